@@ -0,0 +1,330 @@
+// Package ast represents lox programs as syntax trees. Programs are parsed
+// with the compiler's scanner and precedence table, and can be compiled
+// to bytecode by walking the tree.
+package ast
+
+import "github.com/Braden-Griebel/cloxgo/vm"
+
+// Node is implemented by every node of the tree
+type Node interface {
+	// Pos returns the position of the first character of the node
+	Pos() vm.Position
+	// End returns the position just past the last character of the node
+	End() vm.Position
+}
+
+// Expr is implemented by expression nodes
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Stmt is implemented by statement and declaration nodes
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// after returns the position just past text, which starts at pos
+func after(pos vm.Position, text string) vm.Position {
+	for _, c := range text {
+		pos.Offset++
+		if c == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
+
+// region Expressions
+
+// Ident is a name, read as a variable when it is used as an expression
+type Ident struct {
+	NamePos vm.Position
+	Name    string
+}
+
+// Literal is a number, string, true, false or nil
+type Literal struct {
+	ValuePos vm.Position
+	// TOKEN_NUMBER, TOKEN_STRING, TOKEN_TRUE, TOKEN_FALSE or TOKEN_NIL
+	Kind vm.TokenType
+	// Source text of the literal, including the quotes around a string
+	Raw string
+}
+
+// Grouping is an expression in parentheses
+type Grouping struct {
+	Lparen vm.Position
+	X      Expr
+	Rparen vm.Position
+}
+
+// Unary is a prefix operator, ! or -, applied to its operand
+type Unary struct {
+	OpPos vm.Position
+	Op    vm.TokenType
+	X     Expr
+}
+
+// Binary is an arithmetic, comparison or equality operator
+type Binary struct {
+	X     Expr
+	OpPos vm.Position
+	Op    vm.TokenType
+	Y     Expr
+}
+
+// Logical is an and or or, which only evaluates Y when X doesn't decide
+// the result
+type Logical struct {
+	X     Expr
+	OpPos vm.Position
+	Op    vm.TokenType
+	Y     Expr
+}
+
+// Assign assigns to a variable
+type Assign struct {
+	Name  *Ident
+	Value Expr
+}
+
+// Call calls a function, class or method. Calling a Get or Super
+// directly invokes the method without binding it.
+type Call struct {
+	Callee Expr
+	Lparen vm.Position
+	Args   []Expr
+	Rparen vm.Position
+}
+
+// Get reads a property of an instance
+type Get struct {
+	X    Expr
+	Name *Ident
+}
+
+// Set assigns to a field of an instance
+type Set struct {
+	X     Expr
+	Name  *Ident
+	Value Expr
+}
+
+// This is the instance a method was called on
+type This struct {
+	Keyword vm.Position
+}
+
+// Super is a superclass method bound to the current instance
+type Super struct {
+	Keyword vm.Position
+	Method  *Ident
+}
+
+func (expr *Ident) Pos() vm.Position    { return expr.NamePos }
+func (expr *Literal) Pos() vm.Position  { return expr.ValuePos }
+func (expr *Grouping) Pos() vm.Position { return expr.Lparen }
+func (expr *Unary) Pos() vm.Position    { return expr.OpPos }
+func (expr *Binary) Pos() vm.Position   { return expr.X.Pos() }
+func (expr *Logical) Pos() vm.Position  { return expr.X.Pos() }
+func (expr *Assign) Pos() vm.Position   { return expr.Name.Pos() }
+func (expr *Call) Pos() vm.Position     { return expr.Callee.Pos() }
+func (expr *Get) Pos() vm.Position      { return expr.X.Pos() }
+func (expr *Set) Pos() vm.Position      { return expr.X.Pos() }
+func (expr *This) Pos() vm.Position     { return expr.Keyword }
+func (expr *Super) Pos() vm.Position    { return expr.Keyword }
+
+func (expr *Ident) End() vm.Position    { return after(expr.NamePos, expr.Name) }
+func (expr *Literal) End() vm.Position  { return after(expr.ValuePos, expr.Raw) }
+func (expr *Grouping) End() vm.Position { return after(expr.Rparen, ")") }
+func (expr *Unary) End() vm.Position    { return expr.X.End() }
+func (expr *Binary) End() vm.Position   { return expr.Y.End() }
+func (expr *Logical) End() vm.Position  { return expr.Y.End() }
+func (expr *Assign) End() vm.Position   { return expr.Value.End() }
+func (expr *Call) End() vm.Position     { return after(expr.Rparen, ")") }
+func (expr *Get) End() vm.Position      { return expr.Name.End() }
+func (expr *Set) End() vm.Position      { return expr.Value.End() }
+func (expr *This) End() vm.Position     { return after(expr.Keyword, "this") }
+func (expr *Super) End() vm.Position    { return expr.Method.End() }
+
+func (*Ident) exprNode()    {}
+func (*Literal) exprNode()  {}
+func (*Grouping) exprNode() {}
+func (*Unary) exprNode()    {}
+func (*Binary) exprNode()   {}
+func (*Logical) exprNode()  {}
+func (*Assign) exprNode()   {}
+func (*Call) exprNode()     {}
+func (*Get) exprNode()      {}
+func (*Set) exprNode()      {}
+func (*This) exprNode()     {}
+func (*Super) exprNode()    {}
+
+// endregion Expressions
+
+// region Statements
+
+// ExprStmt evaluates an expression and discards its value
+type ExprStmt struct {
+	X         Expr
+	Semicolon vm.Position
+}
+
+// PrintStmt prints the value of an expression
+type PrintStmt struct {
+	Keyword   vm.Position
+	X         Expr
+	Semicolon vm.Position
+}
+
+// VarDecl declares a variable
+type VarDecl struct {
+	Keyword vm.Position
+	Name    *Ident
+	// Initial value of the variable, nil if it starts out as nil
+	Init      Expr
+	Semicolon vm.Position
+}
+
+// Function is the name, parameters and body of a function or method
+type Function struct {
+	Name   *Ident
+	Params []*Ident
+	Body   *Block
+}
+
+// FunDecl declares a function
+type FunDecl struct {
+	Keyword  vm.Position
+	Function *Function
+}
+
+// ClassDecl declares a class
+type ClassDecl struct {
+	Keyword vm.Position
+	Name    *Ident
+	// Class being inherited from, nil if there isn't one
+	Superclass *Ident
+	Lbrace     vm.Position
+	Methods    []*Function
+	Rbrace     vm.Position
+}
+
+// Block is a list of statements with their own scope
+type Block struct {
+	Lbrace vm.Position
+	Stmts  []Stmt
+	Rbrace vm.Position
+}
+
+// IfStmt runs Then when the condition is truthy, and Else otherwise
+type IfStmt struct {
+	Keyword vm.Position
+	Cond    Expr
+	Then    Stmt
+	// Statement after the else keyword, nil if there isn't one
+	Else Stmt
+}
+
+// WhileStmt runs its body for as long as the condition is truthy
+type WhileStmt struct {
+	Keyword vm.Position
+	Cond    Expr
+	Body    Stmt
+}
+
+// ForStmt is a for loop, any of whose clauses may be nil
+type ForStmt struct {
+	Keyword vm.Position
+	// VarDecl or ExprStmt run before the loop
+	Init Stmt
+	Cond Expr
+	// Expression evaluated after each iteration
+	Incr Expr
+	Body Stmt
+}
+
+// ReturnStmt returns from a function
+type ReturnStmt struct {
+	Keyword vm.Position
+	// Value returned, nil for a bare return
+	Value     Expr
+	Semicolon vm.Position
+}
+
+// Program is the list of declarations making up a whole file
+type Program struct {
+	Stmts []Stmt
+	// Every comment in the file, in the order they appear
+	Comments []*Comment
+	// Position of the end of the file
+	EOF vm.Position `json:"eof"`
+}
+
+func (stmt *ExprStmt) Pos() vm.Position   { return stmt.X.Pos() }
+func (stmt *PrintStmt) Pos() vm.Position  { return stmt.Keyword }
+func (stmt *VarDecl) Pos() vm.Position    { return stmt.Keyword }
+func (stmt *FunDecl) Pos() vm.Position    { return stmt.Keyword }
+func (stmt *ClassDecl) Pos() vm.Position  { return stmt.Keyword }
+func (stmt *Block) Pos() vm.Position      { return stmt.Lbrace }
+func (stmt *IfStmt) Pos() vm.Position     { return stmt.Keyword }
+func (stmt *WhileStmt) Pos() vm.Position  { return stmt.Keyword }
+func (stmt *ForStmt) Pos() vm.Position    { return stmt.Keyword }
+func (stmt *ReturnStmt) Pos() vm.Position { return stmt.Keyword }
+
+func (stmt *ExprStmt) End() vm.Position   { return after(stmt.Semicolon, ";") }
+func (stmt *PrintStmt) End() vm.Position  { return after(stmt.Semicolon, ";") }
+func (stmt *VarDecl) End() vm.Position    { return after(stmt.Semicolon, ";") }
+func (stmt *FunDecl) End() vm.Position    { return stmt.Function.End() }
+func (stmt *ClassDecl) End() vm.Position  { return after(stmt.Rbrace, "}") }
+func (stmt *Block) End() vm.Position      { return after(stmt.Rbrace, "}") }
+func (stmt *WhileStmt) End() vm.Position  { return stmt.Body.End() }
+func (stmt *ForStmt) End() vm.Position    { return stmt.Body.End() }
+func (stmt *ReturnStmt) End() vm.Position { return after(stmt.Semicolon, ";") }
+
+func (stmt *IfStmt) End() vm.Position {
+	if stmt.Else != nil {
+		return stmt.Else.End()
+	}
+	return stmt.Then.End()
+}
+
+func (*ExprStmt) stmtNode()   {}
+func (*PrintStmt) stmtNode()  {}
+func (*VarDecl) stmtNode()    {}
+func (*FunDecl) stmtNode()    {}
+func (*ClassDecl) stmtNode()  {}
+func (*Block) stmtNode()      {}
+func (*IfStmt) stmtNode()     {}
+func (*WhileStmt) stmtNode()  {}
+func (*ForStmt) stmtNode()    {}
+func (*ReturnStmt) stmtNode() {}
+
+func (function *Function) Pos() vm.Position { return function.Name.Pos() }
+func (function *Function) End() vm.Position { return function.Body.End() }
+
+func (program *Program) Pos() vm.Position {
+	if len(program.Stmts) > 0 {
+		return program.Stmts[0].Pos()
+	}
+	return program.EOF
+}
+
+func (program *Program) End() vm.Position { return program.EOF }
+
+// endregion Statements
+
+// Comment is a // comment, which runs to the end of its line
+type Comment struct {
+	Slash vm.Position
+	// Text of the comment, starting with the slashes
+	Text string
+}
+
+func (comment *Comment) Pos() vm.Position { return comment.Slash }
+func (comment *Comment) End() vm.Position { return after(comment.Slash, comment.Text) }
@@ -0,0 +1,791 @@
+package ast
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// local is a variable in a function's stack frame
+type local struct {
+	name string
+	// Scope depth of the variable, -1 until its initializer has run
+	depth      int
+	isCaptured bool
+}
+
+// upvalue is a variable captured from an enclosing function
+type upvalue struct {
+	index   byte
+	isLocal bool
+}
+
+// constantKey identifies a number, by its bits, or a string, by its
+// text, so that it is only stored once per chunk
+type constantKey struct {
+	isString bool
+	bits     uint64
+	text     string
+}
+
+// function holds the state of a function being generated, like the
+// compiler's Compiler
+type function struct {
+	enclosing    *function
+	functionType vm.FunctionType
+	chunk        vm.Chunk
+	locals       []local
+	upvalues     []upvalue
+	scopeDepth   int
+	constants    map[constantKey]int
+}
+
+// class tracks the class whose methods are being generated
+type class struct {
+	enclosing     *class
+	hasSuperclass bool
+}
+
+// generator walks a tree, writing the same bytecode the compiler writes
+// for the source it was parsed from
+type generator struct {
+	function    *function
+	class       *class
+	diagnostics []vm.Diagnostic
+	panicMode   bool
+}
+
+// Generate compiles a program parsed without errors into the chunk of its
+// top level script, reporting the same errors the compiler does. The
+// strings and functions in the chunk's constants belong to no VM until it
+// is run with VM.InterpretChunk.
+func Generate(program *Program) (*vm.Chunk, []vm.Diagnostic) {
+	var generator generator
+	generator.beginFunction(vm.TYPE_SCRIPT)
+	generator.declarations(program.Stmts)
+	script := generator.endFunction(program.EOF.Line)
+
+	if len(generator.diagnostics) > 0 {
+		return nil, generator.diagnostics
+	}
+	// Catches code the VM can't run, which would be a bug in the generator
+	if err := script.chunk.Verify(); err != nil {
+		generator.errorAt(program.EOF, "", err.Error())
+		return nil, generator.diagnostics
+	}
+	return &script.chunk, nil
+}
+
+// region Declarations
+
+// declarations generates a list of declarations, allowing an error to be
+// reported in each of them
+func (generator *generator) declarations(stmts []Stmt) {
+	for _, stmt := range stmts {
+		generator.statement(stmt)
+		generator.panicMode = false
+	}
+}
+
+func (generator *generator) classDeclaration(decl *ClassDecl) {
+	line := decl.Name.NamePos.Line
+	nameConstant := generator.identifierConstant(decl.Name)
+	generator.declareVariable(decl.Name)
+
+	generator.emitConstantOp(line, vm.OP_CLASS, nameConstant)
+	generator.defineVariable(nameConstant, line)
+
+	class := &class{enclosing: generator.class}
+	generator.class = class
+
+	if decl.Superclass != nil {
+		line = decl.Superclass.NamePos.Line
+		generator.namedVariable(decl.Superclass, nil, line)
+
+		if decl.Superclass.Name == decl.Name.Name {
+			generator.errorAtIdent(decl.Superclass, "A class can't inherit from itself.")
+		}
+
+		// Store the superclass in a local so methods can capture it for super
+		generator.beginScope()
+		generator.addLocal(&Ident{NamePos: decl.Superclass.NamePos, Name: "super"})
+		generator.defineVariable(0, line)
+
+		generator.namedVariable(decl.Name, nil, line)
+		generator.emit(line, vm.OP_INHERIT)
+		class.hasSuperclass = true
+	}
+
+	// Load the class back onto the stack so methods can be bound to it
+	generator.namedVariable(decl.Name, nil, line)
+	for _, method := range decl.Methods {
+		constant := generator.identifierConstant(method.Name)
+
+		functionType := vm.TYPE_METHOD
+		if method.Name.Name == "init" {
+			functionType = vm.TYPE_INITIALIZER
+		}
+		generator.functionBody(method, functionType)
+
+		generator.emitConstantOp(method.Body.Rbrace.Line, vm.OP_METHOD, constant)
+	}
+	generator.emit(decl.Rbrace.Line, vm.OP_POP)
+
+	if class.hasSuperclass {
+		generator.endScope(decl.Rbrace.Line)
+	}
+
+	generator.class = class.enclosing
+}
+
+func (generator *generator) funDeclaration(decl *FunDecl) {
+	global := generator.parseVariable(decl.Function.Name)
+	generator.markInitialized()
+	generator.functionBody(decl.Function, vm.TYPE_FUNCTION)
+	generator.defineVariable(global, decl.Function.Body.Rbrace.Line)
+}
+
+// functionBody generates a function as a constant of the enclosing one,
+// and the closure which captures its upvalues
+func (generator *generator) functionBody(function *Function, functionType vm.FunctionType) {
+	generator.beginFunction(functionType)
+	generator.beginScope()
+
+	for _, param := range function.Params {
+		constant := generator.parseVariable(param)
+		generator.defineVariable(constant, param.NamePos.Line)
+	}
+	generator.declarations(function.Body.Stmts)
+
+	// No endScope needed, the whole frame is discarded on return
+	line := function.Body.Rbrace.Line
+	compiled := generator.endFunction(line)
+	value := vm.FunctionConstant(function.Name.Name, len(function.Params), len(compiled.upvalues), &compiled.chunk)
+	constant := generator.makeConstant(value, constantKey{}, false, function.Body.Rbrace, "}")
+	generator.emitConstantOp(line, vm.OP_CLOSURE, constant)
+
+	for _, upvalue := range compiled.upvalues {
+		isLocal := vm.OpCode(0)
+		if upvalue.isLocal {
+			isLocal = 1
+		}
+		generator.emit(line, isLocal, vm.OpCode(upvalue.index))
+	}
+}
+
+func (generator *generator) varDeclaration(decl *VarDecl) {
+	global := generator.parseVariable(decl.Name)
+
+	if decl.Init != nil {
+		generator.expression(decl.Init)
+	} else {
+		generator.emit(decl.Name.NamePos.Line, vm.OP_NIL)
+	}
+
+	generator.defineVariable(global, decl.Semicolon.Line)
+}
+
+// parseVariable declares a variable, returning the constant holding its
+// name if it is a global
+func (generator *generator) parseVariable(name *Ident) int {
+	generator.declareVariable(name)
+	if generator.function.scopeDepth > 0 {
+		return 0
+	}
+
+	return generator.identifierConstant(name)
+}
+
+func (generator *generator) declareVariable(name *Ident) {
+	function := generator.function
+	if function.scopeDepth == 0 {
+		return
+	}
+
+	for i := len(function.locals) - 1; i >= 0; i-- {
+		local := &function.locals[i]
+		if local.depth != -1 && local.depth < function.scopeDepth {
+			break
+		}
+
+		if local.name == name.Name {
+			generator.errorAtIdent(name, "Already a variable with this name in this scope.")
+		}
+	}
+
+	generator.addLocal(name)
+}
+
+func (generator *generator) addLocal(name *Ident) {
+	if len(generator.function.locals) == vm.UINT8_COUNT {
+		generator.errorAtIdent(name, "Too many local variables in function.")
+		return
+	}
+
+	generator.function.locals = append(generator.function.locals, local{name: name.Name, depth: -1})
+}
+
+func (generator *generator) markInitialized() {
+	function := generator.function
+	if function.scopeDepth == 0 {
+		return
+	}
+	function.locals[len(function.locals)-1].depth = function.scopeDepth
+}
+
+func (generator *generator) identifierConstant(name *Ident) int {
+	key := constantKey{isString: true, text: name.Name}
+	return generator.makeConstant(vm.StringConstant(name.Name), key, true, name.NamePos, name.Name)
+}
+
+func (generator *generator) defineVariable(global int, line int) {
+	if generator.function.scopeDepth > 0 {
+		generator.markInitialized()
+		return
+	}
+
+	generator.emitConstantOp(line, vm.OP_DEFINE_GLOBAL, global)
+}
+
+// endregion Declarations
+
+// region Statements
+
+func (generator *generator) statement(stmt Stmt) {
+	switch stmt := stmt.(type) {
+	case *ClassDecl:
+		generator.classDeclaration(stmt)
+	case *FunDecl:
+		generator.funDeclaration(stmt)
+	case *VarDecl:
+		generator.varDeclaration(stmt)
+	case *PrintStmt:
+		generator.expression(stmt.X)
+		generator.emit(stmt.Semicolon.Line, vm.OP_PRINT)
+	case *ForStmt:
+		generator.forStatement(stmt)
+	case *IfStmt:
+		generator.ifStatement(stmt)
+	case *ReturnStmt:
+		generator.returnStatement(stmt)
+	case *WhileStmt:
+		generator.whileStatement(stmt)
+	case *Block:
+		generator.beginScope()
+		generator.declarations(stmt.Stmts)
+		generator.endScope(stmt.Rbrace.Line)
+	case *ExprStmt:
+		generator.expression(stmt.X)
+		generator.emit(stmt.Semicolon.Line, vm.OP_POP)
+	}
+}
+
+func (generator *generator) beginScope() {
+	generator.function.scopeDepth++
+}
+
+func (generator *generator) endScope(line int) {
+	function := generator.function
+	function.scopeDepth--
+
+	for len(function.locals) > 0 && function.locals[len(function.locals)-1].depth > function.scopeDepth {
+		if function.locals[len(function.locals)-1].isCaptured {
+			generator.emit(line, vm.OP_CLOSE_UPVALUE)
+		} else {
+			generator.emit(line, vm.OP_POP)
+		}
+		function.locals = function.locals[:len(function.locals)-1]
+	}
+}
+
+func (generator *generator) ifStatement(stmt *IfStmt) {
+	generator.expression(stmt.Cond)
+
+	line := stmt.Cond.End().Line
+	thenJump := generator.emitJump(line, vm.OP_JUMP_IF_FALSE)
+	generator.emit(line, vm.OP_POP)
+	generator.statement(stmt.Then)
+
+	line = stmt.Then.End().Line
+	elseJump := generator.emitJump(line, vm.OP_JUMP)
+
+	generator.patchJump(thenJump, stmt.Keyword, "if")
+	generator.emit(line, vm.OP_POP)
+
+	if stmt.Else != nil {
+		generator.statement(stmt.Else)
+	}
+	generator.patchJump(elseJump, stmt.Keyword, "if")
+}
+
+func (generator *generator) returnStatement(stmt *ReturnStmt) {
+	if generator.function.functionType == vm.TYPE_SCRIPT {
+		generator.errorAt(stmt.Keyword, "return", "Can't return from top-level code.")
+	}
+
+	if stmt.Value == nil {
+		generator.emitReturn(stmt.Semicolon.Line)
+	} else {
+		if generator.function.functionType == vm.TYPE_INITIALIZER {
+			generator.errorAt(stmt.Keyword, "return", "Can't return a value from an initializer.")
+		}
+
+		generator.expression(stmt.Value)
+		generator.emit(stmt.Semicolon.Line, vm.OP_RETURN)
+	}
+}
+
+func (generator *generator) whileStatement(stmt *WhileStmt) {
+	loopStart := generator.function.chunk.Count
+	generator.expression(stmt.Cond)
+
+	line := stmt.Cond.End().Line
+	exitJump := generator.emitJump(line, vm.OP_JUMP_IF_FALSE)
+	generator.emit(line, vm.OP_POP)
+	generator.statement(stmt.Body)
+
+	line = stmt.Body.End().Line
+	generator.emitLoop(line, loopStart, stmt.Keyword, "while")
+
+	generator.patchJump(exitJump, stmt.Keyword, "while")
+	generator.emit(line, vm.OP_POP)
+}
+
+func (generator *generator) forStatement(stmt *ForStmt) {
+	generator.beginScope()
+	if stmt.Init != nil {
+		generator.statement(stmt.Init)
+	}
+
+	loopStart := generator.function.chunk.Count
+	exitJump := -1
+	if stmt.Cond != nil {
+		generator.expression(stmt.Cond)
+
+		// Jump out of the loop if the condition is false
+		line := stmt.Cond.End().Line
+		exitJump = int(generator.emitJump(line, vm.OP_JUMP_IF_FALSE))
+		generator.emit(line, vm.OP_POP)
+	}
+
+	if stmt.Incr != nil {
+		line := stmt.Incr.Pos().Line
+		bodyJump := generator.emitJump(line, vm.OP_JUMP)
+		incrementStart := generator.function.chunk.Count
+		generator.expression(stmt.Incr)
+
+		line = stmt.Incr.End().Line
+		generator.emit(line, vm.OP_POP)
+		generator.emitLoop(line, loopStart, stmt.Keyword, "for")
+		loopStart = incrementStart
+		generator.patchJump(bodyJump, stmt.Keyword, "for")
+	}
+
+	generator.statement(stmt.Body)
+	line := stmt.Body.End().Line
+	generator.emitLoop(line, loopStart, stmt.Keyword, "for")
+
+	if exitJump != -1 {
+		generator.patchJump(uint(exitJump), stmt.Keyword, "for")
+		generator.emit(line, vm.OP_POP)
+	}
+
+	generator.endScope(line)
+}
+
+// endregion Statements
+
+// region Expressions
+
+func (generator *generator) expression(expr Expr) {
+	switch expr := expr.(type) {
+	case *Literal:
+		generator.literal(expr)
+	case *Grouping:
+		generator.expression(expr.X)
+	case *Unary:
+		generator.expression(expr.X)
+		line := expr.X.End().Line
+		if expr.Op == vm.TOKEN_BANG {
+			generator.emit(line, vm.OP_NOT)
+		} else {
+			generator.emit(line, vm.OP_NEGATE)
+		}
+	case *Binary:
+		generator.binary(expr)
+	case *Logical:
+		generator.logical(expr)
+	case *Ident:
+		generator.namedVariable(expr, nil, expr.NamePos.Line)
+	case *Assign:
+		generator.namedVariable(expr.Name, expr.Value, expr.Name.NamePos.Line)
+	case *Call:
+		generator.call(expr)
+	case *Get:
+		generator.expression(expr.X)
+		name := generator.identifierConstant(expr.Name)
+		generator.emitConstantOp(expr.Name.NamePos.Line, vm.OP_GET_PROPERTY, name)
+	case *Set:
+		generator.expression(expr.X)
+		name := generator.identifierConstant(expr.Name)
+		generator.expression(expr.Value)
+		generator.emitConstantOp(expr.Value.End().Line, vm.OP_SET_PROPERTY, name)
+	case *This:
+		if generator.class == nil {
+			generator.errorAt(expr.Keyword, "this", "Can't use 'this' outside of a class.")
+			return
+		}
+		generator.namedVariable(&Ident{NamePos: expr.Keyword, Name: "this"}, nil, expr.Keyword.Line)
+	case *Super:
+		generator.super(expr, nil)
+	}
+}
+
+func (generator *generator) literal(expr *Literal) {
+	line := expr.ValuePos.Line
+	switch expr.Kind {
+	case vm.TOKEN_NUMBER:
+		value, _ := strconv.ParseFloat(expr.Raw, 64)
+		key := constantKey{bits: math.Float64bits(value)}
+		generator.emitConstant(vm.NumberValue(value), key, expr, line)
+	case vm.TOKEN_STRING:
+		text := expr.Raw[1 : len(expr.Raw)-1]
+		key := constantKey{isString: true, text: text}
+		generator.emitConstant(vm.StringConstant(text), key, expr, line)
+	case vm.TOKEN_FALSE:
+		generator.emit(line, vm.OP_FALSE)
+	case vm.TOKEN_TRUE:
+		generator.emit(line, vm.OP_TRUE)
+	case vm.TOKEN_NIL:
+		generator.emit(line, vm.OP_NIL)
+	}
+}
+
+func (generator *generator) binary(expr *Binary) {
+	generator.expression(expr.X)
+	generator.expression(expr.Y)
+
+	line := expr.Y.End().Line
+	switch expr.Op {
+	case vm.TOKEN_BANG_EQUAL:
+		generator.emit(line, vm.OP_EQUAL, vm.OP_NOT)
+	case vm.TOKEN_EQUAL_EQUAL:
+		generator.emit(line, vm.OP_EQUAL)
+	case vm.TOKEN_GREATER:
+		generator.emit(line, vm.OP_GREATER)
+	case vm.TOKEN_GREATER_EQUAL:
+		generator.emit(line, vm.OP_LESS, vm.OP_NOT)
+	case vm.TOKEN_LESS:
+		generator.emit(line, vm.OP_LESS)
+	case vm.TOKEN_LESS_EQUAL:
+		generator.emit(line, vm.OP_GREATER, vm.OP_NOT)
+	case vm.TOKEN_PLUS:
+		generator.emit(line, vm.OP_ADD)
+	case vm.TOKEN_MINUS:
+		generator.emit(line, vm.OP_SUBTRACT)
+	case vm.TOKEN_STAR:
+		generator.emit(line, vm.OP_MULTIPLY)
+	case vm.TOKEN_SLASH:
+		generator.emit(line, vm.OP_DIVIDE)
+	}
+}
+
+func (generator *generator) logical(expr *Logical) {
+	generator.expression(expr.X)
+
+	line := expr.OpPos.Line
+	text := strings.ToLower(expr.Op.String())
+	if expr.Op == vm.TOKEN_AND {
+		endJump := generator.emitJump(line, vm.OP_JUMP_IF_FALSE)
+
+		generator.emit(line, vm.OP_POP)
+		generator.expression(expr.Y)
+
+		generator.patchJump(endJump, expr.OpPos, text)
+		return
+	}
+
+	elseJump := generator.emitJump(line, vm.OP_JUMP_IF_FALSE)
+	endJump := generator.emitJump(line, vm.OP_JUMP)
+
+	generator.patchJump(elseJump, expr.OpPos, text)
+	generator.emit(line, vm.OP_POP)
+
+	generator.expression(expr.Y)
+	generator.patchJump(endJump, expr.OpPos, text)
+}
+
+// call generates a call, invoking methods directly when the callee is a
+// property or superclass method
+func (generator *generator) call(expr *Call) {
+	line := expr.Rparen.Line
+	switch callee := expr.Callee.(type) {
+	case *Get:
+		generator.expression(callee.X)
+		name := generator.identifierConstant(callee.Name)
+		argCount := generator.arguments(expr.Args)
+		generator.emitConstantOp(line, vm.OP_INVOKE, name, vm.OpCode(argCount))
+	case *Super:
+		generator.super(callee, expr)
+	default:
+		generator.expression(expr.Callee)
+		argCount := generator.arguments(expr.Args)
+		generator.emit(line, vm.OP_CALL, vm.OpCode(argCount))
+	}
+}
+
+func (generator *generator) arguments(args []Expr) byte {
+	for _, arg := range args {
+		generator.expression(arg)
+	}
+	return byte(len(args))
+}
+
+// super generates a superclass method lookup, invoking it with the
+// arguments of call unless call is nil
+func (generator *generator) super(expr *Super, call *Call) {
+	if generator.class == nil {
+		generator.errorAt(expr.Keyword, "super", "Can't use 'super' outside of a class.")
+	} else if !generator.class.hasSuperclass {
+		generator.errorAt(expr.Keyword, "super", "Can't use 'super' in a class with no superclass.")
+	}
+
+	name := generator.identifierConstant(expr.Method)
+	line := expr.Method.NamePos.Line
+	generator.namedVariable(&Ident{NamePos: expr.Keyword, Name: "this"}, nil, line)
+	superclass := &Ident{NamePos: expr.Keyword, Name: "super"}
+	if call != nil {
+		argCount := generator.arguments(call.Args)
+		line = call.Rparen.Line
+		generator.namedVariable(superclass, nil, line)
+		generator.emitConstantOp(line, vm.OP_SUPER_INVOKE, name, vm.OpCode(argCount))
+	} else {
+		generator.namedVariable(superclass, nil, line)
+		generator.emitConstantOp(line, vm.OP_GET_SUPER, name)
+	}
+}
+
+// namedVariable loads a variable, emitted on line, or assigns value to
+// it if value isn't nil
+func (generator *generator) namedVariable(name *Ident, value Expr, line int) {
+	var getOp, setOp vm.OpCode
+	var arg int
+	if slot := generator.resolveLocal(generator.function, name); slot != -1 {
+		arg = slot
+		getOp = vm.OP_GET_LOCAL
+		setOp = vm.OP_SET_LOCAL
+	} else if index := generator.resolveUpvalue(generator.function, name); index != -1 {
+		arg = index
+		getOp = vm.OP_GET_UPVALUE
+		setOp = vm.OP_SET_UPVALUE
+	} else {
+		arg = generator.identifierConstant(name)
+		getOp = vm.OP_GET_GLOBAL
+		setOp = vm.OP_SET_GLOBAL
+	}
+
+	// Slots and upvalue indexes always fit in a byte, so only globals
+	// take the long form
+	if value != nil {
+		generator.expression(value)
+		generator.emitConstantOp(value.End().Line, setOp, arg)
+	} else {
+		generator.emitConstantOp(line, getOp, arg)
+	}
+}
+
+// resolveLocal finds the stack slot of a local variable, returning -1
+// if the name refers to a global
+func (generator *generator) resolveLocal(function *function, name *Ident) int {
+	for i := len(function.locals) - 1; i >= 0; i-- {
+		local := &function.locals[i]
+		if local.name == name.Name {
+			if local.depth == -1 {
+				generator.errorAtIdent(name, "Can't read local variable in its own initializer.")
+			}
+			return i
+		}
+	}
+
+	return -1
+}
+
+// resolveUpvalue finds the upvalue index of a variable declared in an
+// enclosing function, returning -1 if the name refers to a global
+func (generator *generator) resolveUpvalue(function *function, name *Ident) int {
+	if function.enclosing == nil {
+		return -1
+	}
+
+	local := generator.resolveLocal(function.enclosing, name)
+	if local != -1 {
+		function.enclosing.locals[local].isCaptured = true
+		return generator.addUpvalue(function, byte(local), true, name)
+	}
+
+	upvalue := generator.resolveUpvalue(function.enclosing, name)
+	if upvalue != -1 {
+		return generator.addUpvalue(function, byte(upvalue), false, name)
+	}
+
+	return -1
+}
+
+func (generator *generator) addUpvalue(function *function, index byte, isLocal bool, name *Ident) int {
+	for i, upvalue := range function.upvalues {
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if len(function.upvalues) == vm.UINT8_COUNT {
+		generator.errorAtIdent(name, "Too many closure variables in function.")
+		return 0
+	}
+
+	function.upvalues = append(function.upvalues, upvalue{index: index, isLocal: isLocal})
+	return len(function.upvalues) - 1
+}
+
+// endregion Expressions
+
+// region Constants
+
+// emitConstant loads value
+func (generator *generator) emitConstant(value vm.Value, key constantKey, literal *Literal, line int) {
+	constant := generator.makeConstant(value, key, true, literal.ValuePos, literal.Raw)
+	generator.emitConstantOp(line, vm.OP_CONSTANT, constant)
+}
+
+// emitConstantOp emits op with the index of a constant followed by
+// operands, using the long form of op once the constants no longer fit
+// in a byte
+func (generator *generator) emitConstantOp(line int, op vm.OpCode, constant int, operands ...vm.OpCode) {
+	if constant <= math.MaxUint8 {
+		generator.emit(line, op, vm.OpCode(constant))
+	} else {
+		generator.emit(line, op.LongForm(), vm.OpCode(constant>>16), vm.OpCode(constant>>8), vm.OpCode(constant))
+	}
+	generator.emit(line, operands...)
+}
+
+// makeConstant adds value to the chunk's constants and returns its index,
+// reusing an identical number or string when shared is set. Errors are
+// reported at text, which starts at pos.
+func (generator *generator) makeConstant(value vm.Value, key constantKey, shared bool, pos vm.Position, text string) int {
+	function := generator.function
+	if shared {
+		if constant, ok := function.constants[key]; ok {
+			return constant
+		}
+	}
+
+	constant := vm.AddConstant(&function.chunk, value)
+	if constant >= vm.CONSTANTS_MAX {
+		generator.errorAt(pos, text, "Too many constants in one chunk.")
+		return 0
+	}
+	if shared {
+		function.constants[key] = constant
+	}
+	return constant
+}
+
+// endregion Constants
+
+// region Helper Functions
+
+// beginFunction starts generating a function nested in the current one
+func (generator *generator) beginFunction(functionType vm.FunctionType) {
+	function := &function{
+		enclosing:    generator.function,
+		functionType: functionType,
+		chunk:        vm.InitChunk(),
+		constants:    make(map[constantKey]int),
+	}
+
+	// Slot zero holds the function itself, or the instance in methods
+	name := ""
+	if functionType != vm.TYPE_FUNCTION && functionType != vm.TYPE_SCRIPT {
+		name = "this"
+	}
+	function.locals = append(function.locals, local{name: name, depth: 0})
+	generator.function = function
+}
+
+// endFunction finishes the innermost function and returns to the one
+// enclosing it
+func (generator *generator) endFunction(line int) *function {
+	generator.emitReturn(line)
+	function := generator.function
+	generator.function = function.enclosing
+	return function
+}
+
+func (generator *generator) emitReturn(line int) {
+	// Initializers implicitly return the instance in slot zero
+	if generator.function.functionType == vm.TYPE_INITIALIZER {
+		generator.emit(line, vm.OP_GET_LOCAL, 0)
+	} else {
+		generator.emit(line, vm.OP_NIL)
+	}
+	generator.emit(line, vm.OP_RETURN)
+}
+
+func (generator *generator) emit(line int, codebytes ...vm.OpCode) {
+	for _, codebyte := range codebytes {
+		vm.WriteChunk(&generator.function.chunk, codebyte, uint(line))
+	}
+}
+
+// emitJump writes a jump instruction with a placeholder offset, returning
+// the location of the offset so it can be patched later
+func (generator *generator) emitJump(line int, instruction vm.OpCode) uint {
+	generator.emit(line, instruction, 0xff, 0xff)
+	return generator.function.chunk.Count - 2
+}
+
+// patchJump backfills the jump offset at offset to land on the next
+// instruction, reporting a jump too long at the keyword starting at pos
+func (generator *generator) patchJump(offset uint, pos vm.Position, keyword string) {
+	chunk := &generator.function.chunk
+	// -2 to adjust for the bytecode for the jump offset itself
+	jump := chunk.Count - offset - 2
+
+	if jump > math.MaxUint16 {
+		generator.errorAt(pos, keyword, "Too much code to jump over.")
+	}
+
+	chunk.Code[offset] = vm.OpCode((jump >> 8) & 0xff)
+	chunk.Code[offset+1] = vm.OpCode(jump & 0xff)
+}
+
+func (generator *generator) emitLoop(line int, loopStart uint, pos vm.Position, keyword string) {
+	generator.emit(line, vm.OP_LOOP)
+
+	offset := generator.function.chunk.Count - loopStart + 2
+	if offset > math.MaxUint16 {
+		generator.errorAt(pos, keyword, "Loop body too large.")
+	}
+
+	generator.emit(line, vm.OpCode((offset>>8)&0xff), vm.OpCode(offset&0xff))
+}
+
+func (generator *generator) errorAtIdent(name *Ident, message string) {
+	generator.errorAt(name.NamePos, name.Name, message)
+}
+
+// errorAt records an error at text, which starts at pos. Further errors
+// in the same declaration are ignored, since they are likely caused by
+// the first.
+func (generator *generator) errorAt(pos vm.Position, text string, message string) {
+	if generator.panicMode {
+		return
+	}
+	generator.panicMode = true
+	generator.diagnostics = append(generator.diagnostics, vm.NewDiagnostic(vm.SEVERITY_ERROR, pos, text, message))
+}
+
+// endregion Helper Functions
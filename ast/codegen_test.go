@@ -0,0 +1,66 @@
+package ast
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// readTestdata returns the source of each lox file in testdata by name
+func readTestdata(t *testing.T) map[string]string {
+	t.Helper()
+	filenames, err := filepath.Glob(filepath.Join("testdata", "*.lox"))
+	if err != nil || len(filenames) == 0 {
+		t.Fatalf("no lox files in testdata: %v", err)
+	}
+	sources := make(map[string]string)
+	for _, filename := range filenames {
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[filepath.Base(filename)] = string(source)
+	}
+	return sources
+}
+
+func TestGenerateMatchesCompiler(t *testing.T) {
+	for name, source := range readTestdata(t) {
+		program, diagnostics := Parse(source)
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", name, diagnostics)
+			continue
+		}
+		chunk, generated := Generate(program)
+
+		machine := vm.InitVM(vm.WithOptimizationLevel(vm.OPTIMIZE_NONE))
+		function, compiled := vm.Compile(source, &machine)
+		if !reflect.DeepEqual(generated, compiled) {
+			t.Errorf("%s: generator reported %v, compiler reported %v", name, generated, compiled)
+		}
+		if function == nil || chunk == nil {
+			if function != nil || chunk != nil {
+				t.Errorf("%s: only one of the generator and compiler made a chunk", name)
+			}
+			machine.FreeVM()
+			continue
+		}
+
+		want, err := function.Chunk().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := chunk.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: generated chunk differs from the compiled one", name)
+		}
+		machine.FreeVM()
+	}
+}
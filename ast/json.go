@@ -0,0 +1,134 @@
+package ast
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// ToJSON encodes node and everything below it as JSON. Each node becomes
+// an object holding its type, its start and end positions and then its
+// fields in declaration order. Fields are keyed by their name with the
+// first letter lower cased, or by their json tag. Token types are written
+// by name.
+func ToJSON(node Node) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := encodeJSON(&buffer, reflect.ValueOf(node)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+var (
+	nodeType      = reflect.TypeOf((*Node)(nil)).Elem()
+	positionType  = reflect.TypeOf(vm.Position{})
+	tokenTypeType = reflect.TypeOf(vm.TokenType(0))
+)
+
+// encodeJSON writes value, a node or one of its fields, to buffer
+func encodeJSON(buffer *bytes.Buffer, value reflect.Value) error {
+	switch {
+	case value.Kind() == reflect.Interface || value.Kind() == reflect.Pointer:
+		if value.IsNil() {
+			buffer.WriteString("null")
+			return nil
+		}
+		if value.Kind() == reflect.Interface {
+			return encodeJSON(buffer, value.Elem())
+		}
+		if value.Type().Implements(nodeType) {
+			return encodeNode(buffer, value)
+		}
+		return encodeJSON(buffer, value.Elem())
+	case value.Type() == positionType:
+		position := value.Interface().(vm.Position)
+		return encodeObject(buffer, []string{"line", "column", "offset"}, func(i int) error {
+			return encodeValue(buffer, []int{position.Line, position.Column, position.Offset}[i])
+		})
+	case value.Type() == tokenTypeType:
+		return encodeValue(buffer, value.Interface().(vm.TokenType).String())
+	case value.Kind() == reflect.Slice:
+		buffer.WriteByte('[')
+		for i := 0; i < value.Len(); i++ {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			if err := encodeJSON(buffer, value.Index(i)); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte(']')
+		return nil
+	default:
+		return encodeValue(buffer, value.Interface())
+	}
+}
+
+// encodeNode writes a pointer to a node struct as an object
+func encodeNode(buffer *bytes.Buffer, value reflect.Value) error {
+	node := value.Interface().(Node)
+	fields := value.Elem()
+	keys := []string{"type", "pos", "end"}
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		if key, ok := field.Tag.Lookup("json"); ok {
+			keys = append(keys, key)
+		} else {
+			keys = append(keys, lowerFirst(field.Name))
+		}
+	}
+
+	return encodeObject(buffer, keys, func(i int) error {
+		switch i {
+		case 0:
+			return encodeValue(buffer, fields.Type().Name())
+		case 1:
+			return encodeJSON(buffer, reflect.ValueOf(node.Pos()))
+		case 2:
+			return encodeJSON(buffer, reflect.ValueOf(node.End()))
+		default:
+			return encodeJSON(buffer, fields.Field(i-3))
+		}
+	})
+}
+
+// encodeObject writes an object with the given keys in order, calling
+// encodeField to write the value of the i-th key
+func encodeObject(buffer *bytes.Buffer, keys []string, encodeField func(i int) error) error {
+	buffer.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		if err := encodeValue(buffer, key); err != nil {
+			return err
+		}
+		buffer.WriteByte(':')
+		if err := encodeField(i); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte('}')
+	return nil
+}
+
+// encodeValue writes a plain Go value with encoding/json
+func encodeValue(buffer *bytes.Buffer, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buffer.Write(data)
+	return nil
+}
+
+// lowerFirst lower cases the first letter of a field name, so Lparen
+// becomes lparen
+func lowerFirst(name string) string {
+	first, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToLower(first)) + name[size:]
+}
@@ -0,0 +1,431 @@
+package ast
+
+import (
+	"fmt"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// parser builds a tree from the tokens of a scanner, consuming them
+// exactly as the compiler does so that both report the same syntax errors
+type parser struct {
+	scanner     *vm.Scanner
+	current     vm.Token
+	previous    vm.Token
+	diagnostics []vm.Diagnostic
+	panicMode   bool
+}
+
+// Parse parses source into a program, along with every syntax error
+// found in it. Declarations containing errors, and every declaration
+// around them, are left out of the program, so it is only complete when
+// there are no errors.
+func Parse(source string) (*Program, []vm.Diagnostic) {
+	parser := parser{scanner: vm.NewScanner(source)}
+	program := &Program{}
+
+	parser.advance()
+	for !parser.match(vm.TOKEN_EOF) {
+		if stmt := parser.declaration(); stmt != nil {
+			program.Stmts = append(program.Stmts, stmt)
+		}
+	}
+	program.EOF = parser.previous.Position()
+	for _, comment := range parser.scanner.Comments() {
+		program.Comments = append(program.Comments, &Comment{Slash: comment.Position, Text: comment.Text})
+	}
+
+	return program, parser.diagnostics
+}
+
+// region Declaration Parsing
+
+// declaration parses a declaration or statement, returning nil if it
+// contained an error
+func (parser *parser) declaration() Stmt {
+	// A nested declaration synchronizes after an error, so the error count
+	// is what shows one happened inside this declaration
+	errors := len(parser.diagnostics)
+	panicking := parser.panicMode
+	var stmt Stmt
+	if parser.match(vm.TOKEN_CLASS) {
+		stmt = parser.classDeclaration()
+	} else if parser.match(vm.TOKEN_FUN) {
+		stmt = parser.funDeclaration()
+	} else if parser.match(vm.TOKEN_VAR) {
+		stmt = parser.varDeclaration()
+	} else {
+		stmt = parser.statement()
+	}
+
+	failed := panicking || parser.panicMode || len(parser.diagnostics) > errors
+	if parser.panicMode {
+		parser.synchronize()
+	}
+	if failed {
+		return nil
+	}
+	return stmt
+}
+
+func (parser *parser) classDeclaration() *ClassDecl {
+	decl := &ClassDecl{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_IDENTIFIER, "Expect class name.")
+	decl.Name = parser.ident()
+
+	if parser.match(vm.TOKEN_LESS) {
+		parser.consume(vm.TOKEN_IDENTIFIER, "Expect superclass name.")
+		decl.Superclass = parser.ident()
+	}
+
+	parser.consume(vm.TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	decl.Lbrace = parser.previous.Position()
+	for !parser.check(vm.TOKEN_RIGHT_BRACE) && !parser.check(vm.TOKEN_EOF) {
+		parser.consume(vm.TOKEN_IDENTIFIER, "Expect method name.")
+		decl.Methods = append(decl.Methods, parser.function(parser.ident()))
+	}
+	parser.consume(vm.TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	decl.Rbrace = parser.previous.Position()
+	return decl
+}
+
+func (parser *parser) funDeclaration() *FunDecl {
+	decl := &FunDecl{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_IDENTIFIER, "Expect function name.")
+	decl.Function = parser.function(parser.ident())
+	return decl
+}
+
+// function parses the parameters and body following the name of a
+// function or method
+func (parser *parser) function(name *Ident) *Function {
+	function := &Function{Name: name}
+
+	parser.consume(vm.TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	if !parser.check(vm.TOKEN_RIGHT_PAREN) {
+		for {
+			if len(function.Params) == 255 {
+				parser.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			parser.consume(vm.TOKEN_IDENTIFIER, "Expect parameter name.")
+			function.Params = append(function.Params, parser.ident())
+			if !parser.match(vm.TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	parser.consume(vm.TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	function.Body = parser.block()
+	return function
+}
+
+func (parser *parser) varDeclaration() *VarDecl {
+	decl := &VarDecl{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_IDENTIFIER, "Expect variable name.")
+	decl.Name = parser.ident()
+
+	if parser.match(vm.TOKEN_EQUAL) {
+		decl.Init = parser.expression()
+	}
+	parser.consume(vm.TOKEN_SEMICOLON, "Expect ';' after variable declaration.")
+	decl.Semicolon = parser.previous.Position()
+	return decl
+}
+
+// endregion Declaration Parsing
+
+// region Statement Parsing
+
+func (parser *parser) statement() Stmt {
+	if parser.match(vm.TOKEN_PRINT) {
+		return parser.printStatement()
+	} else if parser.match(vm.TOKEN_FOR) {
+		return parser.forStatement()
+	} else if parser.match(vm.TOKEN_IF) {
+		return parser.ifStatement()
+	} else if parser.match(vm.TOKEN_RETURN) {
+		return parser.returnStatement()
+	} else if parser.match(vm.TOKEN_WHILE) {
+		return parser.whileStatement()
+	} else if parser.match(vm.TOKEN_LEFT_BRACE) {
+		return parser.block()
+	}
+	return parser.expressionStatement()
+}
+
+// block parses the declarations following a {
+func (parser *parser) block() *Block {
+	block := &Block{Lbrace: parser.previous.Position()}
+	for !parser.check(vm.TOKEN_RIGHT_BRACE) && !parser.check(vm.TOKEN_EOF) {
+		if stmt := parser.declaration(); stmt != nil {
+			block.Stmts = append(block.Stmts, stmt)
+		}
+	}
+
+	parser.consume(vm.TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+	block.Rbrace = parser.previous.Position()
+	return block
+}
+
+func (parser *parser) printStatement() *PrintStmt {
+	stmt := &PrintStmt{Keyword: parser.previous.Position()}
+	stmt.X = parser.expression()
+	parser.consume(vm.TOKEN_SEMICOLON, "Expect ';' after value.")
+	stmt.Semicolon = parser.previous.Position()
+	return stmt
+}
+
+func (parser *parser) ifStatement() *IfStmt {
+	stmt := &IfStmt{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	stmt.Cond = parser.expression()
+	parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	stmt.Then = parser.statement()
+	if parser.match(vm.TOKEN_ELSE) {
+		stmt.Else = parser.statement()
+	}
+	return stmt
+}
+
+func (parser *parser) returnStatement() *ReturnStmt {
+	stmt := &ReturnStmt{Keyword: parser.previous.Position()}
+	if !parser.match(vm.TOKEN_SEMICOLON) {
+		stmt.Value = parser.expression()
+		parser.consume(vm.TOKEN_SEMICOLON, "Expect ';' after return value.")
+	}
+	stmt.Semicolon = parser.previous.Position()
+	return stmt
+}
+
+func (parser *parser) whileStatement() *WhileStmt {
+	stmt := &WhileStmt{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	stmt.Cond = parser.expression()
+	parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+	stmt.Body = parser.statement()
+	return stmt
+}
+
+func (parser *parser) forStatement() *ForStmt {
+	stmt := &ForStmt{Keyword: parser.previous.Position()}
+	parser.consume(vm.TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if parser.match(vm.TOKEN_SEMICOLON) {
+		// No initializer
+	} else if parser.match(vm.TOKEN_VAR) {
+		stmt.Init = parser.varDeclaration()
+	} else {
+		stmt.Init = parser.expressionStatement()
+	}
+
+	if !parser.match(vm.TOKEN_SEMICOLON) {
+		stmt.Cond = parser.expression()
+		parser.consume(vm.TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+	}
+
+	if !parser.match(vm.TOKEN_RIGHT_PAREN) {
+		stmt.Incr = parser.expression()
+		parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+	}
+
+	stmt.Body = parser.statement()
+	return stmt
+}
+
+func (parser *parser) expressionStatement() *ExprStmt {
+	stmt := &ExprStmt{X: parser.expression()}
+	parser.consume(vm.TOKEN_SEMICOLON, "Expect ';' after expression.")
+	stmt.Semicolon = parser.previous.Position()
+	return stmt
+}
+
+// endregion Statement Parsing
+
+// region Expression Parsing
+
+func (parser *parser) expression() Expr {
+	return parser.parsePrecedence(vm.PREC_ASSIGNMENT)
+}
+
+// parsePrecedence parses an expression whose operators bind at least as
+// tightly as precedence, using the compiler's table of parse rules. It
+// returns nil after a syntax error.
+func (parser *parser) parsePrecedence(precedence vm.Precedence) Expr {
+	parser.advance()
+	if !vm.GetRule(parser.previous.Type()).HasPrefix() {
+		parser.error("Expect expression.")
+		return nil
+	}
+
+	canAssign := precedence <= vm.PREC_ASSIGNMENT
+	expr := parser.prefix(canAssign)
+
+	for precedence <= vm.GetRule(parser.current.Type()).Precedence() {
+		parser.advance()
+		expr = parser.infix(expr, canAssign)
+	}
+
+	if canAssign && parser.match(vm.TOKEN_EQUAL) {
+		parser.error("Invalid assignment target.")
+	}
+	return expr
+}
+
+// prefix parses an expression starting with the previous token
+func (parser *parser) prefix(canAssign bool) Expr {
+	token := parser.previous
+	switch token.Type() {
+	case vm.TOKEN_LEFT_PAREN:
+		expr := &Grouping{Lparen: token.Position(), X: parser.expression()}
+		parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
+		expr.Rparen = parser.previous.Position()
+		return expr
+	case vm.TOKEN_BANG, vm.TOKEN_MINUS:
+		return &Unary{OpPos: token.Position(), Op: token.Type(), X: parser.parsePrecedence(vm.PREC_UNARY)}
+	case vm.TOKEN_IDENTIFIER:
+		name := parser.ident()
+		if canAssign && parser.match(vm.TOKEN_EQUAL) {
+			return &Assign{Name: name, Value: parser.expression()}
+		}
+		return name
+	case vm.TOKEN_SUPER:
+		parser.consume(vm.TOKEN_DOT, "Expect '.' after 'super'.")
+		parser.consume(vm.TOKEN_IDENTIFIER, "Expect superclass method name.")
+		return &Super{Keyword: token.Position(), Method: parser.ident()}
+	case vm.TOKEN_THIS:
+		return &This{Keyword: token.Position()}
+	case vm.TOKEN_NUMBER, vm.TOKEN_STRING, vm.TOKEN_TRUE, vm.TOKEN_FALSE, vm.TOKEN_NIL:
+		return &Literal{ValuePos: token.Position(), Kind: token.Type(), Raw: parser.scanner.Lexeme(token)}
+	default:
+		// Only reached if the compiler's rules gain a prefix this switch lacks
+		parser.error(fmt.Sprintf("Internal error: no prefix parser for %v.", token.Type()))
+		return nil
+	}
+}
+
+// infix parses the rest of an expression whose operator is the previous
+// token and whose left operand is left
+func (parser *parser) infix(left Expr, canAssign bool) Expr {
+	token := parser.previous
+	switch token.Type() {
+	case vm.TOKEN_LEFT_PAREN:
+		expr := &Call{Callee: left, Lparen: token.Position()}
+		if !parser.check(vm.TOKEN_RIGHT_PAREN) {
+			for {
+				arg := parser.expression()
+				if len(expr.Args) == 255 {
+					parser.error("Can't have more than 255 arguments.")
+				}
+				expr.Args = append(expr.Args, arg)
+				if !parser.match(vm.TOKEN_COMMA) {
+					break
+				}
+			}
+		}
+		parser.consume(vm.TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+		expr.Rparen = parser.previous.Position()
+		return expr
+	case vm.TOKEN_DOT:
+		parser.consume(vm.TOKEN_IDENTIFIER, "Expect property name after '.'.")
+		name := parser.ident()
+		if canAssign && parser.match(vm.TOKEN_EQUAL) {
+			return &Set{X: left, Name: name, Value: parser.expression()}
+		}
+		return &Get{X: left, Name: name}
+	case vm.TOKEN_AND:
+		return &Logical{X: left, OpPos: token.Position(), Op: token.Type(), Y: parser.parsePrecedence(vm.PREC_AND)}
+	case vm.TOKEN_OR:
+		return &Logical{X: left, OpPos: token.Position(), Op: token.Type(), Y: parser.parsePrecedence(vm.PREC_OR)}
+	default:
+		right := parser.parsePrecedence(vm.GetRule(token.Type()).Precedence() + 1)
+		return &Binary{X: left, OpPos: token.Position(), Op: token.Type(), Y: right}
+	}
+}
+
+// ident makes an identifier from the previous token
+func (parser *parser) ident() *Ident {
+	return &Ident{NamePos: parser.previous.Position(), Name: parser.scanner.Lexeme(parser.previous)}
+}
+
+// endregion Expression Parsing
+
+// region Error Handling
+
+func (parser *parser) errorAtCurrent(message string) {
+	parser.errorAt(parser.current, message)
+}
+
+func (parser *parser) error(message string) {
+	parser.errorAt(parser.previous, message)
+}
+
+// errorAt records an error at token. Further errors are ignored until
+// the parser synchronizes, since they are likely caused by the first.
+func (parser *parser) errorAt(token vm.Token, message string) {
+	if parser.panicMode {
+		return
+	}
+	parser.panicMode = true
+	parser.diagnostics = append(parser.diagnostics,
+		vm.NewTokenDiagnostic(vm.SEVERITY_ERROR, token, parser.scanner.Lexeme(token), message))
+}
+
+// synchronize skips tokens until a likely statement boundary so that
+// one error doesn't cascade into many
+func (parser *parser) synchronize() {
+	parser.panicMode = false
+
+	for parser.current.Type() != vm.TOKEN_EOF {
+		if parser.previous.Type() == vm.TOKEN_SEMICOLON {
+			return
+		}
+		switch parser.current.Type() {
+		case vm.TOKEN_CLASS, vm.TOKEN_FUN, vm.TOKEN_VAR, vm.TOKEN_FOR,
+			vm.TOKEN_IF, vm.TOKEN_WHILE, vm.TOKEN_PRINT, vm.TOKEN_RETURN:
+			return
+		default:
+			// Do nothing
+		}
+		parser.advance()
+	}
+}
+
+// endregion Error Handling
+
+// region Helper Functions
+
+func (parser *parser) advance() {
+	parser.previous = parser.current
+	for {
+		parser.current = parser.scanner.ScanToken()
+		if parser.current.Type() != vm.TOKEN_ERROR {
+			break
+		}
+
+		parser.errorAtCurrent(parser.current.ErrorMessage())
+	}
+}
+
+func (parser *parser) consume(tokenType vm.TokenType, message string) {
+	if parser.current.Type() == tokenType {
+		parser.advance()
+		return
+	}
+
+	parser.errorAtCurrent(message)
+}
+
+func (parser *parser) match(tokenType vm.TokenType) bool {
+	if !parser.check(tokenType) {
+		return false
+	}
+	parser.advance()
+	return true
+}
+
+func (parser *parser) check(tokenType vm.TokenType) bool {
+	return parser.current.Type() == tokenType
+}
+
+// endregion Helper Functions
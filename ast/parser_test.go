@@ -0,0 +1,162 @@
+package ast
+
+import (
+	"encoding/json"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+func TestParseReportsCompilerErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// Number of declarations left in the program
+		stmts int
+	}{
+		{"error in a block", "{ print ; } print 1;", 1},
+		{"error in a function", "fun f() { var = 1; } print 1;", 1},
+		{"error in a nested block", "fun f() { if (true) { print 1 } } print 2;", 0},
+		{"bad method name", "class A { for m() { print 1; } } print 1;", 1},
+		{"bad parameter", "class A { m(1) { print 1; } } print 1;", 1},
+		{"error in a method", "class A { m() { print } } print 1;", 0},
+		{"missing brace", "while (true) { print 1;", 0},
+		{"error after a declaration", "var a = 1; { var b = 2; print b + ; }", 1},
+	}
+
+	for _, test := range tests {
+		program, diagnostics := Parse(test.source)
+		machine := vm.InitVM()
+		_, compiled := vm.Compile(test.source, &machine)
+		machine.FreeVM()
+		if len(diagnostics) == 0 || !reflect.DeepEqual(diagnostics, compiled) {
+			t.Errorf("%s: parser reported %v, compiler reported %v", test.name, diagnostics, compiled)
+		}
+		if len(program.Stmts) != test.stmts {
+			t.Errorf("%s: %d declarations, want %d", test.name, len(program.Stmts), test.stmts)
+		}
+		if _, err := ToJSON(program); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+// TestParseBrokenSourceDoesntPanic inserts and deletes tokens in the
+// testdata, which must parse to a tree that can be encoded
+func TestParseBrokenSourceDoesntPanic(t *testing.T) {
+	tokens := []string{"{", "}", "(", ")", ";", ".", ",", "=", "<", "+", "print", "var", "fun", "class",
+		"if", "else", "for", "while", "return", "this", "super", "x", "1", `"s"`}
+	random := rand.New(rand.NewSource(1))
+
+	for name, source := range readTestdata(t) {
+		for i := 0; i < 500; i++ {
+			broken := source
+			for changes := random.Intn(3); changes >= 0; changes-- {
+				position := random.Intn(len(broken))
+				if random.Intn(2) == 0 {
+					broken = broken[:position] + broken[position+1:]
+				} else {
+					broken = broken[:position] + " " + tokens[random.Intn(len(tokens))] + " " + broken[position:]
+				}
+			}
+
+			func() {
+				defer func() {
+					if recovered := recover(); recovered != nil {
+						t.Fatalf("%s: parsing %q panicked: %v", name, broken, recovered)
+					}
+				}()
+				program, _ := Parse(broken)
+				if _, err := ToJSON(program); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}()
+		}
+	}
+}
+
+// TestPrefixMatchesRules walks every token type, checking the parser
+// handles exactly the tokens which have a prefix rule in the compiler
+func TestPrefixMatchesRules(t *testing.T) {
+	// An expression starting with each token with a prefix rule, and the
+	// node it parses to
+	prefixes := map[vm.TokenType]struct {
+		source string
+		want   Expr
+	}{
+		vm.TOKEN_LEFT_PAREN: {"(1)", &Grouping{}},
+		vm.TOKEN_MINUS:      {"-1", &Unary{}},
+		vm.TOKEN_BANG:       {"!1", &Unary{}},
+		vm.TOKEN_IDENTIFIER: {"a", &Ident{}},
+		vm.TOKEN_STRING:     {`"s"`, &Literal{}},
+		vm.TOKEN_NUMBER:     {"1", &Literal{}},
+		vm.TOKEN_FALSE:      {"false", &Literal{}},
+		vm.TOKEN_NIL:        {"nil", &Literal{}},
+		vm.TOKEN_TRUE:       {"true", &Literal{}},
+		vm.TOKEN_SUPER:      {"super.m", &Super{}},
+		vm.TOKEN_THIS:       {"this", &This{}},
+	}
+
+	for tokenType := vm.TokenType(0); tokenType <= vm.TOKEN_EOF; tokenType++ {
+		prefix, ok := prefixes[tokenType]
+		if hasPrefix := vm.GetRule(tokenType).HasPrefix(); hasPrefix != ok {
+			t.Errorf("%v: compiler has a prefix rule %t, test expects one %t", tokenType, hasPrefix, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		program, diagnostics := Parse("print " + prefix.source + ";")
+		if len(diagnostics) > 0 {
+			t.Errorf("%v: %v", tokenType, diagnostics)
+			continue
+		}
+		expr := program.Stmts[0].(*PrintStmt).X
+		if reflect.TypeOf(expr) != reflect.TypeOf(prefix.want) {
+			t.Errorf("%v: parsed to %T, want %T", tokenType, expr, prefix.want)
+		}
+	}
+
+	// Tokens the switch doesn't know are reported rather than parsed
+	parser := parser{scanner: vm.NewScanner(";")}
+	parser.advance()
+	parser.advance()
+	if expr := parser.prefix(false); expr != nil || len(parser.diagnostics) != 1 ||
+		!strings.HasPrefix(parser.diagnostics[0].Message, "Internal error") {
+		t.Errorf("prefix of ';' parsed to %v with diagnostics %v, want an internal error", expr, parser.diagnostics)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	program, diagnostics := Parse("print -a;\n")
+	if len(diagnostics) > 0 {
+		t.Fatal(diagnostics)
+	}
+	data, err := ToJSON(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tree map[string]any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	for _, key := range []string{"type", "pos", "end", "stmts", "comments", "eof"} {
+		if _, ok := tree[key]; !ok {
+			t.Errorf("program has keys %v, missing %q", keys, key)
+		}
+	}
+	for _, text := range []string{`"type":"Unary"`, `"op":"MINUS"`, `"name":"a"`} {
+		if !strings.Contains(string(data), text) {
+			t.Errorf("%s doesn't contain %s", data, text)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package ast
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// INDENT is written once per level of nesting
+const INDENT = "  "
+
+// operators maps the token types of unary and binary operators to their text
+var operators = map[vm.TokenType]string{
+	vm.TOKEN_MINUS:         "-",
+	vm.TOKEN_PLUS:          "+",
+	vm.TOKEN_SLASH:         "/",
+	vm.TOKEN_STAR:          "*",
+	vm.TOKEN_BANG:          "!",
+	vm.TOKEN_BANG_EQUAL:    "!=",
+	vm.TOKEN_EQUAL_EQUAL:   "==",
+	vm.TOKEN_GREATER:       ">",
+	vm.TOKEN_GREATER_EQUAL: ">=",
+	vm.TOKEN_LESS:          "<",
+	vm.TOKEN_LESS_EQUAL:    "<=",
+	vm.TOKEN_AND:           "and",
+	vm.TOKEN_OR:            "or",
+}
+
+// printer writes a program back out as source in the standard layout
+type printer struct {
+	output bytes.Buffer
+	indent int
+	// Whether nothing has been written on the current line yet
+	lineStart bool
+	// Comments not written yet, in the order they appear
+	comments []*Comment
+	// Source line of the last statement or comment written
+	lastLine int
+	// Whether nothing has been written in the current list of statements
+	listStart bool
+}
+
+// Format parses source and prints it back out in the standard layout.
+// Source with syntax errors isn't formatted, since the declarations
+// containing them are missing from the tree.
+func Format(source string) ([]byte, []vm.Diagnostic) {
+	program, diagnostics := Parse(source)
+	if len(diagnostics) > 0 {
+		return nil, diagnostics
+	}
+
+	var output bytes.Buffer
+	_ = Fprint(&output, program)
+	return output.Bytes(), nil
+}
+
+// Fprint writes program to w in the standard layout: one statement per
+// line, indented two spaces per block, with braces on the line opening
+// them. Comments are kept, and so are single blank lines between
+// statements. Comments which can't stay where they are, such as ones
+// inside an expression, are moved to the line before their statement.
+// An if with an else which is the body of another statement is put in
+// braces, so the else isn't read as belonging to that statement.
+func Fprint(w io.Writer, program *Program) error {
+	printer := printer{lineStart: true, comments: program.Comments}
+	printer.statements(program.Stmts, program.EOF)
+	_, err := w.Write(printer.output.Bytes())
+	return err
+}
+
+// region Statements
+
+// statements writes a list of statements with the comments among them,
+// including those before end
+func (printer *printer) statements(stmts []Stmt, end vm.Position) {
+	printer.listStart = true
+	for i, stmt := range stmts {
+		printer.commentsBefore(stmt.Pos())
+		printer.hoistComments(stmt)
+		printer.separate(stmt.Pos().Line)
+		printer.statement(stmt)
+
+		next := end
+		if i+1 < len(stmts) {
+			next = stmts[i+1].Pos()
+		}
+		printer.endLine(stmt.End().Line, next)
+	}
+	printer.commentsBefore(end)
+}
+
+// statement writes stmt, leaving the line open for a trailing comment
+func (printer *printer) statement(stmt Stmt) {
+	switch stmt := stmt.(type) {
+	case *ExprStmt:
+		printer.expression(stmt.X)
+		printer.write(";")
+	case *PrintStmt:
+		printer.write("print ")
+		printer.expression(stmt.X)
+		printer.write(";")
+	case *VarDecl:
+		printer.write("var ", stmt.Name.Name)
+		if stmt.Init != nil {
+			printer.write(" = ")
+			printer.expression(stmt.Init)
+		}
+		printer.write(";")
+	case *FunDecl:
+		printer.write("fun ")
+		printer.function(stmt.Function)
+	case *ClassDecl:
+		printer.class(stmt)
+	case *Block:
+		printer.block(stmt)
+	case *IfStmt:
+		printer.write("if (")
+		printer.expression(stmt.Cond)
+		printer.write(")")
+		printer.body(stmt.Then)
+		if stmt.Else != nil {
+			if _, ok := braced(stmt.Then).(*Block); ok {
+				printer.write(" ")
+			} else {
+				// Any comment after Then has been hoisted
+				printer.newLine()
+				printer.lastLine = stmt.Then.End().Line
+			}
+			// Else if chains are written without braces
+			printer.write("else ")
+			printer.statement(stmt.Else)
+		}
+	case *WhileStmt:
+		printer.write("while (")
+		printer.expression(stmt.Cond)
+		printer.write(")")
+		printer.body(stmt.Body)
+	case *ForStmt:
+		printer.write("for (")
+		if stmt.Init != nil {
+			printer.statement(stmt.Init)
+		} else {
+			printer.write(";")
+		}
+		if stmt.Cond != nil {
+			printer.write(" ")
+			printer.expression(stmt.Cond)
+		}
+		printer.write(";")
+		if stmt.Incr != nil {
+			printer.write(" ")
+			printer.expression(stmt.Incr)
+		}
+		printer.write(")")
+		printer.body(stmt.Body)
+	case *ReturnStmt:
+		printer.write("return")
+		if stmt.Value != nil {
+			printer.write(" ")
+			printer.expression(stmt.Value)
+		}
+		printer.write(";")
+	}
+}
+
+// body writes the statement controlled by an if, while or for on the
+// same line as it
+func (printer *printer) body(stmt Stmt) {
+	printer.write(" ")
+	printer.statement(braced(stmt))
+}
+
+// braced returns the statement to write for the body of an if, while or
+// for. An if with an else is put in a block, since its else starts a new
+// line and would look like it belonged to the statement around it.
+func braced(stmt Stmt) Stmt {
+	if inner, ok := stmt.(*IfStmt); ok && inner.Else != nil {
+		return &Block{Lbrace: inner.Pos(), Stmts: []Stmt{inner}, Rbrace: inner.End()}
+	}
+	return stmt
+}
+
+func (printer *printer) function(function *Function) {
+	printer.write(function.Name.Name, "(")
+	for i, param := range function.Params {
+		if i > 0 {
+			printer.write(", ")
+		}
+		printer.write(param.Name)
+	}
+	printer.write(") ")
+	printer.block(function.Body)
+}
+
+func (printer *printer) class(decl *ClassDecl) {
+	printer.write("class ", decl.Name.Name)
+	if decl.Superclass != nil {
+		printer.write(" < ", decl.Superclass.Name)
+	}
+	if len(decl.Methods) == 0 && !printer.hasCommentBefore(decl.Rbrace) {
+		printer.write(" {}")
+		return
+	}
+
+	printer.write(" {")
+	if len(decl.Methods) > 0 {
+		printer.endLine(decl.Lbrace.Line, decl.Methods[0].Pos())
+	} else {
+		printer.endLine(decl.Lbrace.Line, decl.Rbrace)
+	}
+	printer.indent++
+	printer.listStart = true
+	for i, method := range decl.Methods {
+		printer.commentsBefore(method.Pos())
+		printer.hoistComments(method)
+		printer.separate(method.Pos().Line)
+		printer.function(method)
+
+		next := decl.Rbrace
+		if i+1 < len(decl.Methods) {
+			next = decl.Methods[i+1].Pos()
+		}
+		printer.endLine(method.End().Line, next)
+	}
+	printer.commentsBefore(decl.Rbrace)
+	printer.indent--
+	printer.write("}")
+}
+
+func (printer *printer) block(block *Block) {
+	if len(block.Stmts) == 0 && !printer.hasCommentBefore(block.Rbrace) {
+		printer.write("{}")
+		return
+	}
+
+	printer.write("{")
+	if len(block.Stmts) > 0 {
+		printer.endLine(block.Lbrace.Line, block.Stmts[0].Pos())
+	} else {
+		printer.endLine(block.Lbrace.Line, block.Rbrace)
+	}
+	printer.indent++
+	printer.statements(block.Stmts, block.Rbrace)
+	printer.indent--
+	printer.write("}")
+}
+
+// endregion Statements
+
+// region Expressions
+
+func (printer *printer) expression(expr Expr) {
+	switch expr := expr.(type) {
+	case *Ident:
+		printer.write(expr.Name)
+	case *Literal:
+		printer.write(expr.Raw)
+	case *Grouping:
+		printer.write("(")
+		printer.expression(expr.X)
+		printer.write(")")
+	case *Unary:
+		printer.write(operators[expr.Op])
+		printer.expression(expr.X)
+	case *Binary:
+		printer.expression(expr.X)
+		printer.write(" ", operators[expr.Op], " ")
+		printer.expression(expr.Y)
+	case *Logical:
+		printer.expression(expr.X)
+		printer.write(" ", operators[expr.Op], " ")
+		printer.expression(expr.Y)
+	case *Assign:
+		printer.write(expr.Name.Name, " = ")
+		printer.expression(expr.Value)
+	case *Call:
+		printer.expression(expr.Callee)
+		printer.write("(")
+		for i, arg := range expr.Args {
+			if i > 0 {
+				printer.write(", ")
+			}
+			printer.expression(arg)
+		}
+		printer.write(")")
+	case *Get:
+		printer.expression(expr.X)
+		printer.write(".", expr.Name.Name)
+	case *Set:
+		printer.expression(expr.X)
+		printer.write(".", expr.Name.Name, " = ")
+		printer.expression(expr.Value)
+	case *This:
+		printer.write("this")
+	case *Super:
+		printer.write("super.", expr.Method.Name)
+	}
+}
+
+// endregion Expressions
+
+// region Comments
+
+// commentsBefore writes the comments before pos on lines of their own
+func (printer *printer) commentsBefore(pos vm.Position) {
+	for printer.hasCommentBefore(pos) {
+		comment := printer.comments[0]
+		printer.comments = printer.comments[1:]
+		printer.separate(comment.Slash.Line)
+		printer.write(commentText(comment))
+		printer.newLine()
+		printer.lastLine = comment.Slash.Line
+	}
+}
+
+// hoistComments writes the comments inside node which can't be kept in
+// place on lines of their own. Only comments in the blocks of a node can
+// be, everything else is written on one line.
+func (printer *printer) hoistComments(node Node) {
+	blocks := blocksOf(node, nil)
+	kept := printer.comments[:0:0]
+	hoisted := false
+	for _, comment := range printer.comments {
+		offset := comment.Slash.Offset
+		if offset < node.Pos().Offset || offset >= node.End().Offset || inBlock(offset, blocks) {
+			kept = append(kept, comment)
+			continue
+		}
+
+		// Hoisted comments are kept together, separated from what came
+		// before if the node was
+		if !hoisted {
+			printer.separate(node.Pos().Line)
+			hoisted = true
+		}
+		printer.write(commentText(comment))
+		printer.newLine()
+	}
+	printer.comments = kept
+	if hoisted {
+		printer.lastLine = node.Pos().Line
+	}
+}
+
+// blocksOf appends the blocks within node where comments can stay to
+// blocks, not counting blocks nested in those
+func blocksOf(node Node, blocks []Node) []Node {
+	switch node := node.(type) {
+	case *Block, *ClassDecl:
+		blocks = append(blocks, node)
+	case *FunDecl:
+		blocks = append(blocks, node.Function.Body)
+	case *Function:
+		blocks = append(blocks, node.Body)
+	case *IfStmt:
+		blocks = blocksOf(node.Then, blocks)
+		if node.Else != nil {
+			blocks = blocksOf(node.Else, blocks)
+		}
+	case *WhileStmt:
+		blocks = blocksOf(node.Body, blocks)
+	case *ForStmt:
+		blocks = blocksOf(node.Body, blocks)
+	}
+	return blocks
+}
+
+// inBlock returns whether offset is between the braces of one of blocks
+func inBlock(offset int, blocks []Node) bool {
+	for _, block := range blocks {
+		var lbrace, rbrace vm.Position
+		switch block := block.(type) {
+		case *Block:
+			lbrace, rbrace = block.Lbrace, block.Rbrace
+		case *ClassDecl:
+			lbrace, rbrace = block.Lbrace, block.Rbrace
+		}
+		if offset > lbrace.Offset && offset < rbrace.Offset {
+			return true
+		}
+	}
+	return false
+}
+
+func (printer *printer) hasCommentBefore(pos vm.Position) bool {
+	return len(printer.comments) > 0 && printer.comments[0].Slash.Offset < pos.Offset
+}
+
+// commentText returns the text of a comment without trailing whitespace
+func commentText(comment *Comment) string {
+	return strings.TrimRight(comment.Text, " \t\r")
+}
+
+// endregion Comments
+
+// region Helper Functions
+
+// write writes text to the current line, indenting it first if it is
+// the start of the line
+func (printer *printer) write(text ...string) {
+	if printer.lineStart {
+		for i := 0; i < printer.indent; i++ {
+			printer.output.WriteString(INDENT)
+		}
+		printer.lineStart = false
+	}
+	for _, part := range text {
+		printer.output.WriteString(part)
+	}
+}
+
+func (printer *printer) newLine() {
+	printer.output.WriteByte('\n')
+	printer.lineStart = true
+}
+
+// endLine finishes the line written for source line, with the comment
+// following it there if there is one before next
+func (printer *printer) endLine(line int, next vm.Position) {
+	if printer.hasCommentBefore(next) && printer.comments[0].Slash.Line == line {
+		printer.write(" ", commentText(printer.comments[0]))
+		printer.comments = printer.comments[1:]
+	}
+	printer.newLine()
+	printer.lastLine = line
+}
+
+// separate starts what was on source line, after a blank line if there
+// was at least one before it in the source
+func (printer *printer) separate(line int) {
+	if !printer.listStart && line > printer.lastLine+1 {
+		printer.newLine()
+	}
+	printer.listStart = false
+}
+
+// endregion Helper Functions
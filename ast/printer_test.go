@@ -0,0 +1,80 @@
+package ast
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestFormatGolden formats each lox file in testdata, comparing it with
+// the golden file of the same name
+func TestFormatGolden(t *testing.T) {
+	for name, source := range readTestdata(t) {
+		formatted, diagnostics := Format(source)
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", name, diagnostics)
+			continue
+		}
+
+		golden := filepath.Join("testdata", strings.TrimSuffix(name, ".lox")+".golden")
+		if *update {
+			if err := os.WriteFile(golden, formatted, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(formatted) != string(want) {
+			t.Errorf("%s: formatted as\n%s\nwant\n%s", name, formatted, want)
+		}
+	}
+}
+
+func TestFormatIsIdempotent(t *testing.T) {
+	sources := readTestdata(t)
+	sources["dangling else"] = "if (a) if (a) print 1; else print 2;"
+	sources["dangling else in a loop"] = "while (a) for (;;) if (a) print 1; else if (b) print 2;"
+
+	for name, source := range sources {
+		once, diagnostics := Format(source)
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", name, diagnostics)
+			continue
+		}
+		twice, diagnostics := Format(string(once))
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: formatted source doesn't parse: %v", name, diagnostics)
+			continue
+		}
+		if string(twice) != string(once) {
+			t.Errorf("%s: formatting again changed\n%s\nto\n%s", name, once, twice)
+		}
+	}
+}
+
+// TestFormatKeepsMeaning checks the formatted source compiles to the same
+// code as the original
+func TestFormatKeepsMeaning(t *testing.T) {
+	for name, source := range readTestdata(t) {
+		program, _ := Parse(source)
+		want, _ := Generate(program)
+		formatted, _ := Format(source)
+		program, _ = Parse(string(formatted))
+		got, _ := Generate(program)
+		if (want == nil) != (got == nil) {
+			t.Errorf("%s: formatted source compiles differently", name)
+			continue
+		}
+		if want != nil && !slices.Equal(want.Code[:want.Count], got.Code[:got.Count]) {
+			t.Errorf("%s: formatted source compiles to different code", name)
+		}
+	}
+}
@@ -2,21 +2,71 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"github.com/Braden-Griebel/cloxgo/ast"
+	"github.com/Braden-Griebel/cloxgo/internal/diff"
+	"github.com/Braden-Griebel/cloxgo/lsp"
+	"github.com/Braden-Griebel/cloxgo/vet"
 	"github.com/Braden-Griebel/cloxgo/vm"
 	"io"
 	"os"
+	"strings"
 )
 
+const usage = `Usage: cloxgo [-O0|-O1] [path]
+       cloxgo [-O0|-O1] run path[.loxc]
+       cloxgo [-O0|-O1] compile [-o output.loxc] path
+       cloxgo ast path
+       cloxgo fmt [-w] [-d] [path ...]
+       cloxgo vet [-json] path ...
+       cloxgo lsp
+
+-O0 turns off the optimizer, -O1 (the default) folds constants and
+fuses instructions.
+
+fmt prints the formatted source of each file, or of standard input when
+no path is given. -w rewrites the files in place, and -d prints a diff.
+
+vet reports likely bugs as file:line:column: message, or as a JSON array
+with -json, and exits with status 1 if it finds any. Files which don't
+compile are reported with their errors, and vet exits with status 65.
+
+lsp runs a language server speaking the Language Server Protocol over
+standard input and output.
+`
+
 func main() {
-	machine := vm.InitVM()
+	args, level := optimizationLevel(os.Args[1:])
+
+	// Shared with the VM so readLine and the REPL don't buffer past each other
+	stdin := bufio.NewReader(os.Stdin)
+	machine := vm.InitVM(vm.WithStdin(stdin), vm.WithOptimizationLevel(level))
 
-	if len(os.Args) == 1 {
-		repl(&machine)
-	} else if len(os.Args) == 2 {
-		runFile(&machine, os.Args[1])
+	if len(args) == 0 {
+		repl(&machine, stdin)
+	} else if args[0] == "ast" && len(args) == 2 {
+		dumpTree(args[1])
+	} else if args[0] == "fmt" {
+		formatFiles(args[1:])
+	} else if args[0] == "vet" {
+		vetFiles(&machine, args[1:])
+	} else if args[0] == "lsp" && len(args) == 1 {
+		serveLanguage(&machine, stdin)
+	} else if args[0] == "compile" {
+		compileFile(&machine, args[1:])
+	} else if args[0] == "run" && len(args) == 2 {
+		if strings.HasSuffix(args[1], ".loxc") {
+			runCompiledFile(&machine, args[1])
+		} else {
+			runFile(&machine, args[1])
+		}
+	} else if len(args) == 1 {
+		runFile(&machine, args[0])
 	} else {
-		_, err := os.Stderr.WriteString("Usage: cloxgo [path]\n")
+		_, err := os.Stderr.WriteString(usage)
 		if err != nil {
 			machine.FreeVM()
 			panic(err)
@@ -25,8 +75,25 @@ func main() {
 	machine.FreeVM()
 }
 
-func repl(machine *vm.VM) {
-	reader := bufio.NewReader(os.Stdin)
+// optimizationLevel removes the -O0 and -O1 flags from args, returning
+// the level selected by the last of them
+func optimizationLevel(args []string) ([]string, vm.OptimizationLevel) {
+	level := vm.OPTIMIZE_PEEPHOLE
+	var rest []string
+	for _, arg := range args {
+		switch arg {
+		case "-O0":
+			level = vm.OPTIMIZE_NONE
+		case "-O1":
+			level = vm.OPTIMIZE_PEEPHOLE
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return rest, level
+}
+
+func repl(machine *vm.VM, reader *bufio.Reader) {
 	for {
 		fmt.Print("> ")
 		line, err := reader.ReadString('\n')
@@ -37,7 +104,7 @@ func repl(machine *vm.VM) {
 			machine.FreeVM()
 			panic(err)
 		}
-		_ = machine.Interpret(line)
+		_, _ = machine.Interpret(line)
 	}
 }
 
@@ -47,7 +114,7 @@ func runFile(machine *vm.VM, filename string) {
 		panic("Couldn't read file: " + filename)
 	}
 	programStr := string(program)
-	result := machine.Interpret(programStr)
+	result, _ := machine.InterpretFile(filename, programStr)
 	if result == vm.INTERPRET_COMPILE_ERROR {
 		machine.FreeVM()
 		os.Exit(65)
@@ -58,3 +125,238 @@ func runFile(machine *vm.VM, filename string) {
 	}
 
 }
+
+// compileFile compiles a lox file to bytecode, written next to it with
+// the .loxc extension unless -o is given
+func compileFile(machine *vm.VM, args []string) {
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	output := flags.String("o", "", "path of the compiled file")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		_, _ = os.Stderr.WriteString(usage)
+		os.Exit(64)
+	}
+
+	filename := flags.Arg(0)
+	program, err := os.ReadFile(filename)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Couldn't read file: %s\n", filename)
+		os.Exit(74)
+	}
+	function, diagnostics := vm.CompileFile(filename, string(program), machine)
+	for _, diagnostic := range diagnostics {
+		_, _ = fmt.Fprintln(os.Stderr, diagnostic)
+	}
+	if function == nil {
+		os.Exit(65)
+	}
+
+	data, err := function.Chunk().MarshalBinary()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(70)
+	}
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, ".lox") + ".loxc"
+	}
+	if err := os.WriteFile(*output, data, 0644); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Couldn't write file: %s\n", *output)
+		os.Exit(74)
+	}
+}
+
+// dumpTree prints the syntax tree of a lox file as JSON
+func dumpTree(filename string) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Couldn't read file: %s\n", filename)
+		os.Exit(74)
+	}
+	program, diagnostics := ast.Parse(string(source))
+	for _, diagnostic := range diagnostics {
+		_, _ = fmt.Fprintln(os.Stderr, diagnostic)
+	}
+
+	data, err := ast.ToJSON(program)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(70)
+	}
+	var indented bytes.Buffer
+	_ = json.Indent(&indented, data, "", "  ")
+	indented.WriteByte('\n')
+	_, _ = os.Stdout.Write(indented.Bytes())
+
+	if len(diagnostics) > 0 {
+		os.Exit(65)
+	}
+}
+
+// formatFiles formats lox files, or standard input when none are given
+func formatFiles(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the formatted source back to each file")
+	showDiff := flags.Bool("d", false, "print a diff of the changes")
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			_, _ = fmt.Fprintln(os.Stderr, "Can't use -w with standard input")
+			os.Exit(64)
+		}
+		source, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, "Couldn't read standard input")
+			os.Exit(74)
+		}
+		if !formatSource("<stdin>", source, false, *showDiff) {
+			os.Exit(65)
+		}
+		return
+	}
+
+	ok := true
+	for _, filename := range flags.Args() {
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Couldn't read file: %s\n", filename)
+			os.Exit(74)
+		}
+		ok = formatSource(filename, source, *write, *showDiff) && ok
+	}
+	if !ok {
+		os.Exit(65)
+	}
+}
+
+// formatSource formats the source of filename, printing it unless it is
+// written back or diffed. It returns false if the source has errors.
+func formatSource(filename string, source []byte, write bool, showDiff bool) bool {
+	formatted, diagnostics := ast.Format(string(source))
+	for _, diagnostic := range diagnostics {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", filename, diagnostic)
+	}
+	if formatted == nil {
+		return false
+	}
+
+	if showDiff {
+		_, _ = os.Stdout.Write(diff.Unified(filename+".orig", filename, source, formatted))
+	}
+	if write && !bytes.Equal(source, formatted) {
+		if err := os.WriteFile(filename, formatted, 0644); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Couldn't write file: %s\n", filename)
+			os.Exit(74)
+		}
+	}
+	if !write && !showDiff {
+		_, _ = os.Stdout.Write(formatted)
+	}
+	return true
+}
+
+// finding is a problem reported by vet, as printed with -json
+type finding struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+// vetFiles checks lox files for likely bugs. Files which don't compile
+// are reported with their errors instead. Globals defined by the VM, like
+// the natives, count as declared.
+func vetFiles(machine *vm.VM, args []string) {
+	flags := flag.NewFlagSet("vet", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the findings as JSON")
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		_, _ = os.Stderr.WriteString(usage)
+		os.Exit(64)
+	}
+
+	isBuiltin := func(name string) bool {
+		_, ok := machine.GetGlobal(name)
+		return ok
+	}
+	findings := []finding{}
+	compiles := true
+	for _, filename := range flags.Args() {
+		source, err := os.ReadFile(filename)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Couldn't read file: %s\n", filename)
+			os.Exit(74)
+		}
+		program, diagnostics := ast.Parse(string(source))
+		if len(diagnostics) == 0 {
+			// Catches the errors the compiler reports after parsing, like
+			// a misplaced this or a redeclared local
+			_, diagnostics = ast.Generate(program)
+		}
+		if len(diagnostics) > 0 {
+			for _, diagnostic := range diagnostics {
+				_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", filename, diagnostic)
+			}
+			compiles = false
+			continue
+		}
+		for _, diagnostic := range vet.Check(program, isBuiltin) {
+			findings = append(findings, finding{filename, diagnostic.Start.Line, diagnostic.Start.Column, diagnostic.Message})
+		}
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(findings, "", "  ")
+		_, _ = fmt.Println(string(data))
+	} else {
+		for _, finding := range findings {
+			_, _ = fmt.Printf("%s:%d:%d: %s\n", finding.File, finding.Line, finding.Column, finding.Message)
+		}
+	}
+
+	if !compiles {
+		machine.FreeVM()
+		os.Exit(65)
+	}
+	if len(findings) > 0 {
+		machine.FreeVM()
+		os.Exit(1)
+	}
+}
+
+// serveLanguage runs a language server over standard input and output
+// until the client exits
+func serveLanguage(machine *vm.VM, stdin io.Reader) {
+	server := lsp.NewServer(machine)
+	if err := server.Serve(stdin, os.Stdout); err != nil {
+		if err != lsp.ErrNoShutdown {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+		}
+		machine.FreeVM()
+		os.Exit(1)
+	}
+}
+
+// runCompiledFile runs a file written by the compile command
+func runCompiledFile(machine *vm.VM, filename string) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Couldn't read file: %s\n", filename)
+		os.Exit(74)
+	}
+	var chunk vm.Chunk
+	if err := chunk.UnmarshalBinary(data); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		os.Exit(65)
+	}
+
+	result, _ := machine.InterpretChunk(filename, &chunk)
+	if result == vm.INTERPRET_COMPILE_ERROR {
+		machine.FreeVM()
+		os.Exit(65)
+	}
+	if result == vm.INTERPRET_RUNTIME_ERROR {
+		machine.FreeVM()
+		os.Exit(70)
+	}
+}
@@ -0,0 +1,188 @@
+// Package diff compares texts line by line, for showing what a formatter
+// would change
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// CONTEXT is the number of unchanged lines shown around each change
+const CONTEXT = 3
+
+// edit is a line kept, deleted or inserted to turn one text into another
+type edit struct {
+	// ' ' for a kept line, '-' for a deleted one and '+' for an inserted one
+	kind byte
+	line string
+}
+
+// Unified returns the changes turning old into new in unified diff
+// format, with the given file names in its header. It returns nil if the
+// texts are the same.
+func Unified(oldName string, newName string, old []byte, new []byte) []byte {
+	edits := diffLines(splitLines(old), splitLines(new))
+	changed := false
+	for _, edit := range edits {
+		if edit.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	var output bytes.Buffer
+	_, _ = fmt.Fprintf(&output, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Line numbers of the next old and new lines, and the edit after the last hunk
+	oldLine, newLine, done := 1, 1, 0
+	for i := 0; i < len(edits); i++ {
+		if edits[i].kind == ' ' {
+			continue
+		}
+
+		// Grow the hunk until the gap to the next change is wider than
+		// the context either side of it
+		start := max(i-CONTEXT, done)
+		last := i
+		for j := i; j < len(edits) && j-last <= 2*CONTEXT; j++ {
+			if edits[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := min(last+CONTEXT+1, len(edits))
+
+		for _, edit := range edits[done:start] {
+			oldLine, newLine = advance(edit, oldLine, newLine)
+		}
+		oldCount, newCount := 0, 0
+		for _, edit := range edits[start:end] {
+			oldCount, newCount = advance(edit, oldCount, newCount)
+		}
+		_, _ = fmt.Fprintf(&output, "@@ -%s +%s @@\n", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount))
+
+		for _, edit := range edits[start:end] {
+			output.WriteByte(edit.kind)
+			output.WriteString(edit.line)
+			if !strings.HasSuffix(edit.line, "\n") {
+				output.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		oldLine += oldCount
+		newLine += newCount
+		done = end
+		i = end - 1
+	}
+	return output.Bytes()
+}
+
+// advance counts the old and new lines covered by edit
+func advance(edit edit, oldLine int, newLine int) (int, int) {
+	if edit.kind != '+' {
+		oldLine++
+	}
+	if edit.kind != '-' {
+		newLine++
+	}
+	return oldLine, newLine
+}
+
+// hunkRange formats the first line and number of lines of one side of a
+// hunk, which starts before the first line when it is empty
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		line--
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+// splitLines splits text into lines, each keeping its newline
+func splitLines(text []byte) []string {
+	var lines []string
+	for len(text) > 0 {
+		end := bytes.IndexByte(text, '\n') + 1
+		if end == 0 {
+			end = len(text)
+		}
+		lines = append(lines, string(text[:end]))
+		text = text[end:]
+	}
+	return lines
+}
+
+// diffLines finds a shortest edit script turning a into b with Myers'
+// algorithm
+func diffLines(a []string, b []string) []edit {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	// Furthest x reached on each diagonal k = x - y, indexed by k + offset
+	furthest := make([]int, 2*offset+1)
+	// Diagonals -d-1 to d+1 of furthest before each round d, which are
+	// all that's needed to walk the path back
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), furthest[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && furthest[offset+k-1] < furthest[offset+k+1]) {
+				x = furthest[offset+k+1]
+			} else {
+				x = furthest[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			furthest[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack follows the path found by diffLines from the end back to
+// the start, returning its edits in order
+func backtrack(a []string, b []string, trace [][]int) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		furthest := trace[d]
+		offset := d + 1
+		k := x - y
+		var previousK int
+		if k == -d || (k != d && furthest[offset+k-1] < furthest[offset+k+1]) {
+			previousK = k + 1
+		} else {
+			previousK = k - 1
+		}
+		previousX := furthest[offset+previousK]
+		previousY := previousX - previousK
+
+		for x > previousX && y > previousY {
+			edits = append(edits, edit{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == previousX {
+				edits = append(edits, edit{kind: '+', line: b[y-1]})
+				y--
+			} else {
+				edits = append(edits, edit{kind: '-', line: a[x-1]})
+				x--
+			}
+		}
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -0,0 +1,464 @@
+package lsp
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Braden-Griebel/cloxgo/ast"
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// TOKEN_TYPES is the semantic token legend, in the order the indices
+// returned by tokenType refer to
+var TOKEN_TYPES = []string{"keyword", "variable", "string", "number", "operator", "comment"}
+
+// Indices into TOKEN_TYPES
+const (
+	TOKEN_TYPE_KEYWORD = iota
+	TOKEN_TYPE_VARIABLE
+	TOKEN_TYPE_STRING
+	TOKEN_TYPE_NUMBER
+	TOKEN_TYPE_OPERATOR
+	TOKEN_TYPE_COMMENT
+)
+
+// document is an open source file, as last sent by the client
+type document struct {
+	uri     string
+	version int
+	text    string
+	code    []rune
+	// Offsets of the first character of each line
+	lineStarts []int
+	// Every name in the document the declaration of which is known,
+	// ordered by position
+	references []reference
+}
+
+// declaration is a variable, parameter, function, class or method
+type declaration struct {
+	// Name in the declaration, nil for globals defined by the VM
+	name *ast.Ident
+	// Signature shown on hover, like "fun add(a, b)"
+	detail string
+}
+
+// reference is a name in the source along with what it refers to.
+// Declarations refer to themselves.
+type reference struct {
+	name        *ast.Ident
+	declaration *declaration
+}
+
+func newDocument(uri string, version int, text string) *document {
+	document := &document{uri: uri, version: version, text: text, code: []rune(text), lineStarts: []int{0}}
+	for i, c := range document.code {
+		if c == '\n' {
+			document.lineStarts = append(document.lineStarts, i+1)
+		}
+	}
+	return document
+}
+
+// region Positions
+
+// toProtocol converts a position in the source to a line and UTF-16 offset
+func (document *document) toProtocol(pos vm.Position) position {
+	line := min(max(pos.Line-1, 0), len(document.lineStarts)-1)
+	start := document.lineStarts[line]
+	offset := min(max(pos.Offset, start), len(document.code))
+	return position{Line: line, Character: utf16Length(document.code[start:offset])}
+}
+
+func (document *document) span(start vm.Position, end vm.Position) span {
+	return span{Start: document.toProtocol(start), End: document.toProtocol(end)}
+}
+
+// offsetOf converts a line and UTF-16 offset to an index into the
+// source, clamped to the line
+func (document *document) offsetOf(pos position) int {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(document.lineStarts) {
+		return len(document.code)
+	}
+
+	offset := document.lineStarts[pos.Line]
+	for units := 0; offset < len(document.code) && document.code[offset] != '\n'; offset++ {
+		units += utf16Width(document.code[offset])
+		if units > pos.Character {
+			break
+		}
+	}
+	return offset
+}
+
+// positionOf converts an index into the source to a position
+func (document *document) positionOf(offset int) vm.Position {
+	line := sort.SearchInts(document.lineStarts, offset+1) - 1
+	return vm.Position{Line: line + 1, Column: offset - document.lineStarts[line] + 1, Offset: offset}
+}
+
+func utf16Width(c rune) int {
+	if c >= 0x10000 && c <= utf8.MaxRune {
+		return 2
+	}
+	return 1
+}
+
+func utf16Length(code []rune) int {
+	length := 0
+	for _, c := range code {
+		length += utf16Width(c)
+	}
+	return length
+}
+
+// endregion Positions
+
+// region Diagnostics
+
+// diagnostics compiles the document, returning the problems the compiler
+// finds in it
+func (document *document) diagnostics(machine *vm.VM) []diagnostic {
+	_, problems := vm.Compile(document.text, machine)
+
+	diagnostics := []diagnostic{}
+	for _, problem := range problems {
+		severity := SEVERITY_ERROR
+		if problem.Severity == vm.SEVERITY_WARNING {
+			severity = SEVERITY_WARNING
+		}
+		diagnostics = append(diagnostics, diagnostic{
+			Range:    document.span(problem.Start, problem.End),
+			Severity: severity,
+			Source:   "cloxgo",
+			Message:  problem.Message,
+		})
+	}
+	return diagnostics
+}
+
+// endregion Diagnostics
+
+// region Semantic Tokens
+
+// tokenType returns the index of the semantic token type of tokens of
+// type t in TOKEN_TYPES, -1 for punctuation and errors
+func tokenType(t vm.TokenType) int {
+	switch {
+	case t == vm.TOKEN_IDENTIFIER:
+		return TOKEN_TYPE_VARIABLE
+	case t == vm.TOKEN_STRING:
+		return TOKEN_TYPE_STRING
+	case t == vm.TOKEN_NUMBER:
+		return TOKEN_TYPE_NUMBER
+	case t >= vm.TOKEN_AND && t <= vm.TOKEN_WHILE:
+		return TOKEN_TYPE_KEYWORD
+	case t == vm.TOKEN_MINUS || t == vm.TOKEN_PLUS || t == vm.TOKEN_SLASH || t == vm.TOKEN_STAR:
+		return TOKEN_TYPE_OPERATOR
+	case t >= vm.TOKEN_BANG && t <= vm.TOKEN_LESS_EQUAL:
+		return TOKEN_TYPE_OPERATOR
+	}
+	return -1
+}
+
+// semanticTokens scans the document, encoding its tokens and comments
+// relative to each other as the protocol expects
+func (document *document) semanticTokens() []int {
+	// Start, end and type of every token to highlight
+	type token struct{ start, end, kind int }
+	var tokens []token
+
+	scanner := vm.NewScanner(document.text)
+	for {
+		scanned := scanner.ScanToken()
+		if scanned.Type() == vm.TOKEN_EOF {
+			break
+		}
+		kind := tokenType(scanned.Type())
+		if kind == -1 {
+			continue
+		}
+		start := scanned.Position().Offset
+		tokens = append(tokens, token{start, start + utf8.RuneCountInString(scanner.Lexeme(scanned)), kind})
+	}
+	for _, comment := range scanner.Comments() {
+		start := comment.Position.Offset
+		tokens = append(tokens, token{start, start + utf8.RuneCountInString(comment.Text), TOKEN_TYPE_COMMENT})
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].start < tokens[j].start })
+
+	data := []int{}
+	previous := position{}
+	for _, token := range tokens {
+		// Tokens can't span lines, so strings are split at each newline
+		for start := token.start; start < token.end; {
+			end := start
+			for end < token.end && document.code[end] != '\n' {
+				end++
+			}
+			if end > start {
+				pos := document.toProtocol(document.positionOf(start))
+				character := pos.Character
+				if pos.Line == previous.Line {
+					character -= previous.Character
+				}
+				data = append(data, pos.Line-previous.Line, character, utf16Length(document.code[start:end]), token.kind, 0)
+				previous = pos
+			}
+			start = end + 1
+		}
+	}
+	return data
+}
+
+// endregion Semantic Tokens
+
+// region Names
+
+// resolver finds what each name in a program refers to, following the
+// compiler's scoping rules
+type resolver struct {
+	// Declarations in scope, innermost last, with the depth of the scope
+	// declaring them
+	locals []local
+	depth  int
+	// First declaration of each global in the program
+	globals map[string]*declaration
+	// Declarations of globals defined by the VM, found by builtin
+	builtins   map[string]*declaration
+	builtin    func(name string) (string, bool)
+	references []reference
+}
+
+type local struct {
+	declaration *declaration
+	depth       int
+}
+
+// resolve finds the references in the document's program. builtin
+// returns the hover text of globals defined by the VM.
+func (document *document) resolve(program *ast.Program, builtin func(name string) (string, bool)) {
+	resolver := resolver{
+		globals:  make(map[string]*declaration),
+		builtins: make(map[string]*declaration),
+		builtin:  builtin,
+	}
+	// Globals are bound late, so functions can use ones declared after them
+	for _, stmt := range program.Stmts {
+		var name *ast.Ident
+		switch stmt := stmt.(type) {
+		case *ast.VarDecl:
+			name = stmt.Name
+		case *ast.FunDecl:
+			name = stmt.Function.Name
+		case *ast.ClassDecl:
+			name = stmt.Name
+		}
+		if name != nil && resolver.globals[name.Name] == nil {
+			resolver.globals[name.Name] = &declaration{name: name, detail: detail(stmt)}
+		}
+	}
+
+	resolver.statements(program.Stmts)
+
+	sort.Slice(resolver.references, func(i, j int) bool {
+		return resolver.references[i].name.NamePos.Offset < resolver.references[j].name.NamePos.Offset
+	})
+	document.references = resolver.references
+}
+
+// referenceAt returns the reference to the name under pos, nil if there
+// isn't one
+func (document *document) referenceAt(pos position) *reference {
+	offset := document.offsetOf(pos)
+	for i := range document.references {
+		name := document.references[i].name
+		// The cursor may be just after the last character of the name
+		if offset >= name.NamePos.Offset && offset <= name.End().Offset {
+			return &document.references[i]
+		}
+	}
+	return nil
+}
+
+func (resolver *resolver) statements(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		resolver.statement(stmt)
+	}
+}
+
+func (resolver *resolver) statement(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		resolver.expression(stmt.X)
+	case *ast.PrintStmt:
+		resolver.expression(stmt.X)
+	case *ast.VarDecl:
+		if stmt.Init != nil {
+			resolver.expression(stmt.Init)
+		}
+		resolver.declare(stmt.Name, detail(stmt))
+	case *ast.FunDecl:
+		resolver.declare(stmt.Function.Name, detail(stmt))
+		resolver.function(stmt.Function)
+	case *ast.ClassDecl:
+		resolver.declare(stmt.Name, detail(stmt))
+		if stmt.Superclass != nil {
+			resolver.use(stmt.Superclass)
+		}
+		for _, method := range stmt.Methods {
+			resolver.references = append(resolver.references, reference{method.Name, &declaration{
+				name:   method.Name,
+				detail: "(method) " + stmt.Name.Name + "." + signature(method),
+			}})
+			resolver.function(method)
+		}
+	case *ast.Block:
+		resolver.beginScope()
+		resolver.statements(stmt.Stmts)
+		resolver.endScope()
+	case *ast.IfStmt:
+		resolver.expression(stmt.Cond)
+		resolver.statement(stmt.Then)
+		if stmt.Else != nil {
+			resolver.statement(stmt.Else)
+		}
+	case *ast.WhileStmt:
+		resolver.expression(stmt.Cond)
+		resolver.statement(stmt.Body)
+	case *ast.ForStmt:
+		resolver.beginScope()
+		if stmt.Init != nil {
+			resolver.statement(stmt.Init)
+		}
+		if stmt.Cond != nil {
+			resolver.expression(stmt.Cond)
+		}
+		if stmt.Incr != nil {
+			resolver.expression(stmt.Incr)
+		}
+		resolver.statement(stmt.Body)
+		resolver.endScope()
+	case *ast.ReturnStmt:
+		if stmt.Value != nil {
+			resolver.expression(stmt.Value)
+		}
+	}
+}
+
+func (resolver *resolver) function(function *ast.Function) {
+	resolver.beginScope()
+	for _, param := range function.Params {
+		resolver.declare(param, "(parameter) "+param.Name)
+	}
+	resolver.statements(function.Body.Stmts)
+	resolver.endScope()
+}
+
+func (resolver *resolver) expression(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		resolver.use(expr)
+	case *ast.Grouping:
+		resolver.expression(expr.X)
+	case *ast.Unary:
+		resolver.expression(expr.X)
+	case *ast.Binary:
+		resolver.expression(expr.X)
+		resolver.expression(expr.Y)
+	case *ast.Logical:
+		resolver.expression(expr.X)
+		resolver.expression(expr.Y)
+	case *ast.Assign:
+		resolver.expression(expr.Value)
+		resolver.use(expr.Name)
+	case *ast.Call:
+		resolver.expression(expr.Callee)
+		for _, arg := range expr.Args {
+			resolver.expression(arg)
+		}
+	case *ast.Get:
+		resolver.expression(expr.X)
+	case *ast.Set:
+		resolver.expression(expr.X)
+		resolver.expression(expr.Value)
+	}
+}
+
+func (resolver *resolver) beginScope() {
+	resolver.depth++
+}
+
+func (resolver *resolver) endScope() {
+	resolver.depth--
+	for len(resolver.locals) > 0 && resolver.locals[len(resolver.locals)-1].depth > resolver.depth {
+		resolver.locals = resolver.locals[:len(resolver.locals)-1]
+	}
+}
+
+// declare records a declaration of name, in the innermost scope if it
+// is a local
+func (resolver *resolver) declare(name *ast.Ident, detail string) {
+	found := &declaration{name: name, detail: detail}
+	if resolver.depth > 0 {
+		resolver.locals = append(resolver.locals, local{found, resolver.depth})
+	} else if global := resolver.globals[name.Name]; global != nil && global.name == name {
+		found = global
+	}
+	resolver.references = append(resolver.references, reference{name, found})
+}
+
+// use records a reference to the variable called name, if it is declared
+func (resolver *resolver) use(name *ast.Ident) {
+	for i := len(resolver.locals) - 1; i >= 0; i-- {
+		if resolver.locals[i].declaration.name.Name == name.Name {
+			resolver.references = append(resolver.references, reference{name, resolver.locals[i].declaration})
+			return
+		}
+	}
+
+	found := resolver.globals[name.Name]
+	if found == nil {
+		found = resolver.builtins[name.Name]
+	}
+	if found == nil && resolver.builtin != nil {
+		if detail, ok := resolver.builtin(name.Name); ok {
+			found = &declaration{detail: detail}
+			resolver.builtins[name.Name] = found
+		}
+	}
+	if found != nil {
+		resolver.references = append(resolver.references, reference{name, found})
+	}
+}
+
+// detail returns the hover text of a declaration
+func detail(stmt ast.Stmt) string {
+	switch stmt := stmt.(type) {
+	case *ast.VarDecl:
+		return "var " + stmt.Name.Name
+	case *ast.FunDecl:
+		return "fun " + signature(stmt.Function)
+	case *ast.ClassDecl:
+		if stmt.Superclass != nil {
+			return "class " + stmt.Name.Name + " < " + stmt.Superclass.Name
+		}
+		return "class " + stmt.Name.Name
+	}
+	return ""
+}
+
+// signature returns the name and parameters of a function, like "add(a, b)"
+func signature(function *ast.Function) string {
+	params := make([]string, len(function.Params))
+	for i, param := range function.Params {
+		params[i] = param.Name
+	}
+	return function.Name.Name + "(" + strings.Join(params, ", ") + ")"
+}
+
+// endregion Names
@@ -0,0 +1,221 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// JSON-RPC error codes used by the server
+const (
+	ERROR_PARSE            = -32700
+	ERROR_INVALID_REQUEST  = -32600
+	ERROR_METHOD_NOT_FOUND = -32601
+	ERROR_INVALID_PARAMS   = -32602
+	ERROR_NOT_INITIALIZED  = -32002
+)
+
+// LSP diagnostic severities
+const (
+	SEVERITY_ERROR   = 1
+	SEVERITY_WARNING = 2
+)
+
+// TEXT_DOCUMENT_SYNC_FULL asks the client to send the whole document on
+// every change
+const TEXT_DOCUMENT_SYNC_FULL = 1
+
+// MAX_MESSAGE_LENGTH is the largest Content-Length accepted, far more than
+// any document needs, so a bad header can't make the server allocate
+// without bound
+const MAX_MESSAGE_LENGTH = 64 << 20
+
+// region Messages
+
+// message is a request, notification or response read from the client.
+// Notifications have no ID.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// response answers a request. Result is written even when it is nil,
+// since null is the answer to some requests.
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  any             `json:"result"`
+}
+
+// errorResponse answers a request which failed
+type errorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   responseError   `json:"error"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// notification is a message sent to the client which isn't answered
+type notification struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+// endregion Messages
+
+// region Protocol Types
+
+// position is a zero based line and UTF-16 offset within that line
+type position struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type span struct {
+	Start position `json:"start"`
+	End   position `json:"end"`
+}
+
+type location struct {
+	URI   string `json:"uri"`
+	Range span   `json:"range"`
+}
+
+type textDocumentItem struct {
+	URI     string `json:"uri"`
+	Version int    `json:"version"`
+	Text    string `json:"text"`
+}
+
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+type didOpenParams struct {
+	TextDocument textDocumentItem `json:"textDocument"`
+}
+
+type didChangeParams struct {
+	TextDocument struct {
+		URI     string `json:"uri"`
+		Version int    `json:"version"`
+	} `json:"textDocument"`
+	// With full sync each change holds the whole document, only the last counts
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type didCloseParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type textDocumentPositionParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+	Position     position               `json:"position"`
+}
+
+type semanticTokensParams struct {
+	TextDocument textDocumentIdentifier `json:"textDocument"`
+}
+
+type semanticTokens struct {
+	Data []int `json:"data"`
+}
+
+type diagnostic struct {
+	Range    span   `json:"range"`
+	Severity int    `json:"severity"`
+	Source   string `json:"source"`
+	Message  string `json:"message"`
+}
+
+type publishDiagnosticsParams struct {
+	URI         string       `json:"uri"`
+	Version     *int         `json:"version,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+type markupContent struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+type hover struct {
+	Contents markupContent `json:"contents"`
+	Range    span          `json:"range"`
+}
+
+// endregion Protocol Types
+
+// region Framing
+
+// readMessage reads the body of the next message, which follows a
+// Content-Length header and a blank line. It returns io.EOF once the
+// input ends between messages.
+func readMessage(reader *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && length == -1 {
+				return nil, io.EOF
+			}
+			return nil, errors.New("lsp: input ended inside a message header")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			return nil, fmt.Errorf("lsp: malformed header %q", line)
+		}
+		// Other headers, like Content-Type, are ignored
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("lsp: invalid Content-Length %q", value)
+			}
+			if length > MAX_MESSAGE_LENGTH {
+				return nil, fmt.Errorf("lsp: Content-Length %d is over the limit of %d", length, MAX_MESSAGE_LENGTH)
+			}
+		}
+	}
+	if length == -1 {
+		return nil, errors.New("lsp: message has no Content-Length header")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, errors.New("lsp: input ended inside a message body")
+	}
+	return body, nil
+}
+
+// writeMessage writes value as JSON, after its Content-Length header
+func writeMessage(w io.Writer, value any) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// endregion Framing
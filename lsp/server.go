@@ -0,0 +1,274 @@
+// Package lsp is a language server for lox, speaking the Language Server
+// Protocol over a pair of streams. It publishes the compiler's
+// diagnostics for open documents, highlights them by token type, and
+// finds the definitions of variables and functions.
+//
+// Since the server only needs an io.Reader and io.Writer, it can be
+// driven by a scripted exchange of JSON-RPC messages instead of an editor.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Braden-Griebel/cloxgo/ast"
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// ErrNoShutdown is returned by Serve when the client exits, or the input
+// ends, without asking the server to shut down first
+var ErrNoShutdown = errors.New("lsp: exit without shutdown")
+
+// Server answers the requests of a single client
+type Server struct {
+	// Compiles documents for their diagnostics, and defines the natives
+	machine   *vm.VM
+	documents map[string]*document
+	output    io.Writer
+	// Whether the initialize request and shutdown request have been received
+	initialized  bool
+	shuttingDown bool
+}
+
+// NewServer creates a server compiling documents with machine, whose
+// globals are treated as declared in every document
+func NewServer(machine *vm.VM) *Server {
+	return &Server{machine: machine, documents: make(map[string]*document)}
+}
+
+// Serve reads messages from in and writes responses and notifications to
+// out until the client sends exit. It returns nil if the client asked the
+// server to shut down first, as the protocol requires.
+func (server *Server) Serve(in io.Reader, out io.Writer) error {
+	server.output = out
+	reader := bufio.NewReader(in)
+	for {
+		body, err := readMessage(reader)
+		if err == io.EOF {
+			return ErrNoShutdown
+		}
+		if err != nil {
+			return err
+		}
+
+		var request message
+		if err := json.Unmarshal(body, &request); err != nil {
+			if err := server.fail(json.RawMessage("null"), ERROR_PARSE, "Couldn't parse message."); err != nil {
+				return err
+			}
+			continue
+		}
+		if request.Method == "exit" {
+			if !server.shuttingDown {
+				return ErrNoShutdown
+			}
+			return nil
+		}
+		if err := server.handle(request); err != nil {
+			return err
+		}
+	}
+}
+
+// region Dispatch
+
+// handle answers a request or acts on a notification, returning an
+// error only if writing to the client fails
+func (server *Server) handle(request message) error {
+	isNotification := len(request.ID) == 0
+	if request.Method == "" {
+		// Responses to requests the server never sends
+		return nil
+	}
+	if !server.initialized && request.Method != "initialize" {
+		if isNotification {
+			return nil
+		}
+		return server.fail(request.ID, ERROR_NOT_INITIALIZED, "Server is not initialized.")
+	}
+	if server.shuttingDown {
+		if isNotification {
+			return nil
+		}
+		return server.fail(request.ID, ERROR_INVALID_REQUEST, "Server is shutting down.")
+	}
+
+	switch request.Method {
+	case "initialize":
+		if server.initialized {
+			return server.fail(request.ID, ERROR_INVALID_REQUEST, "Server is already initialized.")
+		}
+		server.initialized = true
+		return server.reply(request.ID, server.capabilities())
+	case "shutdown":
+		server.shuttingDown = true
+		return server.reply(request.ID, nil)
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if json.Unmarshal(request.Params, &params) != nil {
+			return nil
+		}
+		return server.update(params.TextDocument.URI, params.TextDocument.Version, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if json.Unmarshal(request.Params, &params) != nil || len(params.ContentChanges) == 0 {
+			return nil
+		}
+		text := params.ContentChanges[len(params.ContentChanges)-1].Text
+		return server.update(params.TextDocument.URI, params.TextDocument.Version, text)
+	case "textDocument/didClose":
+		var params didCloseParams
+		if json.Unmarshal(request.Params, &params) != nil {
+			return nil
+		}
+		delete(server.documents, params.TextDocument.URI)
+		// Clear the diagnostics of the closed document
+		return server.notify("textDocument/publishDiagnostics",
+			publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []diagnostic{}})
+	case "textDocument/semanticTokens/full":
+		var params semanticTokensParams
+		if json.Unmarshal(request.Params, &params) != nil {
+			return server.fail(request.ID, ERROR_INVALID_PARAMS, "Invalid parameters.")
+		}
+		document := server.documents[params.TextDocument.URI]
+		if document == nil {
+			return server.reply(request.ID, nil)
+		}
+		return server.reply(request.ID, semanticTokens{Data: document.semanticTokens()})
+	case "textDocument/definition":
+		document, reference, err := server.lookup(request)
+		if err != nil || reference == nil || reference.declaration.name == nil {
+			return server.replyOrFail(request.ID, nil, err)
+		}
+		name := reference.declaration.name
+		return server.reply(request.ID, location{URI: document.uri, Range: document.span(name.Pos(), name.End())})
+	case "textDocument/hover":
+		document, reference, err := server.lookup(request)
+		if err != nil || reference == nil {
+			return server.replyOrFail(request.ID, nil, err)
+		}
+		return server.reply(request.ID, hover{
+			Contents: markupContent{Kind: "markdown", Value: "```lox\n" + reference.declaration.detail + "\n```"},
+			Range:    document.span(reference.name.Pos(), reference.name.End()),
+		})
+	}
+
+	if isNotification {
+		// Notifications the server doesn't support, like $/cancelRequest, are ignored
+		return nil
+	}
+	return server.fail(request.ID, ERROR_METHOD_NOT_FOUND, fmt.Sprintf("Unsupported method '%s'.", request.Method))
+}
+
+func (server *Server) capabilities() any {
+	type semanticTokensOptions struct {
+		Legend struct {
+			TokenTypes     []string `json:"tokenTypes"`
+			TokenModifiers []string `json:"tokenModifiers"`
+		} `json:"legend"`
+		Full bool `json:"full"`
+	}
+	type serverCapabilities struct {
+		TextDocumentSync       int                   `json:"textDocumentSync"`
+		SemanticTokensProvider semanticTokensOptions `json:"semanticTokensProvider"`
+		DefinitionProvider     bool                  `json:"definitionProvider"`
+		HoverProvider          bool                  `json:"hoverProvider"`
+	}
+	type serverInfo struct {
+		Name string `json:"name"`
+	}
+	type initializeResult struct {
+		Capabilities serverCapabilities `json:"capabilities"`
+		ServerInfo   serverInfo         `json:"serverInfo"`
+	}
+
+	result := initializeResult{
+		Capabilities: serverCapabilities{
+			TextDocumentSync:   TEXT_DOCUMENT_SYNC_FULL,
+			DefinitionProvider: true,
+			HoverProvider:      true,
+		},
+		ServerInfo: serverInfo{Name: "cloxgo"},
+	}
+	result.Capabilities.SemanticTokensProvider.Legend.TokenTypes = TOKEN_TYPES
+	result.Capabilities.SemanticTokensProvider.Legend.TokenModifiers = []string{}
+	result.Capabilities.SemanticTokensProvider.Full = true
+	return result
+}
+
+// endregion Dispatch
+
+// region Documents
+
+// update replaces the text of a document, publishing its diagnostics
+func (server *Server) update(uri string, version int, text string) error {
+	document := newDocument(uri, version, text)
+	server.documents[uri] = document
+
+	// The parser drops declarations with syntax errors, so names in the
+	// rest of the document are still found
+	program, _ := ast.Parse(text)
+	document.resolve(program, server.builtin)
+
+	return server.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{
+		URI:         uri,
+		Version:     &document.version,
+		Diagnostics: document.diagnostics(server.machine),
+	})
+}
+
+// lookup finds the document and the reference under the position a
+// request is about. The reference is nil if there is no known name there.
+func (server *Server) lookup(request message) (*document, *reference, error) {
+	var params textDocumentPositionParams
+	if err := json.Unmarshal(request.Params, &params); err != nil {
+		return nil, nil, err
+	}
+	document := server.documents[params.TextDocument.URI]
+	if document == nil {
+		return nil, nil, nil
+	}
+	return document, document.referenceAt(params.Position), nil
+}
+
+// builtin returns the hover text of a global defined by the VM
+func (server *Server) builtin(name string) (string, bool) {
+	if _, ok := server.machine.GetGlobal(name); !ok {
+		return "", false
+	}
+	return "(native) " + name, true
+}
+
+// endregion Documents
+
+// region Output
+
+func (server *Server) reply(id json.RawMessage, result any) error {
+	return writeMessage(server.output, response{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+// replyOrFail replies with result, or with an invalid parameters error
+// if err isn't nil
+func (server *Server) replyOrFail(id json.RawMessage, result any, err error) error {
+	if err != nil {
+		return server.fail(id, ERROR_INVALID_PARAMS, "Invalid parameters.")
+	}
+	return server.reply(id, result)
+}
+
+func (server *Server) fail(id json.RawMessage, code int, message string) error {
+	return writeMessage(server.output, errorResponse{
+		JSONRPC: "2.0",
+		ID:      id,
+		Error:   responseError{Code: code, Message: message},
+	})
+}
+
+func (server *Server) notify(method string, params any) error {
+	return writeMessage(server.output, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+// endregion Output
@@ -0,0 +1,212 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// frame encodes messages with their headers, as a client sends them
+func frame(messages ...string) *bytes.Buffer {
+	var input bytes.Buffer
+	for _, message := range messages {
+		_, _ = fmt.Fprintf(&input, "Content-Length: %d\r\n\r\n%s", len(message), message)
+	}
+	return &input
+}
+
+// serve runs a server over messages, returning the bodies of the
+// messages it wrote and the error Serve returned
+func serve(t *testing.T, messages ...string) ([]string, error) {
+	t.Helper()
+	machine := vm.InitVM()
+	defer machine.FreeVM()
+
+	var output bytes.Buffer
+	err := NewServer(&machine).Serve(frame(messages...), &output)
+
+	var replies []string
+	reader := bufio.NewReader(&output)
+	for {
+		body, readErr := readMessage(reader)
+		if readErr == io.EOF {
+			return replies, err
+		}
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		replies = append(replies, string(body))
+	}
+}
+
+// quote encodes text as a JSON string
+func quote(text string) string {
+	data, _ := json.Marshal(text)
+	return string(data)
+}
+
+func TestServe(t *testing.T) {
+	source := "var greeting = \"hi\";\nfun add(a, b) {\n  return a + b; // sum\n}\nprint add(greeting, clock());\n"
+	// The declaration of x has an error, so x is unknown
+	changed := "var x = ;\nprint \"é😀\" + x;\n"
+	position := func(id int, method string, line int, character int) string {
+		return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"textDocument/%s","params":`+
+			`{"textDocument":{"uri":"file:///a.lox"},"position":{"line":%d,"character":%d}}}`, id, method, line, character)
+	}
+
+	replies, err := serve(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{}}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":`+
+			`{"uri":"file:///a.lox","languageId":"lox","version":1,"text":`+quote(source)+`}}}`,
+		position(2, "definition", 2, 9),
+		position(3, "hover", 4, 7),
+		position(4, "hover", 4, 22),
+		position(5, "hover", 1, 10),
+		`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":`+
+			`{"uri":"file:///a.lox","version":2},"contentChanges":[{"text":`+quote(changed)+`}]}}`,
+		`{"jsonrpc":"2.0","id":6,"method":"textDocument/semanticTokens/full","params":{"textDocument":{"uri":"file:///a.lox"}}}`,
+		position(7, "definition", 1, 14),
+		`{"jsonrpc":"2.0","method":"textDocument/didClose","params":{"textDocument":{"uri":"file:///a.lox"}}}`,
+		`{"jsonrpc":"2.0","id":8,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	if err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+
+	want := []string{
+		`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"textDocumentSync":1,"semanticTokensProvider":{"legend":` +
+			`{"tokenTypes":["keyword","variable","string","number","operator","comment"],"tokenModifiers":[]},"full":true},` +
+			`"definitionProvider":true,"hoverProvider":true},"serverInfo":{"name":"cloxgo"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.lox","version":1,"diagnostics":[]}}`,
+		// The parameter a
+		`{"jsonrpc":"2.0","id":2,"result":{"uri":"file:///a.lox","range":{"start":{"line":1,"character":8},"end":{"line":1,"character":9}}}}`,
+		"{\"jsonrpc\":\"2.0\",\"id\":3,\"result\":{\"contents\":{\"kind\":\"markdown\",\"value\":\"```lox\\nfun add(a, b)\\n```\"}," +
+			`"range":{"start":{"line":4,"character":6},"end":{"line":4,"character":9}}}}`,
+		"{\"jsonrpc\":\"2.0\",\"id\":4,\"result\":{\"contents\":{\"kind\":\"markdown\",\"value\":\"```lox\\n(native) clock\\n```\"}," +
+			`"range":{"start":{"line":4,"character":20},"end":{"line":4,"character":25}}}}`,
+		// Between the parameters, where there is no name
+		`{"jsonrpc":"2.0","id":5,"result":null}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.lox","version":2,"diagnostics":` +
+			`[{"range":{"start":{"line":0,"character":8},"end":{"line":0,"character":9}},"severity":1,"source":"cloxgo","message":"Expect expression."}]}}`,
+		// Positions and lengths are in UTF-16 code units, so the string is 5 long
+		`{"jsonrpc":"2.0","id":6,"result":{"data":[0,0,3,0,0,0,4,1,1,0,0,2,1,4,0,1,0,5,0,0,0,6,5,2,0,0,6,1,4,0,0,2,1,1,0]}}`,
+		`{"jsonrpc":"2.0","id":7,"result":null}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"uri":"file:///a.lox","diagnostics":[]}}`,
+		`{"jsonrpc":"2.0","id":8,"result":null}`,
+	}
+	compareReplies(t, replies, want)
+}
+
+func TestServeErrors(t *testing.T) {
+	initialize := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"capabilities":{}}}`
+	initialized := `{"jsonrpc":"2.0","id":1,"result":`
+	tests := []struct {
+		name     string
+		messages []string
+		// Replies expected after the one to initialize, if it was sent
+		want []string
+		err  error
+	}{
+		{
+			"request before initialize",
+			[]string{`{"jsonrpc":"2.0","id":1,"method":"textDocument/hover","params":{}}`},
+			[]string{`{"jsonrpc":"2.0","id":1,"error":{"code":-32002,"message":"Server is not initialized."}}`},
+			ErrNoShutdown,
+		},
+		{
+			"unsupported method",
+			[]string{initialize, `{"jsonrpc":"2.0","id":2,"method":"workspace/symbol","params":{}}`},
+			[]string{`{"jsonrpc":"2.0","id":2,"error":{"code":-32601,"message":"Unsupported method 'workspace/symbol'."}}`},
+			ErrNoShutdown,
+		},
+		{
+			"unsupported notification",
+			[]string{initialize, `{"jsonrpc":"2.0","method":"$/cancelRequest","params":{"id":1}}`},
+			nil,
+			ErrNoShutdown,
+		},
+		{
+			"malformed message",
+			[]string{initialize, `{"jsonrpc":`},
+			[]string{`{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"Couldn't parse message."}}`},
+			ErrNoShutdown,
+		},
+		{
+			"invalid parameters",
+			[]string{initialize, `{"jsonrpc":"2.0","id":2,"method":"textDocument/semanticTokens/full","params":[]}`},
+			[]string{`{"jsonrpc":"2.0","id":2,"error":{"code":-32602,"message":"Invalid parameters."}}`},
+			ErrNoShutdown,
+		},
+		{
+			"request after shutdown",
+			[]string{initialize, `{"jsonrpc":"2.0","id":2,"method":"shutdown"}`,
+				`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{}}`, `{"jsonrpc":"2.0","method":"exit"}`},
+			[]string{`{"jsonrpc":"2.0","id":2,"result":null}`,
+				`{"jsonrpc":"2.0","id":3,"error":{"code":-32600,"message":"Server is shutting down."}}`},
+			nil,
+		},
+		{
+			"exit without shutdown",
+			[]string{initialize, `{"jsonrpc":"2.0","method":"exit"}`},
+			nil,
+			ErrNoShutdown,
+		},
+	}
+
+	for _, test := range tests {
+		replies, err := serve(t, test.messages...)
+		if err != test.err {
+			t.Errorf("%s: Serve returned %v, want %v", test.name, err, test.err)
+		}
+		if len(test.messages) > 0 && test.messages[0] == initialize {
+			if len(replies) == 0 || !strings.HasPrefix(replies[0], initialized) {
+				t.Errorf("%s: server didn't reply to initialize", test.name)
+				continue
+			}
+			replies = replies[1:]
+		}
+		compareReplies(t, replies, test.want)
+	}
+}
+
+func TestServeRejectsBadFraming(t *testing.T) {
+	for _, input := range []string{
+		"Content-Length: 10\r\n\r\n{}",
+		"Content-Type: application/json\r\n\r\n{}",
+		"Content-Length: many\r\n\r\n{}",
+		"Content-Length 2\r\n\r\n{}",
+		"Content-Length: 99999999999999999\r\n\r\n{}",
+		"Content-Length: 99999999999999999999\r\n\r\n{}",
+		fmt.Sprintf("Content-Length: %d\r\n\r\n{}", MAX_MESSAGE_LENGTH+1),
+	} {
+		machine := vm.InitVM()
+		err := NewServer(&machine).Serve(bytes.NewBufferString(input), io.Discard)
+		machine.FreeVM()
+		if err == nil || err == ErrNoShutdown {
+			t.Errorf("%q: Serve returned %v, want a framing error", input, err)
+		}
+	}
+}
+
+// compareReplies reports each reply which differs from the one wanted
+func compareReplies(t *testing.T, replies []string, want []string) {
+	t.Helper()
+	for i := 0; i < len(replies) || i < len(want); i++ {
+		switch {
+		case i >= len(want):
+			t.Errorf("unexpected reply %s", replies[i])
+		case i >= len(replies):
+			t.Errorf("missing reply %s", want[i])
+		case replies[i] != want[i]:
+			t.Errorf("reply %d is\n%s\nwant\n%s", i, replies[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,441 @@
+// Package vet reports likely bugs in lox programs, code which parses but
+// probably doesn't do what was meant
+package vet
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Braden-Griebel/cloxgo/ast"
+	"github.com/Braden-Griebel/cloxgo/vm"
+)
+
+// variable is a local variable, parameter, function or class in scope
+type variable struct {
+	name *ast.Ident
+	// What was declared, used in messages: "variable", "function", ...
+	kind string
+	// Scope depth the variable was declared at
+	depth int
+	used  bool
+}
+
+// function tracks the scopes of the function being checked
+type function struct {
+	enclosing  *function
+	locals     []*variable
+	scopeDepth int
+}
+
+// checker walks a program, resolving names like the compiler does
+type checker struct {
+	function *function
+	// Number of classes the code being checked is nested in
+	classDepth int
+	// Globals declared anywhere at the top level of the program
+	globals map[string]bool
+	// Reports whether a global not declared by the program is defined
+	// by the host, like the natives
+	isBuiltin   func(name string) bool
+	diagnostics []vm.Diagnostic
+}
+
+// Check reports likely bugs in a program as warnings, ordered by
+// position:
+//
+//   - local variables, functions and classes which are never used
+//   - assignments to globals the program never declares
+//   - statements which can't be reached after a return
+//   - this outside of a method
+//   - comparisons of literals of different types
+//   - local declarations shadowing or redeclaring a local of the same name
+//
+// isBuiltin reports whether a global the program doesn't declare is
+// defined by the host, and may be nil if no globals are.
+func Check(program *ast.Program, isBuiltin func(name string) bool) []vm.Diagnostic {
+	checker := checker{function: &function{}, globals: make(map[string]bool), isBuiltin: isBuiltin}
+	for _, stmt := range program.Stmts {
+		switch stmt := stmt.(type) {
+		case *ast.VarDecl:
+			checker.globals[stmt.Name.Name] = true
+		case *ast.FunDecl:
+			checker.globals[stmt.Function.Name.Name] = true
+		case *ast.ClassDecl:
+			checker.globals[stmt.Name.Name] = true
+		}
+	}
+
+	checker.statements(program.Stmts)
+
+	sort.SliceStable(checker.diagnostics, func(i, j int) bool {
+		return checker.diagnostics[i].Start.Offset < checker.diagnostics[j].Start.Offset
+	})
+	return checker.diagnostics
+}
+
+// region Statements
+
+// statements checks a list of statements, reporting the first one
+// which can't be reached
+func (checker *checker) statements(stmts []ast.Stmt) {
+	reachable := true
+	for _, stmt := range stmts {
+		if !reachable {
+			checker.warn(stmt.Pos(), firstToken(stmt), "Unreachable code.")
+			// Only the first unreachable statement is reported
+			reachable = true
+		}
+		checker.statement(stmt)
+		if returns(stmt) {
+			reachable = false
+		}
+	}
+}
+
+func (checker *checker) statement(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		checker.expression(stmt.X)
+	case *ast.PrintStmt:
+		checker.expression(stmt.X)
+	case *ast.VarDecl:
+		if stmt.Init != nil {
+			checker.expression(stmt.Init)
+		}
+		checker.declare(stmt.Name, "variable")
+	case *ast.FunDecl:
+		checker.declare(stmt.Function.Name, "function")
+		checker.functionBody(stmt.Function)
+	case *ast.ClassDecl:
+		checker.declare(stmt.Name, "class")
+		if stmt.Superclass != nil {
+			checker.resolve(stmt.Superclass, true)
+		}
+		checker.classDepth++
+		for _, method := range stmt.Methods {
+			checker.functionBody(method)
+		}
+		checker.classDepth--
+	case *ast.Block:
+		checker.beginScope()
+		checker.statements(stmt.Stmts)
+		checker.endScope()
+	case *ast.IfStmt:
+		checker.expression(stmt.Cond)
+		checker.statement(stmt.Then)
+		if stmt.Else != nil {
+			checker.statement(stmt.Else)
+		}
+	case *ast.WhileStmt:
+		checker.expression(stmt.Cond)
+		checker.statement(stmt.Body)
+	case *ast.ForStmt:
+		checker.beginScope()
+		if stmt.Init != nil {
+			checker.statement(stmt.Init)
+		}
+		if stmt.Cond != nil {
+			checker.expression(stmt.Cond)
+		}
+		if stmt.Incr != nil {
+			checker.expression(stmt.Incr)
+		}
+		checker.statement(stmt.Body)
+		checker.endScope()
+	case *ast.ReturnStmt:
+		if stmt.Value != nil {
+			checker.expression(stmt.Value)
+		}
+	}
+}
+
+func (checker *checker) functionBody(fn *ast.Function) {
+	checker.function = &function{enclosing: checker.function}
+	checker.beginScope()
+	for _, param := range fn.Params {
+		checker.declare(param, "parameter")
+	}
+	checker.statements(fn.Body.Stmts)
+	checker.endScope()
+	checker.function = checker.function.enclosing
+}
+
+// returns reports whether stmt always returns, so nothing after it runs
+func returns(stmt ast.Stmt) bool {
+	switch stmt := stmt.(type) {
+	case *ast.ReturnStmt:
+		return true
+	case *ast.Block:
+		for _, inner := range stmt.Stmts {
+			if returns(inner) {
+				return true
+			}
+		}
+	case *ast.IfStmt:
+		return stmt.Else != nil && returns(stmt.Then) && returns(stmt.Else)
+	}
+	return false
+}
+
+// endregion Statements
+
+// region Expressions
+
+func (checker *checker) expression(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		checker.resolve(expr, true)
+	case *ast.Grouping:
+		checker.expression(expr.X)
+	case *ast.Unary:
+		checker.expression(expr.X)
+	case *ast.Binary:
+		checker.comparison(expr)
+		checker.expression(expr.X)
+		checker.expression(expr.Y)
+	case *ast.Logical:
+		checker.expression(expr.X)
+		checker.expression(expr.Y)
+	case *ast.Assign:
+		checker.expression(expr.Value)
+		checker.resolve(expr.Name, false)
+	case *ast.Call:
+		checker.expression(expr.Callee)
+		for _, arg := range expr.Args {
+			checker.expression(arg)
+		}
+	case *ast.Get:
+		checker.expression(expr.X)
+	case *ast.Set:
+		checker.expression(expr.X)
+		checker.expression(expr.Value)
+	case *ast.This:
+		if checker.classDepth == 0 {
+			checker.warn(expr.Keyword, "this", "'this' used outside of a method.")
+		}
+	}
+}
+
+// comparison reports comparing literals whose types make the result
+// certain, or make the comparison fail at runtime
+func (checker *checker) comparison(expr *ast.Binary) {
+	left, right := literalType(expr.X), literalType(expr.Y)
+	if left == "" || right == "" {
+		return
+	}
+
+	switch expr.Op {
+	case vm.TOKEN_EQUAL_EQUAL, vm.TOKEN_BANG_EQUAL:
+		if left == right {
+			return
+		}
+		result := "false"
+		if expr.Op == vm.TOKEN_BANG_EQUAL {
+			result = "true"
+		}
+		checker.warn(expr.OpPos, opText(expr.Op),
+			fmt.Sprintf("Comparison of %s and %s is always %s.", left, right, result))
+	case vm.TOKEN_GREATER, vm.TOKEN_GREATER_EQUAL, vm.TOKEN_LESS, vm.TOKEN_LESS_EQUAL:
+		if left == "number" && right == "number" {
+			return
+		}
+		checker.warn(expr.OpPos, opText(expr.Op),
+			fmt.Sprintf("Comparison of %s and %s fails at runtime, operands must be numbers.", left, right))
+	}
+}
+
+// literalType returns the type of a literal value, or of an expression
+// which obviously has that type, empty for anything else
+func literalType(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Grouping:
+		return literalType(expr.X)
+	case *ast.Unary:
+		if expr.Op == vm.TOKEN_BANG {
+			return "boolean"
+		}
+		if literalType(expr.X) == "number" {
+			return "number"
+		}
+	case *ast.Literal:
+		switch expr.Kind {
+		case vm.TOKEN_NUMBER:
+			return "number"
+		case vm.TOKEN_STRING:
+			return "string"
+		case vm.TOKEN_TRUE, vm.TOKEN_FALSE:
+			return "boolean"
+		case vm.TOKEN_NIL:
+			return "nil"
+		}
+	}
+	return ""
+}
+
+// endregion Expressions
+
+// region Scopes
+
+func (checker *checker) beginScope() {
+	checker.function.scopeDepth++
+}
+
+// endScope leaves the innermost scope, reporting its unused locals
+func (checker *checker) endScope() {
+	function := checker.function
+	function.scopeDepth--
+
+	for len(function.locals) > 0 && function.locals[len(function.locals)-1].depth > function.scopeDepth {
+		local := function.locals[len(function.locals)-1]
+		function.locals = function.locals[:len(function.locals)-1]
+		// Parameters are often required by callers, and _ marks names meant to be unused
+		if !local.used && local.kind != "parameter" && !strings.HasPrefix(local.name.Name, "_") {
+			checker.warn(local.name.NamePos, local.name.Name,
+				fmt.Sprintf("Local %s '%s' is declared but never used.", local.kind, local.name.Name))
+		}
+	}
+}
+
+// declare adds a variable to the innermost scope. Globals aren't tracked,
+// they were all collected before checking.
+func (checker *checker) declare(name *ast.Ident, kind string) {
+	if checker.function.enclosing == nil && checker.function.scopeDepth == 0 {
+		return
+	}
+
+	shadowed, functions := checker.lookup(name.Name)
+	switch {
+	case shadowed == nil:
+	case functions == 0 && shadowed.depth == checker.function.scopeDepth:
+		checker.warn(name.NamePos, name.Name, fmt.Sprintf("'%s' is already declared on line %d in this scope.",
+			name.Name, shadowed.name.NamePos.Line))
+	default:
+		checker.warn(name.NamePos, name.Name, fmt.Sprintf("Declaration of '%s' shadows the %s declared on line %d.",
+			name.Name, shadowed.kind, shadowed.name.NamePos.Line))
+	}
+	checker.function.locals = append(checker.function.locals,
+		&variable{name: name, kind: kind, depth: checker.function.scopeDepth})
+}
+
+// resolve finds the variable name refers to, marking it used if it is
+// read, and reports assigning to a global which is never declared
+func (checker *checker) resolve(name *ast.Ident, read bool) {
+	if local, _ := checker.lookup(name.Name); local != nil {
+		if read {
+			local.used = true
+		}
+		return
+	}
+
+	if !read && !checker.globals[name.Name] && (checker.isBuiltin == nil || !checker.isBuiltin(name.Name)) {
+		checker.warn(name.NamePos, name.Name, fmt.Sprintf("Assignment to undeclared global '%s'.", name.Name))
+	}
+}
+
+// lookup finds the innermost local called name in the current function
+// or those enclosing it, and how many functions out it was found. It
+// returns nil if name refers to a global.
+func (checker *checker) lookup(name string) (*variable, int) {
+	depth := 0
+	for function := checker.function; function != nil; function = function.enclosing {
+		for i := len(function.locals) - 1; i >= 0; i-- {
+			if function.locals[i].name.Name == name {
+				return function.locals[i], depth
+			}
+		}
+		depth++
+	}
+	return nil, 0
+}
+
+// endregion Scopes
+
+// region Helper Functions
+
+func (checker *checker) warn(pos vm.Position, text string, message string) {
+	checker.diagnostics = append(checker.diagnostics, vm.NewDiagnostic(vm.SEVERITY_WARNING, pos, text, message))
+}
+
+// firstToken returns the text of the keyword or name starting stmt
+func firstToken(stmt ast.Stmt) string {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		return exprToken(stmt.X)
+	case *ast.PrintStmt:
+		return "print"
+	case *ast.VarDecl:
+		return "var"
+	case *ast.FunDecl:
+		return "fun"
+	case *ast.ClassDecl:
+		return "class"
+	case *ast.Block:
+		return "{"
+	case *ast.IfStmt:
+		return "if"
+	case *ast.WhileStmt:
+		return "while"
+	case *ast.ForStmt:
+		return "for"
+	case *ast.ReturnStmt:
+		return "return"
+	}
+	return ""
+}
+
+// exprToken returns the text of the token starting expr
+func exprToken(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		return expr.Name
+	case *ast.Literal:
+		return expr.Raw
+	case *ast.Grouping:
+		return "("
+	case *ast.Unary:
+		return opText(expr.Op)
+	case *ast.Binary:
+		return exprToken(expr.X)
+	case *ast.Logical:
+		return exprToken(expr.X)
+	case *ast.Assign:
+		return expr.Name.Name
+	case *ast.Call:
+		return exprToken(expr.Callee)
+	case *ast.Get:
+		return exprToken(expr.X)
+	case *ast.Set:
+		return exprToken(expr.X)
+	case *ast.This:
+		return "this"
+	case *ast.Super:
+		return "super"
+	}
+	return ""
+}
+
+// opText returns the source text of an operator
+func opText(op vm.TokenType) string {
+	switch op {
+	case vm.TOKEN_BANG:
+		return "!"
+	case vm.TOKEN_MINUS:
+		return "-"
+	case vm.TOKEN_EQUAL_EQUAL:
+		return "=="
+	case vm.TOKEN_BANG_EQUAL:
+		return "!="
+	case vm.TOKEN_GREATER:
+		return ">"
+	case vm.TOKEN_GREATER_EQUAL:
+		return ">="
+	case vm.TOKEN_LESS:
+		return "<"
+	case vm.TOKEN_LESS_EQUAL:
+		return "<="
+	}
+	return ""
+}
+
+// endregion Helper Functions
@@ -0,0 +1,80 @@
+package vet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Braden-Griebel/cloxgo/ast"
+)
+
+func TestCheck(t *testing.T) {
+	// finding is a message expected at a line and column
+	type finding struct {
+		line    int
+		column  int
+		message string
+	}
+	tests := []struct {
+		name   string
+		source string
+		// Findings expected, in order
+		want []finding
+	}{
+		{"unused local", "{ var a = 1; }", []finding{{1, 7, "Local variable 'a' is declared but never used."}}},
+		{"used local", "{ var a = 1; print a; }", nil},
+		{"unused local function", "fun f() { fun g() {} }", []finding{{1, 15, "Local function 'g' is declared but never used."}}},
+		{"unused parameter", "fun f(a) {}", nil},
+		{"unused local named with _", "{ var _a = 1; }", nil},
+		{"unused global", "var a = 1;", nil},
+		{"local class used as a superclass", "{ class A {} class B < A {} print B; }", nil},
+		{"unused local class", "{ class A {} }", []finding{{1, 9, "Local class 'A' is declared but never used."}}},
+
+		{"assignment to undeclared global", "a = 1;", []finding{{1, 1, "Assignment to undeclared global 'a'."}}},
+		{"assignment to global declared later", "fun f() { a = 1; } var a;", nil},
+		{"assignment to builtin", "clock = 1;", nil},
+		{"undeclared superclass", "class A < D {}", nil},
+
+		{"unreachable code", "fun f() { return 1; print 2; print 3; }", []finding{{1, 21, "Unreachable code."}}},
+		{"unreachable after if returning both ways", "fun f(a) { if (a) return 1; else return 2; print 3; }",
+			[]finding{{1, 44, "Unreachable code."}}},
+		{"unreachable on a later line", "fun f() {\n  return 1;\n  print 2;\n}", []finding{{3, 3, "Unreachable code."}}},
+		{"reachable after if returning one way", "fun f(a) { if (a) return 1; print 3; }", nil},
+
+		// Also a compile error, which the vet command reports instead
+		{"this outside of a method", "fun f() { return this; }", []finding{{1, 18, "'this' used outside of a method."}}},
+		{"this in a method", "class A { m() { return this; } }", nil},
+
+		{"equality of different types", `print 1 == "1"; print nil != false;`,
+			[]finding{{1, 9, "Comparison of number and string is always false."}, {1, 27, "Comparison of nil and boolean is always true."}}},
+		{"equality of the same type", `print 1 == 2; print "a" != "b";`, nil},
+		{"ordering of non-numbers", `print "a" < 1;`,
+			[]finding{{1, 11, "Comparison of string and number fails at runtime, operands must be numbers."}}},
+		{"ordering of numbers", "print -1 < (2);", nil},
+		{"comparison of variables", "var a; var b; print a == b; print a < b;", nil},
+
+		{"shadowed local", "{ var a = 1; { var a = 2; print a; } print a; }",
+			[]finding{{1, 20, "Declaration of 'a' shadows the variable declared on line 1."}}},
+		{"shadowed parameter", "fun f(a) { fun g() { var a = 1; print a; } g(); }",
+			[]finding{{1, 26, "Declaration of 'a' shadows the parameter declared on line 1."}}},
+		// Also a compile error, which the vet command reports instead
+		{"redeclared parameter", "fun f(a) { var a = 1; print a; }",
+			[]finding{{1, 16, "'a' is already declared on line 1 in this scope."}}},
+		{"locals in sibling scopes", "{ var a = 1; print a; } { var a = 2; print a; }", nil},
+	}
+
+	isBuiltin := func(name string) bool { return name == "clock" }
+	for _, test := range tests {
+		program, diagnostics := ast.Parse(test.source)
+		if len(diagnostics) > 0 {
+			t.Errorf("%s: %v", test.name, diagnostics)
+			continue
+		}
+		var findings []finding
+		for _, diagnostic := range Check(program, isBuiltin) {
+			findings = append(findings, finding{diagnostic.Start.Line, diagnostic.Start.Column, diagnostic.Message})
+		}
+		if !reflect.DeepEqual(findings, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, findings, test.want)
+		}
+	}
+}
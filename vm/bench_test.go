@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"io"
+	"testing"
+)
+
+// benchmarkProgram runs source once per iteration in a fresh VM, failing
+// if it has an error
+func benchmarkProgram(b *testing.B, source string) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		machine := InitVM(WithStdout(io.Discard), WithStderr(io.Discard))
+		_, err := machine.Interpret(source)
+		machine.FreeVM()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkArithmetic(b *testing.B) {
+	benchmarkProgram(b, `
+var sum = 0;
+for (var i = 0; i < 100000; i = i + 1) {
+  sum = sum + i * 2 - i / 4;
+}`)
+}
+
+func BenchmarkFib(b *testing.B) {
+	benchmarkProgram(b, `
+fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+fib(20);`)
+}
+
+func BenchmarkLoops(b *testing.B) {
+	benchmarkProgram(b, `
+fun loops() {
+  var count = 0;
+  for (var i = 0; i < 300; i = i + 1) {
+    for (var j = 0; j < 300; j = j + 1) {
+      if (i < j) count = count + 1;
+    }
+  }
+  return count;
+}
+loops();`)
+}
+
+func BenchmarkConcat(b *testing.B) {
+	benchmarkProgram(b, `
+var parts = "";
+for (var i = 0; i < 2000; i = i + 1) {
+  parts = "ab" + parts + "c";
+}`)
+}
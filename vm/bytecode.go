@@ -0,0 +1,377 @@
+package vm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// region Format
+
+// LOXC_MAGIC starts every serialized chunk
+const LOXC_MAGIC = "LOXC"
+
+// LOXC_VERSION is the version of the format written by MarshalBinary, it
+// must change whenever the format or the instruction set does
+const LOXC_VERSION uint16 = 4
+
+// Maximum depth of functions nested in a serialized chunk
+const LOXC_MAX_NESTING int = UINT8_COUNT
+
+// Tags identifying the type of a serialized constant
+const (
+	// CONSTANT_NUMBER is followed by the 8 byte IEEE 754 encoding of the number
+	CONSTANT_NUMBER byte = iota + 1
+	// CONSTANT_STRING is followed by the length and bytes of the string
+	CONSTANT_STRING
+	// CONSTANT_FUNCTION is followed by the arity, upvalue count, name and chunk of the function
+	CONSTANT_FUNCTION
+)
+
+// ErrInvalidBytecode is wrapped by the errors returned for malformed serialized chunks
+var ErrInvalidBytecode = errors.New("invalid bytecode")
+
+// endregion Format
+
+// region Encoding
+
+// MarshalBinary serializes the chunk. The data starts with LOXC_MAGIC and
+// LOXC_VERSION, followed by the code, the line of each byte of code and
+// the constants. Unsigned integers are written as varints and the lines
+// are run length encoded. Functions in the constants are written with
+// their own chunks.
+func (chunk *Chunk) MarshalBinary() ([]byte, error) {
+	data := []byte(LOXC_MAGIC)
+	data = binary.LittleEndian.AppendUint16(data, LOXC_VERSION)
+	return appendChunk(data, chunk)
+}
+
+func appendChunk(data []byte, chunk *Chunk) ([]byte, error) {
+	code := chunk.Code[:chunk.Count]
+	data = binary.AppendUvarint(data, uint64(len(code)))
+	for _, instruction := range code {
+		data = append(data, byte(instruction))
+	}
+
+	// Each run is a line followed by the number of bytes on it
+	var runs [][2]uint
+	for _, line := range chunk.Lines[:chunk.Count] {
+		if len(runs) > 0 && runs[len(runs)-1][0] == line {
+			runs[len(runs)-1][1]++
+		} else {
+			runs = append(runs, [2]uint{line, 1})
+		}
+	}
+	data = binary.AppendUvarint(data, uint64(len(runs)))
+	for _, run := range runs {
+		data = binary.AppendUvarint(data, uint64(run[0]))
+		data = binary.AppendUvarint(data, uint64(run[1]))
+	}
+
+	constants := chunk.Constants.values[:chunk.Constants.count]
+	data = binary.AppendUvarint(data, uint64(len(constants)))
+	for _, constant := range constants {
+		var err error
+		data, err = appendConstant(data, constant)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+func appendConstant(data []byte, constant Value) ([]byte, error) {
+	if isNumber(constant) {
+		data = append(data, CONSTANT_NUMBER)
+		return binary.LittleEndian.AppendUint64(data, math.Float64bits(valAsNumber(constant))), nil
+	}
+
+	if isObj(constant) {
+		obj := valAsObj(constant)
+		switch obj.typeof {
+		case STRING_TYPE:
+			data = append(data, CONSTANT_STRING)
+			return appendString(data, *obj.data.asString()), nil
+		case FUNCTION_TYPE:
+			function := obj.data.asFunction()
+			data = append(data, CONSTANT_FUNCTION)
+			data = binary.AppendUvarint(data, uint64(function.arity))
+			data = binary.AppendUvarint(data, uint64(function.upvalueCount))
+			name := ""
+			if function.name != nil {
+				name = *function.name
+			}
+			data = appendString(data, name)
+			return appendChunk(data, &function.chunk)
+		}
+	}
+	return nil, fmt.Errorf("cannot serialize constant %s", formatValue(constant))
+}
+
+func appendString(data []byte, str string) []byte {
+	data = binary.AppendUvarint(data, uint64(len(str)))
+	return append(data, str...)
+}
+
+// endregion Encoding
+
+// region Decoding
+
+// UnmarshalBinary replaces the chunk with one serialized by MarshalBinary.
+// The magic number, version and lengths are checked and the chunk is
+// verified, so a corrupt chunk is reported as an error wrapping
+// ErrInvalidBytecode. The strings and functions in the constants
+// don't belong to a VM until the chunk is run with VM.InterpretChunk.
+func (chunk *Chunk) UnmarshalBinary(data []byte) error {
+	if len(data) < len(LOXC_MAGIC)+2 || string(data[:len(LOXC_MAGIC)]) != LOXC_MAGIC {
+		return fmt.Errorf("%w: missing magic number", ErrInvalidBytecode)
+	}
+	version := binary.LittleEndian.Uint16(data[len(LOXC_MAGIC):])
+	if version != LOXC_VERSION {
+		return fmt.Errorf("%w: unsupported version %d, expected %d", ErrInvalidBytecode, version, LOXC_VERSION)
+	}
+
+	decoder := chunkDecoder{data: data, offset: len(LOXC_MAGIC) + 2}
+	var decoded Chunk
+	if err := decoder.readChunk(&decoded, 0); err != nil {
+		return err
+	}
+	if decoder.offset != len(data) {
+		return decoder.errorf("unexpected data after chunk")
+	}
+	if err := decoded.Verify(); err != nil {
+		return err
+	}
+
+	*chunk = decoded
+	return nil
+}
+
+// chunkDecoder reads a serialized chunk, keeping track of its position
+type chunkDecoder struct {
+	data   []byte
+	offset int
+}
+
+func (decoder *chunkDecoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at byte %d", ErrInvalidBytecode, fmt.Sprintf(format, args...), decoder.offset)
+}
+
+func (decoder *chunkDecoder) readByte() (byte, error) {
+	if decoder.offset >= len(decoder.data) {
+		return 0, decoder.errorf("unexpected end of data")
+	}
+	decoder.offset++
+	return decoder.data[decoder.offset-1], nil
+}
+
+func (decoder *chunkDecoder) readUvarint() (uint64, error) {
+	value, size := binary.Uvarint(decoder.data[decoder.offset:])
+	if size <= 0 {
+		return 0, decoder.errorf("malformed integer")
+	}
+	decoder.offset += size
+	return value, nil
+}
+
+// readLength reads the number of items which follow, each of which takes
+// at least one byte, so a corrupt length can't cause a huge allocation
+func (decoder *chunkDecoder) readLength() (int, error) {
+	length, err := decoder.readUvarint()
+	if err != nil {
+		return 0, err
+	}
+	if length > uint64(len(decoder.data)-decoder.offset) {
+		return 0, decoder.errorf("length %d is longer than the remaining data", length)
+	}
+	return int(length), nil
+}
+
+func (decoder *chunkDecoder) readString() (string, error) {
+	length, err := decoder.readLength()
+	if err != nil {
+		return "", err
+	}
+	str := string(decoder.data[decoder.offset : decoder.offset+length])
+	decoder.offset += length
+	return str, nil
+}
+
+func (decoder *chunkDecoder) readChunk(chunk *Chunk, depth int) error {
+	if depth > LOXC_MAX_NESTING {
+		return decoder.errorf("functions nested too deeply")
+	}
+
+	codeLength, err := decoder.readLength()
+	if err != nil {
+		return err
+	}
+	for _, instruction := range decoder.data[decoder.offset : decoder.offset+codeLength] {
+		chunk.Code = append(chunk.Code, OpCode(instruction))
+	}
+	decoder.offset += codeLength
+	chunk.Count = uint(codeLength)
+
+	runCount, err := decoder.readLength()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < runCount; i++ {
+		line, err := decoder.readUvarint()
+		if err != nil {
+			return err
+		}
+		count, err := decoder.readUvarint()
+		if err != nil {
+			return err
+		}
+		if count > uint64(codeLength-len(chunk.Lines)) {
+			return decoder.errorf("line table is longer than the code")
+		}
+		for j := uint64(0); j < count; j++ {
+			chunk.Lines = append(chunk.Lines, uint(line))
+		}
+	}
+	if len(chunk.Lines) != codeLength {
+		return decoder.errorf("line table is shorter than the code")
+	}
+
+	constantCount, err := decoder.readLength()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < constantCount; i++ {
+		constant, err := decoder.readConstant(depth)
+		if err != nil {
+			return err
+		}
+		writeValueArray(&chunk.Constants, constant)
+	}
+	return nil
+}
+
+func (decoder *chunkDecoder) readConstant(depth int) (Value, error) {
+	tag, err := decoder.readByte()
+	if err != nil {
+		return nilToVal(), err
+	}
+
+	switch tag {
+	case CONSTANT_NUMBER:
+		if len(decoder.data)-decoder.offset < 8 {
+			return nilToVal(), decoder.errorf("unexpected end of data")
+		}
+		bits := binary.LittleEndian.Uint64(decoder.data[decoder.offset:])
+		decoder.offset += 8
+		return numberToVal(math.Float64frombits(bits)), nil
+	case CONSTANT_STRING:
+		str, err := decoder.readString()
+		if err != nil {
+			return nilToVal(), err
+		}
+		return StringConstant(str), nil
+	case CONSTANT_FUNCTION:
+		return decoder.readFunction(depth)
+	default:
+		return nilToVal(), decoder.errorf("unknown constant tag %d", tag)
+	}
+}
+
+func (decoder *chunkDecoder) readFunction(depth int) (Value, error) {
+	arity, err := decoder.readUvarint()
+	if err != nil {
+		return nilToVal(), err
+	}
+	upvalueCount, err := decoder.readUvarint()
+	if err != nil {
+		return nilToVal(), err
+	}
+	if arity >= uint64(UINT8_COUNT) || upvalueCount > uint64(UINT8_COUNT) {
+		return nilToVal(), decoder.errorf("function has too many parameters or upvalues")
+	}
+	name, err := decoder.readString()
+	if err != nil {
+		return nilToVal(), err
+	}
+
+	var chunk Chunk
+	if err := decoder.readChunk(&chunk, depth+1); err != nil {
+		return nilToVal(), err
+	}
+	return FunctionConstant(name, int(arity), int(upvalueCount), &chunk), nil
+}
+
+// endregion Decoding
+
+// region Constants
+
+// StringConstant creates a string for the constants of a chunk built
+// outside the compiler. Like the strings read by UnmarshalBinary, it
+// doesn't belong to a VM until the chunk is run with VM.InterpretChunk.
+func StringConstant(str string) Value {
+	return objToVal(dataToObj(&StringObj{value: &str}).data)
+}
+
+// FunctionConstant creates a function running chunk for the constants of
+// a chunk built outside the compiler, see StringConstant
+func FunctionConstant(name string, arity int, upvalueCount int, chunk *Chunk) Value {
+	function := &FunctionObj{arity: arity, upvalueCount: upvalueCount, name: &name, chunk: *chunk}
+	return objToVal(dataToObj(function).data)
+}
+
+// endregion Constants
+
+// region Loading
+
+// InterpretChunk verifies and runs a chunk, such as one read with
+// UnmarshalBinary, as a script. file is recorded as the origin of its
+// functions in stack traces.
+func (machine *VM) InterpretChunk(file string, chunk *Chunk) (InterpretResult, error) {
+	machine.startRun(context.Background())
+	defer machine.finishRun()
+
+	script := &FunctionObj{chunk: *chunk}
+	if err := verifyFunction(script, make(map[*FunctionObj]bool)); err != nil {
+		_, _ = fmt.Fprintln(machine.errorOutput, err)
+		return INTERPRET_COMPILE_ERROR, err
+	}
+	function := machine.loadFunction(file, script)
+	return machine.runScript(function)
+}
+
+// loadFunction copies source into a function owned by the VM, interning
+// the strings in its constants and loading the functions among them
+func (machine *VM) loadFunction(file string, source *FunctionObj) *FunctionObj {
+	function := machine.newFunction()
+	function.arity = source.arity
+	function.upvalueCount = source.upvalueCount
+	function.maxSlots = source.maxSlots
+	function.name = source.name
+	function.file = file
+	// Keep the function reachable while its constants are allocated
+	machine.pushValue(objToVal(function))
+
+	chunk := &source.chunk
+	function.chunk.Code = chunk.Code[:chunk.Count]
+	function.chunk.Lines = chunk.Lines[:chunk.Count]
+	function.chunk.Count = chunk.Count
+	for _, constant := range chunk.Constants.values[:chunk.Constants.count] {
+		if isObj(constant) {
+			obj := valAsObj(constant)
+			switch obj.typeof {
+			case STRING_TYPE:
+				constant = objToVal(machine.copyString(*obj.data.asString()))
+			case FUNCTION_TYPE:
+				constant = objToVal(machine.loadFunction(file, obj.data.asFunction()))
+			}
+		}
+		writeValueArray(&function.chunk.Constants, constant)
+	}
+
+	machine.popValue()
+	return function
+}
+
+// endregion Loading
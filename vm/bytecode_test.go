@@ -0,0 +1,288 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testProgram uses every kind of constant and most instructions
+const testProgram = `
+var greeting = "héllo";
+var empty = "";
+print greeting + empty;
+print -0 + 1500.25;
+
+fun makeCounter(start) {
+  var count = start;
+  fun increment() {
+    count = count + 1;
+    return count;
+  }
+  return increment;
+}
+var counter = makeCounter(10);
+counter();
+print counter();
+
+class Animal {
+  init(name) { this.name = name; }
+  speak() { return this.name + " makes a sound"; }
+}
+class Dog < Animal {
+  speak() { return super.speak() + ", woof"; }
+  fetch() { var bound = super.speak; return bound(); }
+}
+var dog = Dog("Rex");
+print dog.speak();
+print dog.fetch();
+
+var i = 0;
+while (i < 3 and !(i == 5)) {
+  if (i != 1) print i; else print nil;
+  i = i + 1;
+}
+for (var j = 0; j <= 1; j = j + 1) print j > 0 or false;
+`
+
+// compileChunk compiles source without optimizing it, failing the test
+// on a compile error. The chunk's objects are freed when the test ends.
+func compileChunk(t *testing.T, source string) *Chunk {
+	t.Helper()
+	return compileChunkAt(t, OPTIMIZE_NONE, source)
+}
+
+// compileChunkAt is like compileChunk, optimizing the code at level
+func compileChunkAt(t *testing.T, level OptimizationLevel, source string) *Chunk {
+	t.Helper()
+	machine := InitVM(WithOptimizationLevel(level))
+	t.Cleanup(machine.FreeVM)
+	function, diagnostics := Compile(source, &machine)
+	if function == nil {
+		t.Fatalf("compile failed: %v", diagnostics)
+	}
+	return function.Chunk()
+}
+
+// runChunk runs chunk in a fresh VM, returning what it printed
+func runChunk(t *testing.T, chunk *Chunk) (string, error) {
+	t.Helper()
+	var output bytes.Buffer
+	machine := InitVM(WithStdout(&output), WithStderr(io.Discard), WithMaxInstructions(100000))
+	defer machine.FreeVM()
+	_, err := machine.InterpretChunk("test", chunk)
+	return output.String(), err
+}
+
+// equalChunks reports whether two chunks have the same code, lines and
+// constants, comparing functions by their contents
+func equalChunks(a *Chunk, b *Chunk) bool {
+	if !bytes.Equal(opCodeBytes(a.Code[:a.Count]), opCodeBytes(b.Code[:b.Count])) {
+		return false
+	}
+	for i := uint(0); i < a.Count; i++ {
+		if a.Lines[i] != b.Lines[i] {
+			return false
+		}
+	}
+	if a.Constants.count != b.Constants.count {
+		return false
+	}
+	for i := uint(0); i < a.Constants.count; i++ {
+		x, y := a.Constants.values[i], b.Constants.values[i]
+		switch {
+		case isNumber(x) && isNumber(y):
+			if math.Float64bits(valAsNumber(x)) != math.Float64bits(valAsNumber(y)) {
+				return false
+			}
+		case isObj(x) && isObj(y) && isString(valAsObj(x)) && isString(valAsObj(y)):
+			if *valAsObj(x).data.asString() != *valAsObj(y).data.asString() {
+				return false
+			}
+		case isObj(x) && isObj(y) && isFunction(valAsObj(x)) && isFunction(valAsObj(y)):
+			f, g := valAsObj(x).data.asFunction(), valAsObj(y).data.asFunction()
+			if f.arity != g.arity || f.upvalueCount != g.upvalueCount || *f.name != *g.name ||
+				!equalChunks(&f.chunk, &g.chunk) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func opCodeBytes(code []OpCode) []byte {
+	data := make([]byte, len(code))
+	for i, instruction := range code {
+		data[i] = byte(instruction)
+	}
+	return data
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	chunk := compileChunk(t, testProgram)
+	data, err := chunk.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded Chunk
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !equalChunks(chunk, &decoded) {
+		t.Error("unmarshaled chunk differs from the original")
+	}
+
+	want, err := runChunk(t, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := runChunk(t, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("unmarshaled chunk printed %q, want %q", got, want)
+	}
+}
+
+func TestMarshalConstantTypes(t *testing.T) {
+	inner := InitChunk()
+	WriteChunk(&inner, OP_NIL, 1)
+	WriteChunk(&inner, OP_RETURN, 1)
+
+	constants := []struct {
+		name  string
+		value Value
+	}{
+		{"number", NumberValue(42.5)},
+		{"negative zero", NumberValue(math.Copysign(0, -1))},
+		{"infinity", NumberValue(math.Inf(1))},
+		{"NaN", NumberValue(math.NaN())},
+		{"string", StringConstant("lox ✓")},
+		{"empty string", StringConstant("")},
+		{"function", FunctionConstant("f", 2, 0, &inner)},
+	}
+	for _, constant := range constants {
+		chunk := InitChunk()
+		AddConstant(&chunk, constant.value)
+		WriteChunk(&chunk, OP_NIL, 1)
+		WriteChunk(&chunk, OP_RETURN, 1)
+
+		data, err := chunk.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: %v", constant.name, err)
+			continue
+		}
+		var decoded Chunk
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Errorf("%s: %v", constant.name, err)
+			continue
+		}
+		if !equalChunks(&chunk, &decoded) {
+			t.Errorf("%s: constant changed in a round trip", constant.name)
+		}
+	}
+}
+
+func TestMarshalRejectsUnserializableConstants(t *testing.T) {
+	chunk := InitChunk()
+	AddConstant(&chunk, BoolValue(true))
+	WriteChunk(&chunk, OP_NIL, 1)
+	WriteChunk(&chunk, OP_RETURN, 1)
+	if _, err := chunk.MarshalBinary(); err == nil {
+		t.Error("marshaled a boolean constant")
+	}
+}
+
+func TestUnmarshalRejectsInvalidData(t *testing.T) {
+	data, err := compileChunk(t, testProgram).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(LOXC_MAGIC) + 2
+
+	// Each test changes a copy of data
+	tests := []struct {
+		name   string
+		change func(data []byte) []byte
+	}{
+		{"empty", func(data []byte) []byte { return nil }},
+		{"wrong magic", func(data []byte) []byte { data[0] = 'X'; return data }},
+		{"wrong version", func(data []byte) []byte {
+			binary.LittleEndian.PutUint16(data[len(LOXC_MAGIC):], LOXC_VERSION+1)
+			return data
+		}},
+		{"trailing data", func(data []byte) []byte { return append(data, 0) }},
+		{"unknown opcode", func(data []byte) []byte { data[header+1] = 0xff; return data }},
+		{"constant out of range", func(data []byte) []byte {
+			// The script starts by loading its first constant
+			data[header+1] = byte(OP_CONSTANT)
+			data[header+2] = 0xff
+			return data
+		}},
+		{"unknown constant tag", func(data []byte) []byte {
+			return append(data[:header], 2, byte(OP_NIL), byte(OP_RETURN), 1, 1, 2, 1, 99)
+		}},
+		{"code longer than data", func(data []byte) []byte {
+			return append(data[:header], 0x7f, byte(OP_NIL))
+		}},
+	}
+	for _, test := range tests {
+		corrupt := test.change(append([]byte(nil), data...))
+		var chunk Chunk
+		if err := chunk.UnmarshalBinary(corrupt); !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: got error %v, want ErrInvalidBytecode", test.name, err)
+		}
+	}
+
+	for length := 0; length < len(data); length++ {
+		var chunk Chunk
+		if err := chunk.UnmarshalBinary(data[:length]); !errors.Is(err, ErrInvalidBytecode) {
+			t.Fatalf("truncated to %d bytes: got error %v, want ErrInvalidBytecode", length, err)
+		}
+	}
+}
+
+// TestCorruptChunksDontPanic runs randomly corrupted chunks, which must
+// either be rejected or run to completion or a runtime error
+func TestCorruptChunksDontPanic(t *testing.T) {
+	data, err := compileChunk(t, testProgram).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		corrupt := append([]byte(nil), data...)
+		for changes := random.Intn(4); changes >= 0; changes-- {
+			position := len(LOXC_MAGIC) + 2 + random.Intn(len(corrupt)-len(LOXC_MAGIC)-2)
+			switch random.Intn(3) {
+			case 0:
+				corrupt[position] = byte(random.Intn(256))
+			case 1:
+				corrupt[position] ^= 1 << random.Intn(8)
+			case 2:
+				corrupt[position] += byte(random.Intn(5) - 2)
+			}
+		}
+
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					t.Fatalf("chunk %x panicked: %v", corrupt, recovered)
+				}
+			}()
+			var chunk Chunk
+			if chunk.UnmarshalBinary(corrupt) == nil {
+				_, _ = runChunk(t, &chunk)
+			}
+		}()
+	}
+}
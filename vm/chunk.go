@@ -1,23 +1,55 @@
 package vm
 
+import "fmt"
+
 type OpCode byte
 
 // Possible OpCodes
 const (
 	// OP_CONSTANT Represents a constant value
 	OP_CONSTANT OpCode = iota
+	// OP_CONSTANT_LONG represents a constant value with a 24-bit index
+	OP_CONSTANT_LONG
 	// OP_NIL Represents a Nil Value
 	OP_NIL
 	// OP_TRUE represents a true value
 	OP_TRUE
 	// OP_FALSE represents a false value
 	OP_FALSE
+	// OP_POP discards the top of the stack
+	OP_POP
+	// OP_GET_LOCAL pushes the value of a local variable
+	OP_GET_LOCAL
+	// OP_SET_LOCAL assigns to a local variable
+	OP_SET_LOCAL
+	// OP_GET_GLOBAL pushes the value of a global variable
+	OP_GET_GLOBAL
+	// OP_DEFINE_GLOBAL defines a new global variable
+	OP_DEFINE_GLOBAL
+	// OP_SET_GLOBAL assigns to an existing global variable
+	OP_SET_GLOBAL
+	// OP_GET_UPVALUE pushes the value of a captured variable
+	OP_GET_UPVALUE
+	// OP_SET_UPVALUE assigns to a captured variable
+	OP_SET_UPVALUE
+	// OP_GET_PROPERTY pushes a field or bound method of an instance
+	OP_GET_PROPERTY
+	// OP_SET_PROPERTY assigns to a field of an instance
+	OP_SET_PROPERTY
+	// OP_GET_SUPER pushes a superclass method bound to the current instance
+	OP_GET_SUPER
 	// OP_EQUAL represents the equality operator
 	OP_EQUAL
 	// OP_GREATER represents the greater than operator
 	OP_GREATER
 	// OP_LESS represents the less than operator
 	OP_LESS
+	// OP_NOT_EQUAL is OP_EQUAL followed by OP_NOT
+	OP_NOT_EQUAL
+	// OP_GREATER_EQUAL is OP_LESS followed by OP_NOT
+	OP_GREATER_EQUAL
+	// OP_LESS_EQUAL is OP_GREATER followed by OP_NOT
+	OP_LESS_EQUAL
 	// OP_ADD Represents Binary Addition
 	OP_ADD
 	// OP_SUBTRACT Represents Binary Subtraction
@@ -32,10 +64,175 @@ const (
 	OP_NEGATE
 	// OP_PRINT Prints the top of the stack
 	OP_PRINT
+	// OP_JUMP unconditionally jumps forward by a 16-bit offset
+	OP_JUMP
+	// OP_JUMP_IF_FALSE jumps forward by a 16-bit offset if the top of the stack is falsey
+	OP_JUMP_IF_FALSE
+	// OP_LOOP unconditionally jumps backward by a 16-bit offset
+	OP_LOOP
+	// OP_CALL calls the function below its arguments on the stack
+	OP_CALL
+	// OP_INVOKE calls a method on the instance below its arguments on the stack
+	OP_INVOKE
+	// OP_SUPER_INVOKE calls a superclass method on the current instance
+	OP_SUPER_INVOKE
+	// OP_CLOSURE creates a closure, followed by a pair of operands for each captured variable
+	OP_CLOSURE
+	// OP_CLOSE_UPVALUE moves the variable on top of the stack into its upvalue
+	OP_CLOSE_UPVALUE
 	// OP_RETURN Represents a function return
 	OP_RETURN
+	// OP_CLASS creates a new class
+	OP_CLASS
+	// OP_INHERIT copies the methods of a superclass into the subclass on top of the stack
+	OP_INHERIT
+	// OP_METHOD adds the closure on top of the stack as a method of the class below it
+	OP_METHOD
+
+	// Long forms of the instructions naming a constant, for constants past
+	// the first 256. They must stay last, see isLong.
+
+	// OP_GET_GLOBAL_LONG is OP_GET_GLOBAL with a 24-bit constant index
+	OP_GET_GLOBAL_LONG
+	// OP_DEFINE_GLOBAL_LONG is OP_DEFINE_GLOBAL with a 24-bit constant index
+	OP_DEFINE_GLOBAL_LONG
+	// OP_SET_GLOBAL_LONG is OP_SET_GLOBAL with a 24-bit constant index
+	OP_SET_GLOBAL_LONG
+	// OP_GET_PROPERTY_LONG is OP_GET_PROPERTY with a 24-bit constant index
+	OP_GET_PROPERTY_LONG
+	// OP_SET_PROPERTY_LONG is OP_SET_PROPERTY with a 24-bit constant index
+	OP_SET_PROPERTY_LONG
+	// OP_GET_SUPER_LONG is OP_GET_SUPER with a 24-bit constant index
+	OP_GET_SUPER_LONG
+	// OP_INVOKE_LONG is OP_INVOKE with a 24-bit constant index
+	OP_INVOKE_LONG
+	// OP_SUPER_INVOKE_LONG is OP_SUPER_INVOKE with a 24-bit constant index
+	OP_SUPER_INVOKE_LONG
+	// OP_CLOSURE_LONG is OP_CLOSURE with a 24-bit constant index
+	OP_CLOSURE_LONG
+	// OP_CLASS_LONG is OP_CLASS with a 24-bit constant index
+	OP_CLASS_LONG
+	// OP_METHOD_LONG is OP_METHOD with a 24-bit constant index
+	OP_METHOD_LONG
 )
 
+// longForms maps each instruction with a one byte constant index to its
+// long form
+var longForms = map[OpCode]OpCode{
+	OP_CONSTANT:      OP_CONSTANT_LONG,
+	OP_GET_GLOBAL:    OP_GET_GLOBAL_LONG,
+	OP_DEFINE_GLOBAL: OP_DEFINE_GLOBAL_LONG,
+	OP_SET_GLOBAL:    OP_SET_GLOBAL_LONG,
+	OP_GET_PROPERTY:  OP_GET_PROPERTY_LONG,
+	OP_SET_PROPERTY:  OP_SET_PROPERTY_LONG,
+	OP_GET_SUPER:     OP_GET_SUPER_LONG,
+	OP_INVOKE:        OP_INVOKE_LONG,
+	OP_SUPER_INVOKE:  OP_SUPER_INVOKE_LONG,
+	OP_CLOSURE:       OP_CLOSURE_LONG,
+	OP_CLASS:         OP_CLASS_LONG,
+	OP_METHOD:        OP_METHOD_LONG,
+}
+
+// shortForms maps each long form back to the instruction it widens
+var shortForms = map[OpCode]OpCode{
+	OP_CONSTANT_LONG:      OP_CONSTANT,
+	OP_GET_GLOBAL_LONG:    OP_GET_GLOBAL,
+	OP_DEFINE_GLOBAL_LONG: OP_DEFINE_GLOBAL,
+	OP_SET_GLOBAL_LONG:    OP_SET_GLOBAL,
+	OP_GET_PROPERTY_LONG:  OP_GET_PROPERTY,
+	OP_SET_PROPERTY_LONG:  OP_SET_PROPERTY,
+	OP_GET_SUPER_LONG:     OP_GET_SUPER,
+	OP_INVOKE_LONG:        OP_INVOKE,
+	OP_SUPER_INVOKE_LONG:  OP_SUPER_INVOKE,
+	OP_CLOSURE_LONG:       OP_CLOSURE,
+	OP_CLASS_LONG:         OP_CLASS,
+	OP_METHOD_LONG:        OP_METHOD,
+}
+
+var opCodeNames = map[OpCode]string{
+	OP_CONSTANT:      "OP_CONSTANT",
+	OP_CONSTANT_LONG: "OP_CONSTANT_LONG",
+	OP_NIL:           "OP_NIL",
+	OP_TRUE:          "OP_TRUE",
+	OP_FALSE:         "OP_FALSE",
+	OP_POP:           "OP_POP",
+	OP_GET_LOCAL:     "OP_GET_LOCAL",
+	OP_SET_LOCAL:     "OP_SET_LOCAL",
+	OP_GET_GLOBAL:    "OP_GET_GLOBAL",
+	OP_DEFINE_GLOBAL: "OP_DEFINE_GLOBAL",
+	OP_SET_GLOBAL:    "OP_SET_GLOBAL",
+	OP_GET_UPVALUE:   "OP_GET_UPVALUE",
+	OP_SET_UPVALUE:   "OP_SET_UPVALUE",
+	OP_GET_PROPERTY:  "OP_GET_PROPERTY",
+	OP_SET_PROPERTY:  "OP_SET_PROPERTY",
+	OP_GET_SUPER:     "OP_GET_SUPER",
+	OP_EQUAL:         "OP_EQUAL",
+	OP_GREATER:       "OP_GREATER",
+	OP_LESS:          "OP_LESS",
+	OP_NOT_EQUAL:     "OP_NOT_EQUAL",
+	OP_GREATER_EQUAL: "OP_GREATER_EQUAL",
+	OP_LESS_EQUAL:    "OP_LESS_EQUAL",
+	OP_ADD:           "OP_ADD",
+	OP_SUBTRACT:      "OP_SUBTRACT",
+	OP_MULTIPLY:      "OP_MULTIPLY",
+	OP_DIVIDE:        "OP_DIVIDE",
+	OP_NOT:           "OP_NOT",
+	OP_NEGATE:        "OP_NEGATE",
+	OP_PRINT:         "OP_PRINT",
+	OP_JUMP:          "OP_JUMP",
+	OP_JUMP_IF_FALSE: "OP_JUMP_IF_FALSE",
+	OP_LOOP:          "OP_LOOP",
+	OP_CALL:          "OP_CALL",
+	OP_INVOKE:        "OP_INVOKE",
+	OP_SUPER_INVOKE:  "OP_SUPER_INVOKE",
+	OP_CLOSURE:       "OP_CLOSURE",
+	OP_CLOSE_UPVALUE: "OP_CLOSE_UPVALUE",
+	OP_RETURN:        "OP_RETURN",
+	OP_CLASS:         "OP_CLASS",
+	OP_INHERIT:       "OP_INHERIT",
+	OP_METHOD:        "OP_METHOD",
+
+	OP_GET_GLOBAL_LONG:    "OP_GET_GLOBAL_LONG",
+	OP_DEFINE_GLOBAL_LONG: "OP_DEFINE_GLOBAL_LONG",
+	OP_SET_GLOBAL_LONG:    "OP_SET_GLOBAL_LONG",
+	OP_GET_PROPERTY_LONG:  "OP_GET_PROPERTY_LONG",
+	OP_SET_PROPERTY_LONG:  "OP_SET_PROPERTY_LONG",
+	OP_GET_SUPER_LONG:     "OP_GET_SUPER_LONG",
+	OP_INVOKE_LONG:        "OP_INVOKE_LONG",
+	OP_SUPER_INVOKE_LONG:  "OP_SUPER_INVOKE_LONG",
+	OP_CLOSURE_LONG:       "OP_CLOSURE_LONG",
+	OP_CLASS_LONG:         "OP_CLASS_LONG",
+	OP_METHOD_LONG:        "OP_METHOD_LONG",
+}
+
+func (op OpCode) String() string {
+	if name, ok := opCodeNames[op]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP_UNKNOWN(%d)", byte(op))
+}
+
+// LongForm returns the form of an instruction with a one byte constant
+// index which takes a 24-bit index instead, for constants past the
+// first 256. It is only defined for instructions naming a constant.
+func (op OpCode) LongForm() OpCode {
+	return longForms[op]
+}
+
+// isLong reports whether the constant index of an instruction is 24 bits
+func (op OpCode) isLong() bool {
+	return op == OP_CONSTANT_LONG || op >= OP_GET_GLOBAL_LONG
+}
+
+// shortForm returns the instruction a long form widens, or op itself if
+// it isn't a long form
+func (op OpCode) shortForm() OpCode {
+	if short, ok := shortForms[op]; ok {
+		return short
+	}
+	return op
+}
+
 // Chunk is a representation of an array of uint
 type Chunk struct {
 	Code      []OpCode
@@ -57,8 +254,8 @@ func WriteChunk(chunk *Chunk, codebyte OpCode, line uint) {
 	chunk.Lines = append(chunk.Lines, line)
 }
 
-// Add a constant to the constant array
-func AddConstant(chunk *Chunk, value Value) byte {
+// Add a constant to the constant array and return its index
+func AddConstant(chunk *Chunk, value Value) int {
 	writeValueArray(&chunk.Constants, value)
-	return byte(chunk.Constants.count - 1)
+	return int(chunk.Constants.count - 1)
 }
@@ -1,11 +1,81 @@
 package vm
 
 import (
-	"fmt"
 	"math"
 	"strconv"
 )
 
+// Number of distinct values which fit in a single byte operand
+const UINT8_COUNT int = 256
+
+// Number of constants a chunk can hold, limited by the 24-bit index of the long instructions
+const CONSTANTS_MAX int = 1 << 24
+
+// Local represents a local variable tracked by the compiler
+type Local struct {
+	// Token holding the name of the variable
+	name Token
+	// Scope depth of the variable, -1 while it is being initialized
+	depth int
+	// Whether the variable is captured by a closure
+	isCaptured bool
+}
+
+// Upvalue represents a variable captured from an enclosing function
+type Upvalue struct {
+	// Local slot or upvalue index in the enclosing function
+	index byte
+	// Whether the variable is a local of the immediately enclosing function
+	isLocal bool
+}
+
+// FunctionType distinguishes the top level script from function bodies
+type FunctionType byte
+
+const (
+	TYPE_FUNCTION FunctionType = iota
+	TYPE_INITIALIZER
+	TYPE_METHOD
+	TYPE_SCRIPT
+)
+
+// Compiler tracks the local variables and scope of the function being compiled
+type Compiler struct {
+	// Compiler of the surrounding function, nil for the top level script
+	enclosing *Compiler
+	// Function being compiled
+	function *FunctionObj
+	// Kind of function being compiled
+	functionType FunctionType
+	// Local variables currently in scope
+	locals [UINT8_COUNT]Local
+	// Number of locals currently in scope
+	localCount int
+	// Variables captured from enclosing functions
+	upvalues [UINT8_COUNT]Upvalue
+	// Number of blocks surrounding the current code
+	scopeDepth int
+	// Index of each number and string already in the chunk's constants
+	constants map[constantKey]int
+}
+
+// constantKey identifies a constant which can be shared. Numbers are
+// compared by their bits so 0 and -0 stay distinct, and strings by their
+// interned object.
+type constantKey struct {
+	typeof ValueType
+	bits   uint64
+	obj    *Obj
+}
+
+// ClassCompiler tracks the class whose body is being compiled
+type ClassCompiler struct {
+	// Class surrounding this one, nil for the outermost class
+	enclosing *ClassCompiler
+	// Whether the class inherits from a superclass
+	hasSuperclass bool
+}
+
 // Parser represents the parser and compiler combined
 type Parser struct {
 	// Current token
@@ -14,54 +84,64 @@ type Parser struct {
 	previous Token
 	// Scanner reading the tokens from the soure code
 	scanner *Scanner
-	// Chunk being compiled
-	compilingChunk *Chunk
+	// Virtual machine which owns the objects created while compiling
+	vm *VM
+	// File the source code was read from, empty if unknown
+	file string
+	// Compiler for the innermost function being compiled
+	compiler *Compiler
+	// Innermost class being compiled, nil outside of classes
+	currentClass *ClassCompiler
 	// Whether an error occurred during parsing
 	hadError bool
+	// Problems found in the source so far
+	diagnostics []Diagnostic
 	// Whether the Parser/Compiler is in panic mode
 	panicMode bool
-	// Parser Rules
-	rules map[TokenType]ParseRule
 }
 
-func (parser *Parser) InitRules() {
-	parser.rules = map[TokenType]ParseRule{
-		TOKEN_LEFT_PAREN:    {parser.grouping, nil, PREC_NONE},
+// rules holds the ParseRule of each token type. It is filled in by init,
+// since the parse functions refer back to it.
+var rules map[TokenType]ParseRule
+
+func init() {
+	rules = map[TokenType]ParseRule{
+		TOKEN_LEFT_PAREN:    {(*Parser).grouping, (*Parser).call, PREC_CALL},
 		TOKEN_RIGHT_PAREN:   {nil, nil, PREC_NONE},
 		TOKEN_LEFT_BRACE:    {nil, nil, PREC_NONE},
 		TOKEN_RIGHT_BRACE:   {nil, nil, PREC_NONE},
 		TOKEN_COMMA:         {nil, nil, PREC_NONE},
-		TOKEN_DOT:           {nil, nil, PREC_NONE},
-		TOKEN_MINUS:         {parser.unary, parser.binary, PREC_TERM},
-		TOKEN_PLUS:          {nil, parser.binary, PREC_TERM},
+		TOKEN_DOT:           {nil, (*Parser).dot, PREC_CALL},
+		TOKEN_MINUS:         {(*Parser).unary, (*Parser).binary, PREC_TERM},
+		TOKEN_PLUS:          {nil, (*Parser).binary, PREC_TERM},
 		TOKEN_SEMICOLON:     {nil, nil, PREC_NONE},
-		TOKEN_SLASH:         {nil, parser.binary, PREC_FACTOR},
-		TOKEN_STAR:          {nil, parser.binary, PREC_FACTOR},
-		TOKEN_BANG:          {parser.unary, nil, PREC_NONE},
-		TOKEN_BANG_EQUAL:    {nil, nil, PREC_NONE},
+		TOKEN_SLASH:         {nil, (*Parser).binary, PREC_FACTOR},
+		TOKEN_STAR:          {nil, (*Parser).binary, PREC_FACTOR},
+		TOKEN_BANG:          {(*Parser).unary, nil, PREC_NONE},
+		TOKEN_BANG_EQUAL:    {nil, (*Parser).binary, PREC_EQUALITY},
 		TOKEN_EQUAL:         {nil, nil, PREC_NONE},
-		TOKEN_EQUAL_EQUAL:   {nil, parser.binary, PREC_EQUALITY},
-		TOKEN_GREATER:       {nil, parser.binary, PREC_COMPARISON},
-		TOKEN_GREATER_EQUAL: {nil, parser.binary, PREC_COMPARISON},
-		TOKEN_LESS:          {nil, parser.binary, PREC_COMPARISON},
-		TOKEN_LESS_EQUAL:    {nil, parser.binary, PREC_COMPARISON},
-		TOKEN_IDENTIFIER:    {nil, nil, PREC_NONE},
-		TOKEN_STRING:        {parser.string, nil, PREC_NONE},
-		TOKEN_NUMBER:        {parser.number, nil, PREC_NONE},
-		TOKEN_AND:           {nil, nil, PREC_NONE},
+		TOKEN_EQUAL_EQUAL:   {nil, (*Parser).binary, PREC_EQUALITY},
+		TOKEN_GREATER:       {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_GREATER_EQUAL: {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_LESS:          {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_LESS_EQUAL:    {nil, (*Parser).binary, PREC_COMPARISON},
+		TOKEN_IDENTIFIER:    {(*Parser).variable, nil, PREC_NONE},
+		TOKEN_STRING:        {(*Parser).string, nil, PREC_NONE},
+		TOKEN_NUMBER:        {(*Parser).number, nil, PREC_NONE},
+		TOKEN_AND:           {nil, (*Parser).and, PREC_AND},
 		TOKEN_CLASS:         {nil, nil, PREC_NONE},
 		TOKEN_ELSE:          {nil, nil, PREC_NONE},
-		TOKEN_FALSE:         {parser.literal, nil, PREC_NONE},
+		TOKEN_FALSE:         {(*Parser).literal, nil, PREC_NONE},
 		TOKEN_FOR:           {nil, nil, PREC_NONE},
 		TOKEN_FUN:           {nil, nil, PREC_NONE},
 		TOKEN_IF:            {nil, nil, PREC_NONE},
-		TOKEN_NIL:           {parser.literal, nil, PREC_NONE},
-		TOKEN_OR:            {nil, nil, PREC_NONE},
+		TOKEN_NIL:           {(*Parser).literal, nil, PREC_NONE},
+		TOKEN_OR:            {nil, (*Parser).or, PREC_OR},
 		TOKEN_PRINT:         {nil, nil, PREC_NONE},
 		TOKEN_RETURN:        {nil, nil, PREC_NONE},
-		TOKEN_SUPER:         {nil, nil, PREC_NONE},
-		TOKEN_THIS:          {nil, nil, PREC_NONE},
-		TOKEN_TRUE:          {parser.literal, nil, PREC_NONE},
+		TOKEN_SUPER:         {(*Parser).super, nil, PREC_NONE},
+		TOKEN_THIS:          {(*Parser).this, nil, PREC_NONE},
+		TOKEN_TRUE:          {(*Parser).literal, nil, PREC_NONE},
 		TOKEN_VAR:           {nil, nil, PREC_NONE},
 		TOKEN_WHILE:         {nil, nil, PREC_NONE},
 		TOKEN_ERROR:         {nil, nil, PREC_NONE},
@@ -69,25 +149,256 @@ func (parser *Parser) InitRules() {
 	}
 }
 
-func Compile(source string, chunk *Chunk) bool {
-	scanner := initScanner(&source)
-	parser := Parser{scanner: scanner, compilingChunk: chunk}
-	parser.InitRules()
+// Compile compiles source into the function for the top level script,
+// along with every problem found in it. The function is nil if there was
+// a compile error. Objects created while compiling are owned by machine.
+func Compile(source string, machine *VM) (*FunctionObj, []Diagnostic) {
+	return CompileFile("", source, machine)
+}
+
+// CompileFile is like Compile, but records file as the origin of the
+// compiled functions
+func CompileFile(file string, source string, machine *VM) (*FunctionObj, []Diagnostic) {
+	scanner := NewScanner(source)
+	parser := Parser{scanner: scanner, vm: machine, file: file}
+	var compiler Compiler
+	parser.initCompiler(&compiler, TYPE_SCRIPT)
 	parser.advance()
 
 	for !parser.match(TOKEN_EOF) {
 		parser.declaration()
 	}
 
-	//parser.consume(TOKEN_EOF, "Expect end of expression.")
-	parser.endCompiler()
-	return !parser.hadError
+	function := parser.endCompiler()
+	if parser.hadError {
+		return nil, parser.diagnostics
+	}
+	return function, parser.diagnostics
+}
+
+func (parser *Parser) initCompiler(compiler *Compiler, functionType FunctionType) {
+	compiler.enclosing = parser.compiler
+	compiler.function = nil
+	compiler.functionType = functionType
+	compiler.constants = make(map[constantKey]int)
+	parser.compiler = compiler
+	parser.vm.compiler = compiler
+	compiler.function = parser.vm.newFunction()
+	compiler.function.file = parser.file
+	if functionType != TYPE_SCRIPT {
+		name := parser.lexeme(&parser.previous)
+		compiler.function.name = &name
+	}
+
+	// Slot zero is reserved for the function being called, or the
+	// receiver in methods
+	local := &compiler.locals[compiler.localCount]
+	compiler.localCount++
+	local.depth = 0
+	local.isCaptured = false
+	if functionType != TYPE_FUNCTION && functionType != TYPE_SCRIPT {
+		local.name = syntheticToken("this")
+	} else {
+		local.name = syntheticToken("")
+	}
 }
 
 // region Declaration Parsing
 
 func (parser *Parser) declaration() {
-	parser.statement()
+	if parser.match(TOKEN_CLASS) {
+		parser.classDeclaration()
+	} else if parser.match(TOKEN_FUN) {
+		parser.funDeclaration()
+	} else if parser.match(TOKEN_VAR) {
+		parser.varDeclaration()
+	} else {
+		parser.statement()
+	}
+
+	if parser.panicMode {
+		parser.synchronize()
+	}
+}
+
+func (parser *Parser) classDeclaration() {
+	parser.consume(TOKEN_IDENTIFIER, "Expect class name.")
+	className := parser.previous
+	nameConstant := parser.identifierConstant(&parser.previous)
+	parser.declareVariable()
+
+	parser.emitConstantOp(OP_CLASS, nameConstant)
+	parser.defineVariable(nameConstant)
+
+	classCompiler := ClassCompiler{enclosing: parser.currentClass}
+	parser.currentClass = &classCompiler
+
+	if parser.match(TOKEN_LESS) {
+		parser.consume(TOKEN_IDENTIFIER, "Expect superclass name.")
+		parser.variable(false)
+
+		if parser.identifiersEqual(&className, &parser.previous) {
+			parser.error("A class can't inherit from itself.")
+		}
+
+		// Store the superclass in a local so methods can capture it for super
+		parser.beginScope()
+		parser.addLocal(syntheticToken("super"))
+		parser.defineVariable(0)
+
+		parser.namedVariable(className, false)
+		parser.emitByte(OP_INHERIT)
+		classCompiler.hasSuperclass = true
+	}
+
+	// Load the class back onto the stack so methods can be bound to it
+	parser.namedVariable(className, false)
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before class body.")
+	for !parser.check(TOKEN_RIGHT_BRACE) && !parser.check(TOKEN_EOF) {
+		parser.method()
+	}
+	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after class body.")
+	parser.emitByte(OP_POP)
+
+	if classCompiler.hasSuperclass {
+		parser.endScope()
+	}
+
+	parser.currentClass = parser.currentClass.enclosing
+}
+
+func (parser *Parser) method() {
+	parser.consume(TOKEN_IDENTIFIER, "Expect method name.")
+	constant := parser.identifierConstant(&parser.previous)
+
+	functionType := TYPE_METHOD
+	if parser.lexeme(&parser.previous) == "init" {
+		functionType = TYPE_INITIALIZER
+	}
+	parser.function(functionType)
+
+	parser.emitConstantOp(OP_METHOD, constant)
+}
+
+func (parser *Parser) funDeclaration() {
+	global := parser.parseVariable("Expect function name.")
+	parser.markInitialized()
+	parser.function(TYPE_FUNCTION)
+	parser.defineVariable(global)
+}
+
+func (parser *Parser) function(functionType FunctionType) {
+	var compiler Compiler
+	parser.initCompiler(&compiler, functionType)
+	parser.beginScope()
+
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after function name.")
+	if !parser.check(TOKEN_RIGHT_PAREN) {
+		for {
+			parser.compiler.function.arity++
+			if parser.compiler.function.arity > 255 {
+				parser.errorAtCurrent("Can't have more than 255 parameters.")
+			}
+			constant := parser.parseVariable("Expect parameter name.")
+			parser.defineVariable(constant)
+			if !parser.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after parameters.")
+	parser.consume(TOKEN_LEFT_BRACE, "Expect '{' before function body.")
+	parser.block()
+
+	// No endScope needed, the whole frame is discarded on return
+	function := parser.endCompiler()
+	parser.emitConstantOp(OP_CLOSURE, parser.makeConstant(objToVal(function)))
+
+	for i := 0; i < function.upvalueCount; i++ {
+		if compiler.upvalues[i].isLocal {
+			parser.emitByte(1)
+		} else {
+			parser.emitByte(0)
+		}
+		parser.emitByte(OpCode(compiler.upvalues[i].index))
+	}
+}
+
+func (parser *Parser) varDeclaration() {
+	global := parser.parseVariable("Expect variable name.")
+
+	if parser.match(TOKEN_EQUAL) {
+		parser.expression()
+	} else {
+		parser.emitByte(OP_NIL)
+	}
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after variable declaration.")
+
+	parser.defineVariable(global)
+}
+
+func (parser *Parser) parseVariable(errorMessage string) int {
+	parser.consume(TOKEN_IDENTIFIER, errorMessage)
+
+	parser.declareVariable()
+	if parser.compiler.scopeDepth > 0 {
+		return 0
+	}
+
+	return parser.identifierConstant(&parser.previous)
+}
+
+func (parser *Parser) declareVariable() {
+	if parser.compiler.scopeDepth == 0 {
+		return
+	}
+
+	name := &parser.previous
+	for i := parser.compiler.localCount - 1; i >= 0; i-- {
+		local := &parser.compiler.locals[i]
+		if local.depth != -1 && local.depth < parser.compiler.scopeDepth {
+			break
+		}
+
+		if parser.identifiersEqual(name, &local.name) {
+			parser.error("Already a variable with this name in this scope.")
+		}
+	}
+
+	parser.addLocal(*name)
+}
+
+func (parser *Parser) addLocal(name Token) {
+	if parser.compiler.localCount == UINT8_COUNT {
+		parser.error("Too many local variables in function.")
+		return
+	}
+
+	local := &parser.compiler.locals[parser.compiler.localCount]
+	parser.compiler.localCount++
+	local.name = name
+	local.depth = -1
+	local.isCaptured = false
+}
+
+func (parser *Parser) markInitialized() {
+	if parser.compiler.scopeDepth == 0 {
+		return
+	}
+	parser.compiler.locals[parser.compiler.localCount-1].depth = parser.compiler.scopeDepth
+}
+
+func (parser *Parser) identifierConstant(name *Token) int {
+	return parser.makeConstant(objToVal(parser.vm.copyString(parser.lexeme(name))))
+}
+
+func (parser *Parser) defineVariable(global int) {
+	if parser.compiler.scopeDepth > 0 {
+		parser.markInitialized()
+		return
+	}
+
+	parser.emitConstantOp(OP_DEFINE_GLOBAL, global)
 }
 
 // endregion Declaration Parsing
@@ -97,6 +408,46 @@ func (parser *Parser) declaration() {
 func (parser *Parser) statement() {
 	if parser.match(TOKEN_PRINT) {
 		parser.printStatement()
+	} else if parser.match(TOKEN_FOR) {
+		parser.forStatement()
+	} else if parser.match(TOKEN_IF) {
+		parser.ifStatement()
+	} else if parser.match(TOKEN_RETURN) {
+		parser.returnStatement()
+	} else if parser.match(TOKEN_WHILE) {
+		parser.whileStatement()
+	} else if parser.match(TOKEN_LEFT_BRACE) {
+		parser.beginScope()
+		parser.block()
+		parser.endScope()
+	} else {
+		parser.expressionStatement()
+	}
+}
+
+func (parser *Parser) block() {
+	for !parser.check(TOKEN_RIGHT_BRACE) && !parser.check(TOKEN_EOF) {
+		parser.declaration()
+	}
+
+	parser.consume(TOKEN_RIGHT_BRACE, "Expect '}' after block.")
+}
+
+func (parser *Parser) beginScope() {
+	parser.compiler.scopeDepth++
+}
+
+func (parser *Parser) endScope() {
+	parser.compiler.scopeDepth--
+
+	for parser.compiler.localCount > 0 &&
+		parser.compiler.locals[parser.compiler.localCount-1].depth > parser.compiler.scopeDepth {
+		if parser.compiler.locals[parser.compiler.localCount-1].isCaptured {
+			parser.emitByte(OP_CLOSE_UPVALUE)
+		} else {
+			parser.emitByte(OP_POP)
+		}
+		parser.compiler.localCount--
 	}
 }
 
@@ -106,6 +457,110 @@ func (parser *Parser) printStatement() {
 	parser.emitByte(OP_PRINT)
 }
 
+func (parser *Parser) ifStatement() {
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'if'.")
+	parser.expression()
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	thenJump := parser.emitJump(OP_JUMP_IF_FALSE)
+	parser.emitByte(OP_POP)
+	parser.statement()
+
+	elseJump := parser.emitJump(OP_JUMP)
+
+	parser.patchJump(thenJump)
+	parser.emitByte(OP_POP)
+
+	if parser.match(TOKEN_ELSE) {
+		parser.statement()
+	}
+	parser.patchJump(elseJump)
+}
+
+func (parser *Parser) returnStatement() {
+	if parser.compiler.functionType == TYPE_SCRIPT {
+		parser.error("Can't return from top-level code.")
+	}
+
+	if parser.match(TOKEN_SEMICOLON) {
+		parser.emitReturn()
+	} else {
+		if parser.compiler.functionType == TYPE_INITIALIZER {
+			parser.error("Can't return a value from an initializer.")
+		}
+
+		parser.expression()
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after return value.")
+		parser.emitByte(OP_RETURN)
+	}
+}
+
+func (parser *Parser) whileStatement() {
+	loopStart := parser.currentChunk().Count
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'while'.")
+	parser.expression()
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after condition.")
+
+	exitJump := parser.emitJump(OP_JUMP_IF_FALSE)
+	parser.emitByte(OP_POP)
+	parser.statement()
+	parser.emitLoop(loopStart)
+
+	parser.patchJump(exitJump)
+	parser.emitByte(OP_POP)
+}
+
+func (parser *Parser) forStatement() {
+	parser.beginScope()
+	parser.consume(TOKEN_LEFT_PAREN, "Expect '(' after 'for'.")
+	if parser.match(TOKEN_SEMICOLON) {
+		// No initializer
+	} else if parser.match(TOKEN_VAR) {
+		parser.varDeclaration()
+	} else {
+		parser.expressionStatement()
+	}
+
+	loopStart := parser.currentChunk().Count
+	exitJump := -1
+	if !parser.match(TOKEN_SEMICOLON) {
+		parser.expression()
+		parser.consume(TOKEN_SEMICOLON, "Expect ';' after loop condition.")
+
+		// Jump out of the loop if the condition is false
+		exitJump = int(parser.emitJump(OP_JUMP_IF_FALSE))
+		parser.emitByte(OP_POP)
+	}
+
+	if !parser.match(TOKEN_RIGHT_PAREN) {
+		bodyJump := parser.emitJump(OP_JUMP)
+		incrementStart := parser.currentChunk().Count
+		parser.expression()
+		parser.emitByte(OP_POP)
+		parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after for clauses.")
+
+		parser.emitLoop(loopStart)
+		loopStart = incrementStart
+		parser.patchJump(bodyJump)
+	}
+
+	parser.statement()
+	parser.emitLoop(loopStart)
+
+	if exitJump != -1 {
+		parser.patchJump(uint(exitJump))
+		parser.emitByte(OP_POP)
+	}
+
+	parser.endScope()
+}
+
+func (parser *Parser) expressionStatement() {
+	parser.expression()
+	parser.consume(TOKEN_SEMICOLON, "Expect ';' after expression.")
+	parser.emitByte(OP_POP)
+}
+
 // endregion Statement Parsing
 
 // region Expression Parsing
@@ -113,7 +568,7 @@ func (parser *Parser) expression() {
 	parser.parsePrecedence(PREC_ASSIGNMENT)
 }
 
-func (parser *Parser) number() {
+func (parser *Parser) number(canAssign bool) {
 	value, _ := strconv.ParseFloat(
 		string(
 			parser.scanner.code[parser.previous.start:parser.previous.start+parser.previous.length],
@@ -122,30 +577,66 @@ func (parser *Parser) number() {
 	parser.emitConstant(numberToVal(value))
 }
 
-func (parser *Parser) string() {
+func (parser *Parser) string(canAssign bool) {
 	newString := string(parser.scanner.code[parser.previous.start+1 : parser.previous.start+parser.previous.length-1])
-	parser.emitConstant(objToVal(&newString))
+	parser.emitConstant(objToVal(parser.vm.copyString(newString)))
 }
 
+// emitConstant loads value
 func (parser *Parser) emitConstant(value Value) {
-	parser.emitBytes(OP_CONSTANT, OpCode(parser.makeConstant(value)))
+	parser.emitConstantOp(OP_CONSTANT, parser.makeConstant(value))
 }
 
-func (parser *Parser) makeConstant(value Value) byte {
+// emitConstantOp emits op with the index of a constant, using the long
+// form of op once the constants no longer fit in a byte
+func (parser *Parser) emitConstantOp(op OpCode, constant int) {
+	if constant <= math.MaxUint8 {
+		parser.emitBytes(op, OpCode(constant))
+		return
+	}
+	parser.emitBytes(op.LongForm(), OpCode(constant>>16))
+	parser.emitBytes(OpCode(constant>>8), OpCode(constant))
+}
+
+// makeConstant adds value to the chunk's constants and returns its index,
+// reusing an identical number or string which is already there
+func (parser *Parser) makeConstant(value Value) int {
+	key, shared := constantKeyOf(value)
+	if shared {
+		if constant, ok := parser.compiler.constants[key]; ok {
+			return constant
+		}
+	}
+
 	constant := AddConstant(parser.currentChunk(), value)
-	if constant > math.MaxUint8 {
+	if constant >= CONSTANTS_MAX {
 		parser.error("Too many constants in one chunk.")
 		return 0
 	}
+	if shared {
+		parser.compiler.constants[key] = constant
+	}
 	return constant
 }
 
-func (parser *Parser) grouping() {
+// constantKeyOf returns the key of value, and whether it is a number or
+// string which can be shared
+func constantKeyOf(value Value) (constantKey, bool) {
+	if isNumber(value) {
+		return constantKey{typeof: value.Type(), bits: math.Float64bits(valAsNumber(value))}, true
+	}
+	if isObj(value) && valAsObj(value).typeof == STRING_TYPE {
+		return constantKey{typeof: value.Type(), obj: valAsObj(value)}, true
+	}
+	return constantKey{}, false
+}
+
+func (parser *Parser) grouping(canAssign bool) {
 	parser.expression()
 	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after expression.")
 }
 
-func (parser *Parser) unary() {
+func (parser *Parser) unary(canAssign bool) {
 	operatorType := parser.previous.tokenType
 
 	parser.parsePrecedence(PREC_UNARY)
@@ -178,24 +669,29 @@ const (
 
 func (parser *Parser) parsePrecedence(precedence Precedence) {
 	parser.advance()
-	prefixRule := parser.getRule(parser.previous.tokenType).prefix
+	prefixRule := GetRule(parser.previous.tokenType).prefix
 	if prefixRule == nil {
 		parser.error("Expect expression.")
 		return
 	}
 
-	prefixRule()
+	canAssign := precedence <= PREC_ASSIGNMENT
+	prefixRule(parser, canAssign)
 
-	for precedence <= parser.getRule(parser.current.tokenType).precedence {
+	for precedence <= GetRule(parser.current.tokenType).precedence {
 		parser.advance()
-		infixRule := parser.getRule(parser.previous.tokenType).infix
-		infixRule()
+		infixRule := GetRule(parser.previous.tokenType).infix
+		infixRule(parser, canAssign)
+	}
+
+	if canAssign && parser.match(TOKEN_EQUAL) {
+		parser.error("Invalid assignment target.")
 	}
 }
 
-func (parser *Parser) binary() {
+func (parser *Parser) binary(canAssign bool) {
 	operatorType := parser.previous.tokenType
-	rule := parser.getRule(operatorType)
+	rule := GetRule(operatorType)
 	parser.parsePrecedence(rule.precedence + 1)
 
 	switch operatorType {
@@ -224,7 +720,7 @@ func (parser *Parser) binary() {
 	}
 }
 
-func (parser *Parser) literal() {
+func (parser *Parser) literal(canAssign bool) {
 	switch parser.previous.tokenType {
 	case TOKEN_FALSE:
 		parser.emitByte(OP_FALSE)
@@ -237,16 +733,215 @@ func (parser *Parser) literal() {
 	}
 }
 
-func (parser *Parser) getRule(operatorType TokenType) ParseRule {
-	return parser.rules[operatorType]
+func (parser *Parser) call(canAssign bool) {
+	argCount := parser.argumentList()
+	parser.emitBytes(OP_CALL, OpCode(argCount))
+}
+
+func (parser *Parser) argumentList() byte {
+	var argCount int
+	if !parser.check(TOKEN_RIGHT_PAREN) {
+		for {
+			parser.expression()
+			if argCount == 255 {
+				parser.error("Can't have more than 255 arguments.")
+			}
+			argCount++
+			if !parser.match(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+	parser.consume(TOKEN_RIGHT_PAREN, "Expect ')' after arguments.")
+	return byte(argCount)
+}
+
+func (parser *Parser) dot(canAssign bool) {
+	parser.consume(TOKEN_IDENTIFIER, "Expect property name after '.'.")
+	name := parser.identifierConstant(&parser.previous)
+
+	if canAssign && parser.match(TOKEN_EQUAL) {
+		parser.expression()
+		parser.emitConstantOp(OP_SET_PROPERTY, name)
+	} else if parser.match(TOKEN_LEFT_PAREN) {
+		argCount := parser.argumentList()
+		parser.emitConstantOp(OP_INVOKE, name)
+		parser.emitByte(OpCode(argCount))
+	} else {
+		parser.emitConstantOp(OP_GET_PROPERTY, name)
+	}
+}
+
+func (parser *Parser) super(canAssign bool) {
+	if parser.currentClass == nil {
+		parser.error("Can't use 'super' outside of a class.")
+	} else if !parser.currentClass.hasSuperclass {
+		parser.error("Can't use 'super' in a class with no superclass.")
+	}
+
+	parser.consume(TOKEN_DOT, "Expect '.' after 'super'.")
+	parser.consume(TOKEN_IDENTIFIER, "Expect superclass method name.")
+	name := parser.identifierConstant(&parser.previous)
+
+	parser.namedVariable(syntheticToken("this"), false)
+	if parser.match(TOKEN_LEFT_PAREN) {
+		argCount := parser.argumentList()
+		parser.namedVariable(syntheticToken("super"), false)
+		parser.emitConstantOp(OP_SUPER_INVOKE, name)
+		parser.emitByte(OpCode(argCount))
+	} else {
+		parser.namedVariable(syntheticToken("super"), false)
+		parser.emitConstantOp(OP_GET_SUPER, name)
+	}
+}
+
+func (parser *Parser) this(canAssign bool) {
+	if parser.currentClass == nil {
+		parser.error("Can't use 'this' outside of a class.")
+		return
+	}
+
+	parser.variable(false)
+}
+
+func (parser *Parser) and(canAssign bool) {
+	endJump := parser.emitJump(OP_JUMP_IF_FALSE)
+
+	parser.emitByte(OP_POP)
+	parser.parsePrecedence(PREC_AND)
+
+	parser.patchJump(endJump)
+}
+
+func (parser *Parser) or(canAssign bool) {
+	elseJump := parser.emitJump(OP_JUMP_IF_FALSE)
+	endJump := parser.emitJump(OP_JUMP)
+
+	parser.patchJump(elseJump)
+	parser.emitByte(OP_POP)
+
+	parser.parsePrecedence(PREC_OR)
+	parser.patchJump(endJump)
+}
+
+func (parser *Parser) variable(canAssign bool) {
+	parser.namedVariable(parser.previous, canAssign)
+}
+
+func (parser *Parser) namedVariable(name Token, canAssign bool) {
+	var getOp, setOp OpCode
+	var arg int
+	if slot := parser.resolveLocal(parser.compiler, &name); slot != -1 {
+		arg = slot
+		getOp = OP_GET_LOCAL
+		setOp = OP_SET_LOCAL
+	} else if index := parser.resolveUpvalue(parser.compiler, &name); index != -1 {
+		arg = index
+		getOp = OP_GET_UPVALUE
+		setOp = OP_SET_UPVALUE
+	} else {
+		arg = parser.identifierConstant(&name)
+		getOp = OP_GET_GLOBAL
+		setOp = OP_SET_GLOBAL
+	}
+
+	// Slots and upvalue indexes always fit in a byte, so only globals
+	// take the long form
+	if canAssign && parser.match(TOKEN_EQUAL) {
+		parser.expression()
+		parser.emitConstantOp(setOp, arg)
+	} else {
+		parser.emitConstantOp(getOp, arg)
+	}
+}
+
+// resolveLocal finds the stack slot of a local variable, returning -1
+// if the name refers to a global
+func (parser *Parser) resolveLocal(compiler *Compiler, name *Token) int {
+	for i := compiler.localCount - 1; i >= 0; i-- {
+		local := &compiler.locals[i]
+		if parser.identifiersEqual(name, &local.name) {
+			if local.depth == -1 {
+				parser.error("Can't read local variable in its own initializer.")
+			}
+			return i
+		}
+	}
+
+	return -1
+}
+
+// resolveUpvalue finds the upvalue index of a variable declared in an
+// enclosing function, returning -1 if the name refers to a global
+func (parser *Parser) resolveUpvalue(compiler *Compiler, name *Token) int {
+	if compiler.enclosing == nil {
+		return -1
+	}
+
+	local := parser.resolveLocal(compiler.enclosing, name)
+	if local != -1 {
+		compiler.enclosing.locals[local].isCaptured = true
+		return parser.addUpvalue(compiler, byte(local), true)
+	}
+
+	upvalue := parser.resolveUpvalue(compiler.enclosing, name)
+	if upvalue != -1 {
+		return parser.addUpvalue(compiler, byte(upvalue), false)
+	}
+
+	return -1
+}
+
+func (parser *Parser) addUpvalue(compiler *Compiler, index byte, isLocal bool) int {
+	upvalueCount := compiler.function.upvalueCount
+
+	for i := 0; i < upvalueCount; i++ {
+		upvalue := &compiler.upvalues[i]
+		if upvalue.index == index && upvalue.isLocal == isLocal {
+			return i
+		}
+	}
+
+	if upvalueCount == UINT8_COUNT {
+		parser.error("Too many closure variables in function.")
+		return 0
+	}
+
+	compiler.upvalues[upvalueCount].isLocal = isLocal
+	compiler.upvalues[upvalueCount].index = index
+	compiler.function.upvalueCount++
+	return upvalueCount
+}
+
+// GetRule returns how the compiler parses tokens of the given type
+func GetRule(operatorType TokenType) ParseRule {
+	return rules[operatorType]
 }
 
+// ParseRule describes how a token is parsed at the start of an expression
+// and after an operand, and how tightly it binds as an infix operator
 type ParseRule struct {
-	prefix     func()
-	infix      func()
+	prefix     func(parser *Parser, canAssign bool)
+	infix      func(parser *Parser, canAssign bool)
 	precedence Precedence
 }
 
+// Precedence returns how tightly the token binds as an infix operator,
+// PREC_NONE if it isn't one
+func (rule ParseRule) Precedence() Precedence {
+	return rule.precedence
+}
+
+// HasPrefix returns whether the token can start an expression
+func (rule ParseRule) HasPrefix() bool {
+	return rule.prefix != nil
+}
+
+// HasInfix returns whether the token can follow an operand
+func (rule ParseRule) HasInfix() bool {
+	return rule.infix != nil
+}
+
 // endregion Expression Parsing
 
 // region Error Handling
@@ -258,23 +953,36 @@ func (parser *Parser) error(message string) {
 	parser.errorAt(&parser.previous, message)
 }
 
+// errorAt records an error at token. Further errors are ignored until
+// the parser synchronizes, since they are likely caused by the first.
 func (parser *Parser) errorAt(token *Token, message string) {
 	if parser.panicMode {
 		return
 	}
 	parser.panicMode = true
-	_ = fmt.Errorf("[line %d] Error", token.line)
+	parser.diagnostics = append(parser.diagnostics,
+		NewTokenDiagnostic(SEVERITY_ERROR, *token, parser.lexeme(token), message))
+	parser.hadError = true
+}
 
-	if token.tokenType == TOKEN_EOF {
-		_ = fmt.Errorf(" at end")
-	} else if token.tokenType == TOKEN_ERROR {
-		// Pass
-	} else {
-		_ = fmt.Errorf(" at '%s'", string(parser.scanner.code[token.start:token.start+token.length]))
-	}
+// synchronize skips tokens until a likely statement boundary so that
+// one error doesn't cascade into many
+func (parser *Parser) synchronize() {
+	parser.panicMode = false
 
-	_ = fmt.Errorf(": %s\n", message)
-	parser.hadError = true
+	for parser.current.tokenType != TOKEN_EOF {
+		if parser.previous.tokenType == TOKEN_SEMICOLON {
+			return
+		}
+		switch parser.current.tokenType {
+		case TOKEN_CLASS, TOKEN_FUN, TOKEN_VAR, TOKEN_FOR,
+			TOKEN_IF, TOKEN_WHILE, TOKEN_PRINT, TOKEN_RETURN:
+			return
+		default:
+			// Do nothing
+		}
+		parser.advance()
+	}
 }
 
 // endregion Error Handling
@@ -283,12 +991,12 @@ func (parser *Parser) errorAt(token *Token, message string) {
 func (parser *Parser) advance() {
 	parser.previous = parser.current
 	for {
-		parser.current = parser.scanner.scanToken()
+		parser.current = parser.scanner.ScanToken()
 		if parser.current.tokenType != TOKEN_ERROR {
 			break
 		}
 
-		parser.errorAtCurrent(string(parser.scanner.code[parser.current.start:]))
+		parser.errorAtCurrent(*parser.current.err)
 	}
 }
 
@@ -310,22 +1018,92 @@ func (parser *Parser) emitBytes(instruction1 OpCode, instruction2 OpCode) {
 	parser.emitByte(instruction2)
 }
 
+// emitJump writes a jump instruction with a placeholder offset, returning
+// the location of the offset so it can be patched later
+func (parser *Parser) emitJump(instruction OpCode) uint {
+	parser.emitByte(instruction)
+	parser.emitBytes(0xff, 0xff)
+	return parser.currentChunk().Count - 2
+}
+
+// patchJump backfills the jump offset at offset to land on the next instruction
+func (parser *Parser) patchJump(offset uint) {
+	// -2 to adjust for the bytecode for the jump offset itself
+	jump := parser.currentChunk().Count - offset - 2
+
+	if jump > math.MaxUint16 {
+		parser.error("Too much code to jump over.")
+	}
+
+	parser.currentChunk().Code[offset] = OpCode((jump >> 8) & 0xff)
+	parser.currentChunk().Code[offset+1] = OpCode(jump & 0xff)
+}
+
+func (parser *Parser) emitLoop(loopStart uint) {
+	parser.emitByte(OP_LOOP)
+
+	offset := parser.currentChunk().Count - loopStart + 2
+	if offset > math.MaxUint16 {
+		parser.error("Loop body too large.")
+	}
+
+	parser.emitByte(OpCode((offset >> 8) & 0xff))
+	parser.emitByte(OpCode(offset & 0xff))
+}
+
 func (parser *Parser) currentChunk() *Chunk {
-	return parser.compilingChunk
+	return &parser.compiler.function.chunk
 }
 
-func (parser *Parser) endCompiler() {
+// endCompiler finishes the innermost function and returns to its enclosing compiler
+func (parser *Parser) endCompiler() *FunctionObj {
+	parser.emitReturn()
+	function := parser.compiler.function
+	if !parser.hadError {
+		if parser.vm.optimizationLevel >= OPTIMIZE_PEEPHOLE {
+			parser.vm.optimize(function)
+		}
+		// Finds the size of the function's frame, and catches code the VM can't run
+		v := verifier{function: function}
+		if err := v.verify(); err != nil {
+			parser.error(err.Error())
+		}
+	}
+
 	if DEBUG_PRINT_CODE {
 		if !parser.hadError {
-			DisassembleChunk(parser.currentChunk(), "code")
+			name := "<script>"
+			if function.name != nil {
+				name = *function.name
+			}
+			DisassembleChunk(parser.vm.stdout, parser.currentChunk(), name)
 		}
 	}
+
+	parser.compiler = parser.compiler.enclosing
+	parser.vm.compiler = parser.compiler
+	return function
 }
 
 func (parser *Parser) emitReturn() {
+	// Initializers implicitly return the instance in slot zero
+	if parser.compiler.functionType == TYPE_INITIALIZER {
+		parser.emitBytes(OP_GET_LOCAL, 0)
+	} else {
+		parser.emitByte(OP_NIL)
+	}
 	parser.emitByte(OP_RETURN)
 }
 
+// lexeme returns the source text of a token
+func (parser *Parser) lexeme(token *Token) string {
+	return parser.scanner.Lexeme(*token)
+}
+
+func (parser *Parser) identifiersEqual(a *Token, b *Token) bool {
+	return parser.lexeme(a) == parser.lexeme(b)
+}
+
 func (parser *Parser) match(tokenType TokenType) bool {
 	if !parser.check(tokenType) {
 		return false
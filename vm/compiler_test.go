@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// longProgram needs every instruction naming a constant, so it uses their
+// long forms when it comes after manyConstants
+const longProgram = `
+var x = 1;
+x = x + 1;
+print x;
+class A {
+  init(n) { this.n = n; }
+  get() { return this.n; }
+}
+class B < A {
+  get() { return super.get() + 1; }
+  bound() { var method = super.get; return method(); }
+}
+var b = B(x);
+b.n = b.n * 10;
+print b.get();
+print b.bound();
+fun outer() {
+  var captured = "captured";
+  fun inner() { return captured; }
+  return inner;
+}
+print outer()();
+`
+
+// manyConstants returns statements which fill the first count constants
+// with distinct numbers
+func manyConstants(count int) string {
+	var source strings.Builder
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&source, "%d;\n", i)
+	}
+	return source.String()
+}
+
+func TestCompilerLongConstants(t *testing.T) {
+	source := manyConstants(300) + longProgram
+	want, err := runSource(OPTIMIZE_NONE, longProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, level := range []OptimizationLevel{OPTIMIZE_NONE, OPTIMIZE_PEEPHOLE} {
+		chunk := compileChunkAt(t, level, source)
+		if chunk.Constants.count <= 256 {
+			t.Errorf("level %d: %d constants, want more than 256", level, chunk.Constants.count)
+		}
+		if err := chunk.Verify(); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+
+		counts := countOpCodes(chunk)
+		for _, op := range []OpCode{OP_CONSTANT_LONG, OP_GET_GLOBAL_LONG, OP_DEFINE_GLOBAL_LONG, OP_SET_GLOBAL_LONG,
+			OP_GET_PROPERTY_LONG, OP_SET_PROPERTY_LONG, OP_INVOKE_LONG, OP_CLOSURE_LONG, OP_CLASS_LONG} {
+			if counts[op] == 0 {
+				t.Errorf("level %d: script has no %v", level, op)
+			}
+		}
+
+		data, err := chunk.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Chunk
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if !equalChunks(chunk, &decoded) {
+			t.Errorf("level %d: unmarshaled chunk differs from the original", level)
+		}
+
+		output, err := runSource(level, source)
+		if err != nil || output != want {
+			t.Errorf("level %d: printed %q with error %v, want %q", level, output, err, want)
+		}
+	}
+}
+
+// TestCompilerLongMethods checks the long forms inside a class whose
+// methods have more than 256 constants of their own
+func TestCompilerLongMethods(t *testing.T) {
+	source := `
+class A {
+  init(n) { this.n = n; }
+  get() { return this.n; }
+}
+class B < A {
+  get() {
+` + manyConstants(300) + `
+    return super.get() + this.n;
+  }
+  bound() {
+` + manyConstants(300) + `
+    var method = super.get;
+    return method();
+  }
+}
+print B(1).get();
+print B(2).bound();
+`
+	chunk := compileChunk(t, source)
+	if err := chunk.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[OpCode]int)
+	for _, value := range chunk.Constants.values[:chunk.Constants.count] {
+		if isObj(value) && isFunction(valAsObj(value)) {
+			for op, count := range countOpCodes(&valAsObj(value).data.asFunction().chunk) {
+				counts[op] += count
+			}
+		}
+	}
+	for _, op := range []OpCode{OP_SUPER_INVOKE_LONG, OP_GET_SUPER_LONG, OP_GET_PROPERTY_LONG} {
+		if counts[op] == 0 {
+			t.Errorf("methods have no %v", op)
+		}
+	}
+
+	output, err := runSource(OPTIMIZE_NONE, source)
+	if err != nil || output != "2\n2\n" {
+		t.Errorf("printed %q with error %v, want \"2\\n2\\n\"", output, err)
+	}
+}
+
+func TestCompilerSharesConstants(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   uint
+	}{
+		{"repeated number", "print 1; print 1; print 1;", 1},
+		{"repeated string", `print "a"; print "a";`, 1},
+		{"name and string", `var a = "a"; print a;`, 1},
+		{"number and string", `print 1; print "1";`, 2},
+		{"zero and negative zero", "print 0; print -0;", 1},
+		{"repeated global", "var a; a = 1; print a; print a;", 2},
+	}
+
+	for _, test := range tests {
+		chunk := compileChunk(t, test.source)
+		if chunk.Constants.count != test.want {
+			t.Errorf("%s: %d constants, want %d", test.name, chunk.Constants.count, test.want)
+		}
+	}
+}
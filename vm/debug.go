@@ -2,73 +2,202 @@ package vm
 
 import (
 	"fmt"
+	"io"
 )
 
-func DisassembleChunk(chunk *Chunk, name string) {
-	fmt.Printf("===%s===\n", name)
+// DisassembleChunk writes a listing of the instructions in chunk to w
+func DisassembleChunk(w io.Writer, chunk *Chunk, name string) {
+	_, _ = fmt.Fprintf(w, "===%s===\n", name)
 	var offset uint = 0
 	for offset < chunk.Count {
-		offset = disassembleInstruction(chunk, offset)
+		offset = disassembleInstruction(w, chunk, offset)
 	}
 }
 
-func disassembleInstruction(chunk *Chunk, offset uint) uint {
-	fmt.Printf("%04d ", offset)
+func disassembleInstruction(w io.Writer, chunk *Chunk, offset uint) uint {
+	_, _ = fmt.Fprintf(w, "%04d ", offset)
 
 	if offset > 0 && chunk.Lines[offset] == chunk.Lines[offset-1] {
-		fmt.Printf("   | ")
+		_, _ = fmt.Fprintf(w, "   | ")
 	} else {
-		fmt.Printf("%4d ", chunk.Lines[offset])
+		_, _ = fmt.Fprintf(w, "%4d ", chunk.Lines[offset])
 	}
 
 	instruction := chunk.Code[offset]
 
 	switch instruction {
 	case OP_CONSTANT:
-		return constantInstruction("OP_CONSTANT", chunk, offset)
+		return constantInstruction(w, "OP_CONSTANT", chunk, offset)
+	case OP_CONSTANT_LONG:
+		return constantInstruction(w, "OP_CONSTANT_LONG", chunk, offset)
 	case OP_NIL:
-		return simpleInstruction("OP_NIL", offset)
+		return simpleInstruction(w, "OP_NIL", offset)
 	case OP_TRUE:
-		return simpleInstruction("OP_TRUE", offset)
+		return simpleInstruction(w, "OP_TRUE", offset)
 	case OP_FALSE:
-		return simpleInstruction("OP_FALSE", offset)
+		return simpleInstruction(w, "OP_FALSE", offset)
+	case OP_POP:
+		return simpleInstruction(w, "OP_POP", offset)
+	case OP_GET_LOCAL:
+		return byteInstruction(w, "OP_GET_LOCAL", chunk, offset)
+	case OP_SET_LOCAL:
+		return byteInstruction(w, "OP_SET_LOCAL", chunk, offset)
+	case OP_GET_GLOBAL:
+		return constantInstruction(w, "OP_GET_GLOBAL", chunk, offset)
+	case OP_DEFINE_GLOBAL:
+		return constantInstruction(w, "OP_DEFINE_GLOBAL", chunk, offset)
+	case OP_SET_GLOBAL:
+		return constantInstruction(w, "OP_SET_GLOBAL", chunk, offset)
+	case OP_GET_UPVALUE:
+		return byteInstruction(w, "OP_GET_UPVALUE", chunk, offset)
+	case OP_SET_UPVALUE:
+		return byteInstruction(w, "OP_SET_UPVALUE", chunk, offset)
+	case OP_GET_PROPERTY:
+		return constantInstruction(w, "OP_GET_PROPERTY", chunk, offset)
+	case OP_SET_PROPERTY:
+		return constantInstruction(w, "OP_SET_PROPERTY", chunk, offset)
+	case OP_GET_SUPER:
+		return constantInstruction(w, "OP_GET_SUPER", chunk, offset)
 	case OP_EQUAL:
-		return simpleInstruction("OP_EQUAL", offset)
+		return simpleInstruction(w, "OP_EQUAL", offset)
 	case OP_GREATER:
-		return simpleInstruction("OP_GREATER", offset)
+		return simpleInstruction(w, "OP_GREATER", offset)
 	case OP_LESS:
-		return simpleInstruction("OP_LESS", offset)
+		return simpleInstruction(w, "OP_LESS", offset)
+	case OP_NOT_EQUAL:
+		return simpleInstruction(w, "OP_NOT_EQUAL", offset)
+	case OP_GREATER_EQUAL:
+		return simpleInstruction(w, "OP_GREATER_EQUAL", offset)
+	case OP_LESS_EQUAL:
+		return simpleInstruction(w, "OP_LESS_EQUAL", offset)
 	case OP_ADD:
-		return simpleInstruction("OP_ADD", offset)
+		return simpleInstruction(w, "OP_ADD", offset)
 	case OP_SUBTRACT:
-		return simpleInstruction("OP_SUBTRACT", offset)
+		return simpleInstruction(w, "OP_SUBTRACT", offset)
 	case OP_MULTIPLY:
-		return simpleInstruction("OP_MULTIPLY", offset)
+		return simpleInstruction(w, "OP_MULTIPLY", offset)
 	case OP_DIVIDE:
-		return simpleInstruction("OP_DIVIDE", offset)
+		return simpleInstruction(w, "OP_DIVIDE", offset)
 	case OP_NOT:
-		return simpleInstruction("OP_NOT", offset)
+		return simpleInstruction(w, "OP_NOT", offset)
 	case OP_NEGATE:
-		return simpleInstruction("OP_NEGATE", offset)
+		return simpleInstruction(w, "OP_NEGATE", offset)
 	case OP_PRINT:
-		return simpleInstruction("OP_PRINT", offset)
+		return simpleInstruction(w, "OP_PRINT", offset)
+	case OP_JUMP:
+		return jumpInstruction(w, "OP_JUMP", 1, chunk, offset)
+	case OP_JUMP_IF_FALSE:
+		return jumpInstruction(w, "OP_JUMP_IF_FALSE", 1, chunk, offset)
+	case OP_LOOP:
+		return jumpInstruction(w, "OP_LOOP", -1, chunk, offset)
+	case OP_CALL:
+		return byteInstruction(w, "OP_CALL", chunk, offset)
+	case OP_INVOKE:
+		return invokeInstruction(w, "OP_INVOKE", chunk, offset)
+	case OP_SUPER_INVOKE:
+		return invokeInstruction(w, "OP_SUPER_INVOKE", chunk, offset)
+	case OP_CLOSURE:
+		return closureInstruction(w, "OP_CLOSURE", chunk, offset)
+	case OP_CLOSE_UPVALUE:
+		return simpleInstruction(w, "OP_CLOSE_UPVALUE", offset)
 	case OP_RETURN:
-		return simpleInstruction("OP_RETURN", offset)
+		return simpleInstruction(w, "OP_RETURN", offset)
+	case OP_CLASS:
+		return constantInstruction(w, "OP_CLASS", chunk, offset)
+	case OP_INHERIT:
+		return simpleInstruction(w, "OP_INHERIT", offset)
+	case OP_METHOD:
+		return constantInstruction(w, "OP_METHOD", chunk, offset)
+	case OP_GET_GLOBAL_LONG:
+		return constantInstruction(w, "OP_GET_GLOBAL_LONG", chunk, offset)
+	case OP_DEFINE_GLOBAL_LONG:
+		return constantInstruction(w, "OP_DEFINE_GLOBAL_LONG", chunk, offset)
+	case OP_SET_GLOBAL_LONG:
+		return constantInstruction(w, "OP_SET_GLOBAL_LONG", chunk, offset)
+	case OP_GET_PROPERTY_LONG:
+		return constantInstruction(w, "OP_GET_PROPERTY_LONG", chunk, offset)
+	case OP_SET_PROPERTY_LONG:
+		return constantInstruction(w, "OP_SET_PROPERTY_LONG", chunk, offset)
+	case OP_GET_SUPER_LONG:
+		return constantInstruction(w, "OP_GET_SUPER_LONG", chunk, offset)
+	case OP_INVOKE_LONG:
+		return invokeInstruction(w, "OP_INVOKE_LONG", chunk, offset)
+	case OP_SUPER_INVOKE_LONG:
+		return invokeInstruction(w, "OP_SUPER_INVOKE_LONG", chunk, offset)
+	case OP_CLOSURE_LONG:
+		return closureInstruction(w, "OP_CLOSURE_LONG", chunk, offset)
+	case OP_CLASS_LONG:
+		return constantInstruction(w, "OP_CLASS_LONG", chunk, offset)
+	case OP_METHOD_LONG:
+		return constantInstruction(w, "OP_METHOD_LONG", chunk, offset)
 	default:
-		fmt.Printf("Unknown opcode %d\n", instruction)
+		_, _ = fmt.Fprintf(w, "Unknown opcode %d\n", instruction)
 		return offset + 1
 	}
 }
 
-func simpleInstruction(name string, offset uint) uint {
-	fmt.Printf("%s\n", name)
+func simpleInstruction(w io.Writer, name string, offset uint) uint {
+	_, _ = fmt.Fprintf(w, "%s\n", name)
 	return offset + 1
 }
 
-func constantInstruction(name string, chunk *Chunk, offset uint) uint {
-	constant := chunk.Code[offset+1]
-	fmt.Printf("%-16s %4d '", name, constant)
-	printValue(chunk.Constants.values[constant])
-	fmt.Printf("'\n")
+func byteInstruction(w io.Writer, name string, chunk *Chunk, offset uint) uint {
+	slot := chunk.Code[offset+1]
+	_, _ = fmt.Fprintf(w, "%-16s %4d\n", name, slot)
 	return offset + 2
 }
+
+func jumpInstruction(w io.Writer, name string, sign int, chunk *Chunk, offset uint) uint {
+	jump := uint16(chunk.Code[offset+1])<<8 | uint16(chunk.Code[offset+2])
+	target := int(offset) + 3 + sign*int(jump)
+	_, _ = fmt.Fprintf(w, "%-16s %4d -> %d\n", name, offset, target)
+	return offset + 3
+}
+
+// constantOperand returns the constant index of the instruction at
+// offset, which is 24 bits for the long forms, and the offset after it
+func constantOperand(chunk *Chunk, offset uint) (uint, uint) {
+	if chunk.Code[offset].isLong() {
+		constant := uint(chunk.Code[offset+1])<<16 | uint(chunk.Code[offset+2])<<8 | uint(chunk.Code[offset+3])
+		return constant, offset + 4
+	}
+	return uint(chunk.Code[offset+1]), offset + 2
+}
+
+func invokeInstruction(w io.Writer, name string, chunk *Chunk, offset uint) uint {
+	constant, offset := constantOperand(chunk, offset)
+	argCount := chunk.Code[offset]
+	_, _ = fmt.Fprintf(w, "%-16s (%d args) %4d '", name, argCount, constant)
+	printValue(w, chunk.Constants.values[constant])
+	_, _ = fmt.Fprintf(w, "'\n")
+	return offset + 1
+}
+
+func closureInstruction(w io.Writer, name string, chunk *Chunk, offset uint) uint {
+	constant, offset := constantOperand(chunk, offset)
+	_, _ = fmt.Fprintf(w, "%-16s %4d ", name, constant)
+	printValue(w, chunk.Constants.values[constant])
+	_, _ = fmt.Fprintf(w, "\n")
+
+	// List the variables captured by the closure
+	function := valAsObj(chunk.Constants.values[constant]).data.asFunction()
+	for j := 0; j < function.upvalueCount; j++ {
+		isLocal := chunk.Code[offset]
+		index := chunk.Code[offset+1]
+		kind := "upvalue"
+		if isLocal == 1 {
+			kind = "local"
+		}
+		_, _ = fmt.Fprintf(w, "%04d      |                     %s %d\n", offset, kind, index)
+		offset += 2
+	}
+	return offset
+}
+
+func constantInstruction(w io.Writer, name string, chunk *Chunk, offset uint) uint {
+	constant, offset := constantOperand(chunk, offset)
+	_, _ = fmt.Fprintf(w, "%-16s %4d '", name, constant)
+	printValue(w, chunk.Constants.values[constant])
+	_, _ = fmt.Fprintf(w, "'\n")
+	return offset
+}
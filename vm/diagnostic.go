@@ -0,0 +1,94 @@
+package vm
+
+import "fmt"
+
+// Severity represents how serious a Diagnostic is
+type Severity byte
+
+const (
+	// SEVERITY_ERROR prevents the code from being run
+	SEVERITY_ERROR Severity = iota
+	// SEVERITY_WARNING points out likely mistakes in valid code
+	SEVERITY_WARNING
+)
+
+func (severity Severity) String() string {
+	switch severity {
+	case SEVERITY_ERROR:
+		return "Error"
+	case SEVERITY_WARNING:
+		return "Warning"
+	default:
+		return "Unknown"
+	}
+}
+
+// Position represents a location in source code
+type Position struct {
+	// Line number, starting from 1
+	Line int
+	// Column number, starting from 1
+	Column int
+	// Index of the character in the source, starting from 0
+	Offset int
+}
+
+// Diagnostic represents a problem found in source code
+type Diagnostic struct {
+	// How serious the problem is
+	Severity Severity
+	// Description of the problem
+	Message string
+	// Position of the first character of the offending token
+	Start Position
+	// Position just past the last character of the offending token
+	End Position
+	// Source text of the offending token
+	Token string
+	// Where the problem is, as shown by String
+	where string
+}
+
+// String formats the diagnostic as "[line N, column C] Error at 'x': message"
+func (diagnostic Diagnostic) String() string {
+	return fmt.Sprintf("[line %d, column %d] %s%s: %s",
+		diagnostic.Start.Line, diagnostic.Start.Column, diagnostic.Severity, diagnostic.where, diagnostic.Message)
+}
+
+// NewDiagnostic creates a diagnostic covering text, which starts at start
+func NewDiagnostic(severity Severity, start Position, text string, message string) Diagnostic {
+	// Walk the text to find where it ends, it may span lines
+	end := start
+	for _, c := range text {
+		end.Offset++
+		if c == '\n' {
+			end.Line++
+			end.Column = 1
+		} else {
+			end.Column++
+		}
+	}
+
+	return Diagnostic{
+		Severity: severity,
+		Message:  message,
+		Start:    start,
+		End:      end,
+		Token:    text,
+		where:    fmt.Sprintf(" at '%s'", text),
+	}
+}
+
+// NewTokenDiagnostic creates a diagnostic covering token, whose text is
+// lexeme, as the compiler reports it
+func NewTokenDiagnostic(severity Severity, token Token, lexeme string, message string) Diagnostic {
+	diagnostic := NewDiagnostic(severity, token.Position(), lexeme, message)
+	switch token.tokenType {
+	case TOKEN_EOF:
+		diagnostic.where = " at end"
+	case TOKEN_ERROR:
+		// The message already describes the offending text
+		diagnostic.where = ""
+	}
+	return diagnostic
+}
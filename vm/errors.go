@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CompileError is returned when source code fails to compile
+type CompileError struct {
+	// Problems found in the source, at least one of which is an error
+	Diagnostics []Diagnostic
+}
+
+func (err *CompileError) Error() string {
+	messages := make([]string, len(err.Diagnostics))
+	for i, diagnostic := range err.Diagnostics {
+		messages[i] = diagnostic.String()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// StackFrame describes a function call which was active when a runtime
+// error occurred
+type StackFrame struct {
+	// Name of the function, "script" for the top level code
+	Function string
+	// File the function was compiled from, empty if unknown
+	File string
+	// Line being executed in the function
+	Line uint
+}
+
+func (frame StackFrame) String() string {
+	name := frame.Function
+	if name != "script" {
+		name += "()"
+	}
+	if frame.File == "" {
+		return fmt.Sprintf("[line %d] in %s", frame.Line, name)
+	}
+	return fmt.Sprintf("[line %d] in %s (%s)", frame.Line, name, frame.File)
+}
+
+// RuntimeError is returned when a script fails while running
+type RuntimeError struct {
+	// Description of the failure
+	Message string
+	// Calls active at the time of the failure, innermost first
+	Frames []StackFrame
+	// Instruction which failed
+	OpCode OpCode
+	// Error returned by a native function which caused the failure, if any
+	Cause error
+}
+
+// Error formats the message followed by the stack trace, one frame per line
+func (err *RuntimeError) Error() string {
+	var builder strings.Builder
+	builder.WriteString(err.Message)
+	for _, frame := range err.Frames {
+		builder.WriteString("\n")
+		builder.WriteString(frame.String())
+	}
+	return builder.String()
+}
+
+func (err *RuntimeError) Unwrap() error {
+	return err.Cause
+}
+
+// InstructionLimitError is the cause of the RuntimeError raised when a
+// script runs more instructions than allowed by WithMaxInstructions
+type InstructionLimitError struct {
+	// Number of instructions the script was allowed to run
+	Limit uint64
+}
+
+func (err *InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit of %d exceeded", err.Limit)
+}
+
+// StackDepthError is the cause of the RuntimeError raised when calls are
+// nested deeper than allowed by WithMaxStackDepth or FRAMES_MAX
+type StackDepthError struct {
+	// Number of calls which may be active at once
+	Limit int
+}
+
+func (err *StackDepthError) Error() string {
+	return fmt.Sprintf("stack depth limit of %d exceeded", err.Limit)
+}
+
+// HeapLimitError is the cause of the RuntimeError raised when the objects
+// a script keeps alive use more memory than allowed by WithMaxHeapBytes
+type HeapLimitError struct {
+	// Number of bytes the heap may use
+	Limit uint
+	// Estimated number of bytes in use when the limit was exceeded
+	Allocated uint
+}
+
+func (err *HeapLimitError) Error() string {
+	return fmt.Sprintf("heap limit of %d bytes exceeded, %d bytes in use", err.Limit, err.Allocated)
+}
+
+// VerifyError is returned when a chunk fails verification
+type VerifyError struct {
+	// Name of the function containing the problem, "script" for the top level code
+	Function string
+	// Offset of the offending instruction in the function's code
+	Offset uint
+	// Offending instruction
+	OpCode OpCode
+	// Description of the problem
+	Message string
+}
+
+func (err *VerifyError) Error() string {
+	return fmt.Sprintf("%s: %s at offset %d in %s: %s", ErrInvalidBytecode, err.OpCode, err.Offset, err.Function, err.Message)
+}
+
+// Unwrap lets errors.Is match the error against ErrInvalidBytecode
+func (err *VerifyError) Unwrap() error {
+	return ErrInvalidBytecode
+}
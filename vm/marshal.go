@@ -0,0 +1,299 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// region Lox to Go
+
+// ToGo converts a lox value to its natural Go representation: nil, bool,
+// float64 and string for the primitive types, []any for the lists created
+// by FromGo and map[string]any holding the fields of any other instance.
+// Functions, classes and other objects are returned unchanged as a Value.
+func ToGo(value Value) any {
+	return toGo(value, make(map[*InstanceObj]any))
+}
+
+// toGo converts value, reusing the result for instances which have
+// already been seen so that cyclic references don't recurse forever
+func toGo(value Value, seen map[*InstanceObj]any) any {
+	switch value.Type() {
+	case VAL_NIL:
+		return nil
+	case VAL_BOOL:
+		return valAsBool(value)
+	case VAL_NUMBER:
+		return valAsNumber(value)
+	}
+
+	obj := valAsObj(value)
+	switch obj.typeof {
+	case STRING_TYPE:
+		return *obj.data.asString()
+	case INSTANCE_TYPE:
+		instance := obj.data.asInstance()
+		if converted, ok := seen[instance]; ok {
+			return converted
+		}
+		if instance.class.isList {
+			return listToGo(instance, seen)
+		}
+
+		fields := make(map[string]any, len(instance.fields))
+		seen[instance] = fields
+		for name, field := range instance.fields {
+			fields[name] = toGo(field, seen)
+		}
+		return fields
+	default:
+		return value
+	}
+}
+
+// listToGo converts a list created by FromGo. Scripts can assign its
+// length, so a length which isn't a whole number of elements is taken as
+// 0, and it is capped at the number of elements the list has.
+func listToGo(instance *InstanceObj, seen map[*InstanceObj]any) any {
+	length := 0.0
+	if field, ok := instance.fields["length"]; ok && isNumber(field) {
+		length = valAsNumber(field)
+	}
+	if !(length >= 0) || length != math.Trunc(length) {
+		length = 0
+	}
+	elementCount := 0
+	for name := range instance.fields {
+		if index, err := strconv.Atoi(name); err == nil && index >= 0 {
+			elementCount++
+		}
+	}
+	length = math.Min(length, float64(elementCount))
+
+	elements := make([]any, int(length))
+	seen[instance] = elements
+	for i := range elements {
+		if element, ok := instance.fields[strconv.Itoa(i)]; ok {
+			elements[i] = toGo(element, seen)
+		}
+	}
+	return elements
+}
+
+// endregion Lox to Go
+
+// region Go to Lox
+
+// seenKey identifies a Go value which may be referenced more than once
+type seenKey struct {
+	address uintptr
+	typeof  reflect.Type
+	// Length of a slice, since slices of different lengths can share an address
+	length int
+}
+
+// FromGo converts a Go value to a lox value owned by machine. Booleans,
+// numbers, strings and nil map to the matching lox types, and pointers
+// and interfaces are followed. Structs become instances of a class named
+// after their type, with a field for each exported field; the field name
+// can be changed with a `lox:"name"` tag or the field skipped with
+// `lox:"-"`. Maps with string keys become instances of a class named Map
+// with a field for each entry. Slices and arrays become instances of a
+// class named List, with the elements in fields named by their index, a
+// length field and a get(index) method. A Value is returned unchanged.
+//
+// The result isn't a garbage collection root, so keep it reachable from
+// lox, for example with SetGlobal, before compiling or running more code.
+func (machine *VM) FromGo(value any) (Value, error) {
+	return machine.fromGo(reflect.ValueOf(value), make(map[seenKey]Value))
+}
+
+func (machine *VM) fromGo(value reflect.Value, seen map[seenKey]Value) (Value, error) {
+	if !value.IsValid() {
+		return nilToVal(), nil
+	}
+	if value.Type() == reflect.TypeOf(Value{}) {
+		return value.Interface().(Value), nil
+	}
+
+	switch value.Kind() {
+	case reflect.Bool:
+		return boolToVal(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return numberToVal(float64(value.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return numberToVal(float64(value.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return numberToVal(value.Float()), nil
+	case reflect.String:
+		return objToVal(machine.copyString(value.String())), nil
+	case reflect.Interface, reflect.Pointer:
+		if value.IsNil() {
+			return nilToVal(), nil
+		}
+		return machine.fromGo(value.Elem(), seen)
+	case reflect.Slice:
+		if value.IsNil() {
+			return nilToVal(), nil
+		}
+		return machine.listFromGo(value, seen)
+	case reflect.Array:
+		return machine.listFromGo(value, seen)
+	case reflect.Map:
+		if value.IsNil() {
+			return nilToVal(), nil
+		}
+		return machine.mapFromGo(value, seen)
+	case reflect.Struct:
+		return machine.structFromGo(value, seen)
+	default:
+		return nilToVal(), fmt.Errorf("cannot convert %s to a lox value", value.Type())
+	}
+}
+
+func (machine *VM) listFromGo(value reflect.Value, seen map[seenKey]Value) (Value, error) {
+	// Slices, and arrays which are addressable, can be referenced more than once
+	var key seenKey
+	shared := true
+	switch {
+	case value.Kind() == reflect.Slice:
+		key = seenKey{address: value.Pointer(), typeof: value.Type(), length: value.Len()}
+	case value.CanAddr():
+		key = seenKey{address: value.UnsafeAddr(), typeof: value.Type()}
+	default:
+		shared = false
+	}
+	if converted, ok := seen[key]; shared && ok {
+		return converted, nil
+	}
+
+	instance, err := machine.newHostInstance(value.Type(), "List")
+	if err != nil {
+		return nilToVal(), err
+	}
+	defer machine.popValue()
+	if shared {
+		seen[key] = objToVal(instance)
+	}
+
+	instance.class.isList = true
+	length := value.Len()
+	instance.fields["length"] = numberToVal(float64(length))
+	instance.fields["get"] = objToVal(machine.newNative("get", 1, func(args []Value) (Value, error) {
+		index, ok := args[0].AsNumber()
+		if !ok || index != math.Trunc(index) {
+			return nilToVal(), errors.New("List index must be an integer.")
+		}
+		element, ok := instance.fields[strconv.Itoa(int(index))]
+		if !ok || index < 0 {
+			return nilToVal(), errors.New("List index out of range.")
+		}
+		return element, nil
+	}))
+
+	for i := 0; i < length; i++ {
+		element, err := machine.fromGo(value.Index(i), seen)
+		if err != nil {
+			return nilToVal(), err
+		}
+		instance.fields[strconv.Itoa(i)] = element
+	}
+	return objToVal(instance), nil
+}
+
+func (machine *VM) mapFromGo(value reflect.Value, seen map[seenKey]Value) (Value, error) {
+	if value.Type().Key().Kind() != reflect.String {
+		return nilToVal(), fmt.Errorf("cannot convert %s to a lox value, keys must be strings", value.Type())
+	}
+
+	key := seenKey{address: value.Pointer(), typeof: value.Type()}
+	if converted, ok := seen[key]; ok {
+		return converted, nil
+	}
+
+	instance, err := machine.newHostInstance(value.Type(), "Map")
+	if err != nil {
+		return nilToVal(), err
+	}
+	defer machine.popValue()
+	seen[key] = objToVal(instance)
+
+	iter := value.MapRange()
+	for iter.Next() {
+		entry, err := machine.fromGo(iter.Value(), seen)
+		if err != nil {
+			return nilToVal(), err
+		}
+		instance.fields[iter.Key().String()] = entry
+	}
+	return objToVal(instance), nil
+}
+
+func (machine *VM) structFromGo(value reflect.Value, seen map[seenKey]Value) (Value, error) {
+	// Only addressable structs can be referenced more than once
+	var key seenKey
+	if value.CanAddr() {
+		key = seenKey{address: value.UnsafeAddr(), typeof: value.Type()}
+		if converted, ok := seen[key]; ok {
+			return converted, nil
+		}
+	}
+
+	name := value.Type().Name()
+	if name == "" {
+		name = "Object"
+	}
+	instance, err := machine.newHostInstance(value.Type(), name)
+	if err != nil {
+		return nilToVal(), err
+	}
+	defer machine.popValue()
+	if value.CanAddr() {
+		seen[key] = objToVal(instance)
+	}
+
+	structType := value.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldName := field.Name
+		if tag := field.Tag.Get("lox"); tag == "-" {
+			continue
+		} else if tag != "" {
+			fieldName = tag
+		}
+
+		fieldValue, err := machine.fromGo(value.Field(i), seen)
+		if err != nil {
+			return nilToVal(), err
+		}
+		instance.fields[fieldName] = fieldValue
+	}
+	return objToVal(instance), nil
+}
+
+// newHostInstance creates an instance of the class for goType and pushes
+// it on the stack, so the garbage collector can't free it while its
+// fields are converted. The caller must pop it once it is done.
+func (machine *VM) newHostInstance(goType reflect.Type, className string) (*InstanceObj, error) {
+	if machine.stackTop >= STACK_MAX {
+		return nil, fmt.Errorf("cannot convert %s to a lox value, it is nested too deeply", goType)
+	}
+
+	class, ok := machine.hostClasses[goType]
+	if !ok {
+		class = machine.newClass(&className)
+		machine.hostClasses[goType] = class
+	}
+
+	instance := machine.newInstance(class)
+	machine.pushValue(objToVal(instance))
+	return instance, nil
+}
+
+// endregion Go to Lox
@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+// scriptValue stores value in the global v, runs source and returns the
+// global v afterwards
+func scriptValue(t *testing.T, machine *VM, value any, source string) Value {
+	t.Helper()
+	converted, err := machine.FromGo(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.SetGlobal("v", converted)
+	if _, err := machine.Interpret(source); err != nil {
+		t.Fatal(err)
+	}
+	result, _ := machine.GetGlobal("v")
+	return result
+}
+
+func TestGoRoundTrip(t *testing.T) {
+	type point struct {
+		X, Y   float64
+		Label  string `lox:"name"`
+		Hidden bool   `lox:"-"`
+	}
+	tests := []struct {
+		name  string
+		value any
+		want  any
+	}{
+		{"nil", nil, nil},
+		{"bool", true, true},
+		{"int", 3, 3.0},
+		{"string", "lox", "lox"},
+		{"slice", []int{1, 2}, []any{1.0, 2.0}},
+		{"array", [2]string{"a", "b"}, []any{"a", "b"}},
+		{"map", map[string]bool{"a": true}, map[string]any{"a": true}},
+		{"struct", point{X: 1, Y: 2, Label: "p", Hidden: true}, map[string]any{"X": 1.0, "Y": 2.0, "name": "p"}},
+	}
+
+	machine := InitVM(WithStdout(io.Discard))
+	defer machine.FreeVM()
+	for _, test := range tests {
+		value, err := machine.FromGo(test.value)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := ToGo(value); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: converted back to %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestListLengthSetByScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		length string
+		want   []any
+	}{
+		{"shorter", "1", []any{1.0}},
+		{"negative", "-1", []any{}},
+		{"NaN", "0 / 0", []any{}},
+		{"fraction", "1.5", []any{}},
+		{"huge", "1000000000000", []any{1.0, 2.0}},
+		{"longer", "3", []any{1.0, 2.0}},
+		{"not a number", `"2"`, []any{}},
+	}
+
+	machine := InitVM(WithStdout(io.Discard))
+	defer machine.FreeVM()
+	for _, test := range tests {
+		list := scriptValue(t, &machine, []int{1, 2}, "v.length = "+test.length+";")
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					t.Errorf("%s: ToGo panicked: %v", test.name, recovered)
+				}
+			}()
+			if got := ToGo(list); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: converted to %#v, want %#v", test.name, got, test.want)
+			}
+		}()
+	}
+}
+
+func TestFromGoCycles(t *testing.T) {
+	machine := InitVM(WithStdout(io.Discard))
+	defer machine.FreeVM()
+
+	list := make([]any, 2)
+	list[0] = "head"
+	list[1] = list
+	value, err := machine.FromGo(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted := ToGo(value).([]any)
+	if inner, ok := converted[1].([]any); !ok || len(inner) != 2 || &inner[0] != &converted[0] {
+		t.Errorf("self-referencing slice converted to %#v", converted)
+	}
+
+	type node struct{ Next *node }
+	cycle := &node{}
+	cycle.Next = cycle
+	if _, err := machine.FromGo(cycle); err != nil {
+		t.Errorf("self-referencing struct: %v", err)
+	}
+
+	// Slices sharing an array aren't the same list
+	shared := []int{1, 2, 3}
+	value, err = machine.FromGo([][]int{shared, shared[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{[]any{1.0, 2.0, 3.0}, []any{1.0}}
+	if got := ToGo(value); !reflect.DeepEqual(got, want) {
+		t.Errorf("slices of one array converted to %#v, want %#v", got, want)
+	}
+}
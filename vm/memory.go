@@ -0,0 +1,248 @@
+package vm
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Factor the heap is allowed to grow by before the next collection
+const GC_HEAP_GROW_FACTOR uint = 2
+
+// Number of bytes allocated before the first collection
+const GC_INITIAL_THRESHOLD uint = 1024 * 1024
+
+// allocateObject wraps data in a new Obj and adds it to the object list,
+// collecting garbage first if the heap has grown past its threshold
+func (machine *VM) allocateObject(data ObjData) *Obj {
+	size := objectSize(data)
+	machine.bytesAllocated += size
+	overLimit := machine.maxHeapBytes > 0 && machine.bytesAllocated > machine.maxHeapBytes
+	if DEBUG_STRESS_GC || machine.bytesAllocated > machine.nextGC || overLimit {
+		machine.collectGarbage()
+	}
+	// The allocation can't fail, so the run loop raises the error before
+	// the next instruction
+	if machine.maxHeapBytes > 0 && machine.bytesAllocated > machine.maxHeapBytes {
+		machine.heapExceeded = true
+		machine.nextLimitCheck = 0
+	}
+
+	obj := dataToObj(data)
+	obj.size = size
+	obj.next = machine.objects
+	machine.objects = obj
+
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "%p allocate %d for %d\n", obj, size, obj.typeof)
+	}
+	return obj
+}
+
+// objectSize estimates the number of bytes used by an object
+func objectSize(data ObjData) uint {
+	size := uint(unsafe.Sizeof(Obj{}))
+	switch data := data.(type) {
+	case *StringObj:
+		size += uint(unsafe.Sizeof(*data)) + uint(len(*data.value))
+	case *FunctionObj:
+		size += uint(unsafe.Sizeof(*data))
+	case *ClosureObj:
+		size += uint(unsafe.Sizeof(*data)) + uint(len(data.upvalues))*uint(unsafe.Sizeof(data))
+	case *UpvalueObj:
+		size += uint(unsafe.Sizeof(*data))
+	case *ClassObj:
+		size += uint(unsafe.Sizeof(*data))
+	case *InstanceObj:
+		size += uint(unsafe.Sizeof(*data))
+	case *BoundMethodObj:
+		size += uint(unsafe.Sizeof(*data))
+	case *NativeObj:
+		size += uint(unsafe.Sizeof(*data)) + uint(len(data.name))
+	}
+	return size
+}
+
+func (machine *VM) freeObject(obj *Obj) {
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "%p free type %d\n", obj, obj.typeof)
+	}
+
+	machine.bytesAllocated -= obj.size
+	// Drop the references held by the object, the go runtime
+	// reclaims the memory once nothing points to it
+	obj.data = nil
+	obj.next = nil
+}
+
+// collectGarbage runs a full mark and sweep collection
+func (machine *VM) collectGarbage() {
+	var before uint
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "-- gc begin\n")
+		before = machine.bytesAllocated
+	}
+
+	machine.markRoots()
+	machine.traceReferences()
+	machine.tableRemoveWhite()
+	machine.sweep()
+
+	machine.nextGC = machine.bytesAllocated * GC_HEAP_GROW_FACTOR
+	if machine.nextGC < GC_INITIAL_THRESHOLD {
+		machine.nextGC = GC_INITIAL_THRESHOLD
+	}
+
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "-- gc end\n")
+		_, _ = fmt.Fprintf(machine.stdout, "   collected %d bytes (from %d to %d) next at %d\n",
+			before-machine.bytesAllocated, before, machine.bytesAllocated, machine.nextGC)
+	}
+}
+
+// region Marking
+
+func (machine *VM) markRoots() {
+	for slot := uint(0); slot < machine.stackTop; slot++ {
+		machine.markValue(machine.stack[slot])
+	}
+
+	for i := 0; i < machine.frameCount; i++ {
+		machine.markObject(machine.frames[i].closure.header())
+	}
+
+	for upvalue := machine.openUpvalues; upvalue != nil; upvalue = upvalue.next {
+		machine.markObject(upvalue.header())
+	}
+
+	for _, value := range machine.globals {
+		machine.markValue(value)
+	}
+
+	for _, class := range machine.hostClasses {
+		machine.markObject(class.header())
+	}
+
+	machine.markCompilerRoots()
+}
+
+// markCompilerRoots marks the functions which are still being compiled
+func (machine *VM) markCompilerRoots() {
+	for compiler := machine.compiler; compiler != nil; compiler = compiler.enclosing {
+		// The function is nil while it is being allocated
+		if compiler.function != nil {
+			machine.markObject(compiler.function.header())
+		}
+	}
+}
+
+func (machine *VM) markValue(value Value) {
+	if isObj(value) {
+		machine.markObject(valAsObj(value))
+	}
+}
+
+func (machine *VM) markObject(obj *Obj) {
+	if obj == nil || obj.isMarked {
+		return
+	}
+
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "%p mark ", obj)
+		printValue(machine.stdout, objToVal(obj.data))
+		_, _ = fmt.Fprintf(machine.stdout, "\n")
+	}
+
+	obj.isMarked = true
+	machine.grayStack = append(machine.grayStack, obj)
+}
+
+// traceReferences blackens gray objects until none are left
+func (machine *VM) traceReferences() {
+	for len(machine.grayStack) > 0 {
+		obj := machine.grayStack[len(machine.grayStack)-1]
+		machine.grayStack = machine.grayStack[:len(machine.grayStack)-1]
+		machine.blackenObject(obj)
+	}
+}
+
+// blackenObject marks every object referenced by obj
+func (machine *VM) blackenObject(obj *Obj) {
+	if DEBUG_LOG_GC {
+		_, _ = fmt.Fprintf(machine.stdout, "%p blacken ", obj)
+		printValue(machine.stdout, objToVal(obj.data))
+		_, _ = fmt.Fprintf(machine.stdout, "\n")
+	}
+
+	switch obj.typeof {
+	case BOUND_METHOD_TYPE:
+		bound := obj.data.asBoundMethod()
+		machine.markValue(bound.receiver)
+		machine.markObject(bound.method.header())
+	case CLASS_TYPE:
+		for _, method := range obj.data.asClass().methods {
+			machine.markValue(method)
+		}
+	case CLOSURE_TYPE:
+		closure := obj.data.asClosure()
+		machine.markObject(closure.function.header())
+		for _, upvalue := range closure.upvalues {
+			if upvalue != nil {
+				machine.markObject(upvalue.header())
+			}
+		}
+	case FUNCTION_TYPE:
+		function := obj.data.asFunction()
+		for _, constant := range function.chunk.Constants.values {
+			machine.markValue(constant)
+		}
+	case INSTANCE_TYPE:
+		instance := obj.data.asInstance()
+		machine.markObject(instance.class.header())
+		for _, value := range instance.fields {
+			machine.markValue(value)
+		}
+	case UPVALUE_TYPE:
+		machine.markValue(obj.data.asUpvalue().closed)
+	case NATIVE_TYPE, STRING_TYPE:
+		// Natives and strings don't reference other objects
+	}
+}
+
+// endregion Marking
+
+// region Sweeping
+
+// tableRemoveWhite drops unmarked strings from the intern table, so the
+// table doesn't keep otherwise unreachable strings alive
+func (machine *VM) tableRemoveWhite() {
+	for chars, str := range machine.strings {
+		if !str.header().isMarked {
+			delete(machine.strings, chars)
+		}
+	}
+}
+
+// sweep frees every unmarked object and clears the marks of the rest
+func (machine *VM) sweep() {
+	var previous *Obj
+	object := machine.objects
+	for object != nil {
+		if object.isMarked {
+			object.isMarked = false
+			previous = object
+			object = object.next
+		} else {
+			unreached := object
+			object = object.next
+			if previous != nil {
+				previous.next = object
+			} else {
+				machine.objects = object
+			}
+
+			machine.freeObject(unreached)
+		}
+	}
+}
+
+// endregion Sweeping
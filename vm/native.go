@@ -0,0 +1,69 @@
+package vm
+
+import (
+	"io"
+	"strings"
+	"time"
+)
+
+// Time the program started, used by the clock native
+var startTime = time.Now()
+
+// DefineNative exposes fn to scripts as a global function called name.
+// arity is the number of arguments fn expects, or -1 to accept any number.
+// An error returned by fn stops the script with a runtime error.
+func (machine *VM) DefineNative(name string, arity int, fn NativeFn) {
+	machine.globals[name] = objToVal(machine.newNative(name, arity, fn))
+}
+
+// defineBuiltin exposes a native provided by the VM as a global function
+func (machine *VM) defineBuiltin(name string, arity int, fn builtinFn) {
+	native := machine.newNative(name, arity, nil)
+	native.builtin = fn
+	machine.globals[name] = objToVal(native)
+}
+
+func (machine *VM) callNative(native *NativeObj, argCount int) bool {
+	if native.arity >= 0 && argCount != native.arity {
+		machine.runtimeError("Expected %d arguments but got %d.", native.arity, argCount)
+		return false
+	}
+
+	args := machine.stack[machine.stackTop-uint(argCount) : machine.stackTop]
+	var result Value
+	var err error
+	if native.builtin != nil {
+		result, err = native.builtin(machine, args)
+	} else {
+		result, err = native.function(args)
+	}
+	if err != nil {
+		machine.runtimeError("%s", err)
+		machine.runtimeErr.Cause = err
+		return false
+	}
+
+	// Replace the native and its arguments with the result
+	machine.stackTop -= uint(argCount) + 1
+	machine.pushValue(result)
+	return true
+}
+
+// clockNative returns the number of seconds since the program started
+func clockNative(args []Value) (Value, error) {
+	return numberToVal(time.Since(startTime).Seconds()), nil
+}
+
+// readLineNative reads the next line from the VM's input, without the line
+// ending. It returns nil once the input is exhausted.
+func readLineNative(machine *VM, args []Value) (Value, error) {
+	line, err := machine.stdin.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return nilToVal(), nil
+	}
+	if err != nil && err != io.EOF {
+		return nilToVal(), err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	return objToVal(machine.copyString(line)), nil
+}
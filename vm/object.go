@@ -1,18 +1,84 @@
 package vm
 
+import "fmt"
+
 type ObjType byte
 
 const (
 	STRING_TYPE ObjType = iota
+	FUNCTION_TYPE
+	CLOSURE_TYPE
+	UPVALUE_TYPE
+	CLASS_TYPE
+	INSTANCE_TYPE
+	BOUND_METHOD_TYPE
+	NATIVE_TYPE
 )
 
 // ObjData represents the data associated with an Obj
 type ObjData interface {
+	header() *Obj
+	setHeader(obj *Obj)
 	asString() *string
+	asFunction() *FunctionObj
+	asClosure() *ClosureObj
+	asUpvalue() *UpvalueObj
+	asClass() *ClassObj
+	asInstance() *InstanceObj
+	asBoundMethod() *BoundMethodObj
+	asNative() *NativeObj
+}
+
+// objDataBase links object data back to its Obj header and provides
+// panicking defaults for the ObjData accessors, so each kind of object
+// only needs to implement the accessor for itself
+type objDataBase struct {
+	obj *Obj
+}
+
+func (b *objDataBase) header() *Obj {
+	return b.obj
+}
+
+func (b *objDataBase) setHeader(obj *Obj) {
+	b.obj = obj
+}
+
+func (objDataBase) asString() *string {
+	panic("Can't coerce object to string")
+}
+
+func (objDataBase) asFunction() *FunctionObj {
+	panic("Can't coerce object to function")
+}
+
+func (objDataBase) asClosure() *ClosureObj {
+	panic("Can't coerce object to closure")
+}
+
+func (objDataBase) asUpvalue() *UpvalueObj {
+	panic("Can't coerce object to upvalue")
+}
+
+func (objDataBase) asClass() *ClassObj {
+	panic("Can't coerce object to class")
+}
+
+func (objDataBase) asInstance() *InstanceObj {
+	panic("Can't coerce object to instance")
+}
+
+func (objDataBase) asBoundMethod() *BoundMethodObj {
+	panic("Can't coerce object to bound method")
+}
+
+func (objDataBase) asNative() *NativeObj {
+	panic("Can't coerce object to native function")
 }
 
 // region string
 type StringObj struct {
+	objDataBase
 	value *string
 }
 
@@ -20,34 +86,281 @@ func (s *StringObj) asString() *string {
 	return s.value
 }
 
+// copyString returns the interned string object for chars, allocating
+// it if it doesn't exist yet
+func (machine *VM) copyString(chars string) *StringObj {
+	if interned, ok := machine.strings[chars]; ok {
+		return interned
+	}
+
+	str := &StringObj{value: &chars}
+	machine.allocateObject(str)
+	machine.strings[chars] = str
+	return str
+}
+
 // endregion string
 
+// region function
+
+// FunctionObj represents a compiled lox function
+type FunctionObj struct {
+	objDataBase
+	// Number of parameters the function expects
+	arity int
+	// Number of variables the function captures from enclosing scopes
+	upvalueCount int
+	// Most stack slots the function's frame uses, including the callee and arguments
+	maxSlots int
+	// Bytecode of the function body
+	chunk Chunk
+	// Name of the function, nil for the top level script
+	name *string
+	// File the function was compiled from, empty if unknown
+	file string
+}
+
+func (machine *VM) newFunction() *FunctionObj {
+	function := &FunctionObj{chunk: InitChunk()}
+	machine.allocateObject(function)
+	return function
+}
+
+// Chunk returns the bytecode of the function
+func (f *FunctionObj) Chunk() *Chunk {
+	return &f.chunk
+}
+
+func (f *FunctionObj) asFunction() *FunctionObj {
+	return f
+}
+
+func formatFunction(function *FunctionObj) string {
+	if function.name == nil {
+		return "<script>"
+	}
+	return fmt.Sprintf("<fn %s>", *function.name)
+}
+
+// endregion function
+
+// region closure
+
+// ClosureObj represents a function together with the variables it captured
+type ClosureObj struct {
+	objDataBase
+	// Function wrapped by the closure
+	function *FunctionObj
+	// Captured variables, one for each upvalue of the function
+	upvalues []*UpvalueObj
+}
+
+func (machine *VM) newClosure(function *FunctionObj) *ClosureObj {
+	closure := &ClosureObj{
+		function: function,
+		upvalues: make([]*UpvalueObj, function.upvalueCount),
+	}
+	machine.allocateObject(closure)
+	return closure
+}
+
+func (c *ClosureObj) asClosure() *ClosureObj {
+	return c
+}
+
+// endregion closure
+
+// region upvalue
+
+// UpvalueObj represents a variable captured by a closure
+type UpvalueObj struct {
+	objDataBase
+	// Location of the captured variable, either on the stack or in closed
+	location *Value
+	// Stack slot of the variable while the upvalue is open
+	slot uint
+	// Holds the variable once it has left the stack
+	closed Value
+	// Next open upvalue, ordered by decreasing stack slot
+	next *UpvalueObj
+}
+
+func (machine *VM) newUpvalue(location *Value, slot uint) *UpvalueObj {
+	upvalue := &UpvalueObj{location: location, slot: slot, closed: nilToVal()}
+	machine.allocateObject(upvalue)
+	return upvalue
+}
+
+func (u *UpvalueObj) asUpvalue() *UpvalueObj {
+	return u
+}
+
+// endregion upvalue
+
+// region class
+
+// ClassObj represents a lox class
+type ClassObj struct {
+	objDataBase
+	// Name of the class
+	name *string
+	// Methods of the class, keyed by name
+	methods map[string]Value
+	// Whether instances hold the elements of a Go slice, see FromGo
+	isList bool
+}
+
+func (machine *VM) newClass(name *string) *ClassObj {
+	class := &ClassObj{name: name, methods: make(map[string]Value)}
+	machine.allocateObject(class)
+	return class
+}
+
+func (c *ClassObj) asClass() *ClassObj {
+	return c
+}
+
+// endregion class
+
+// region instance
+
+// InstanceObj represents an instance of a lox class
+type InstanceObj struct {
+	objDataBase
+	// Class the instance was created from
+	class *ClassObj
+	// Fields of the instance, keyed by name
+	fields map[string]Value
+}
+
+func (machine *VM) newInstance(class *ClassObj) *InstanceObj {
+	instance := &InstanceObj{class: class, fields: make(map[string]Value)}
+	machine.allocateObject(instance)
+	return instance
+}
+
+func (i *InstanceObj) asInstance() *InstanceObj {
+	return i
+}
+
+// endregion instance
+
+// region bound method
+
+// BoundMethodObj represents a method together with the instance it was accessed from
+type BoundMethodObj struct {
+	objDataBase
+	// Instance bound to this in the method
+	receiver Value
+	// Method being bound
+	method *ClosureObj
+}
+
+func (machine *VM) newBoundMethod(receiver Value, method *ClosureObj) *BoundMethodObj {
+	bound := &BoundMethodObj{receiver: receiver, method: method}
+	machine.allocateObject(bound)
+	return bound
+}
+
+func (b *BoundMethodObj) asBoundMethod() *BoundMethodObj {
+	return b
+}
+
+// endregion bound method
+
+// region native
+
+// NativeFn is a Go function which can be called from lox. The args slice
+// refers to the VM's stack, so it is only valid until the function returns.
+type NativeFn func(args []Value) (Value, error)
+
+// builtinFn is a native function provided by the VM itself, which is
+// given the machine running it
+type builtinFn func(machine *VM, args []Value) (Value, error)
+
+// NativeObj represents a Go function exposed to lox
+type NativeObj struct {
+	objDataBase
+	// Name the function was defined with
+	name string
+	// Number of arguments the function expects, -1 for any number
+	arity int
+	// Go function to call
+	function NativeFn
+	// Called instead of function for natives provided by the VM
+	builtin builtinFn
+}
+
+func (machine *VM) newNative(name string, arity int, function NativeFn) *NativeObj {
+	native := &NativeObj{name: name, arity: arity, function: function}
+	machine.allocateObject(native)
+	return native
+}
+
+func (n *NativeObj) asNative() *NativeObj {
+	return n
+}
+
+// endregion native
+
 // Obj represents an object in lox, such as a string, function, etc.
 type Obj struct {
 	// Type of the Object
 	typeof ObjType
+	// Whether the garbage collector has reached the Object
+	isMarked bool
+	// Estimated number of bytes used by the Object
+	size uint
 	// Data associated with the Object
 	data ObjData
 	// The next object in the object list
 	next *Obj
 }
 
-func dataToObj(data interface{}) *Obj {
+// dataToObj wraps data in a new Obj header
+func dataToObj(data ObjData) *Obj {
 	var newObj Obj
 	switch data.(type) {
-	case *string:
-		newObj = Obj{
-			typeof: STRING_TYPE,
-			data: &StringObj{
-				value: data.(*string),
-			},
-		}
+	case *StringObj:
+		newObj = Obj{typeof: STRING_TYPE}
+	case *FunctionObj:
+		newObj = Obj{typeof: FUNCTION_TYPE}
+	case *ClosureObj:
+		newObj = Obj{typeof: CLOSURE_TYPE}
+	case *UpvalueObj:
+		newObj = Obj{typeof: UPVALUE_TYPE}
+	case *ClassObj:
+		newObj = Obj{typeof: CLASS_TYPE}
+	case *InstanceObj:
+		newObj = Obj{typeof: INSTANCE_TYPE}
+	case *BoundMethodObj:
+		newObj = Obj{typeof: BOUND_METHOD_TYPE}
+	case *NativeObj:
+		newObj = Obj{typeof: NATIVE_TYPE}
 	default:
 		panic("Unable to create object from data")
 	}
+	newObj.data = data
+	data.setHeader(&newObj)
 	return &newObj
 }
 
 func isString(obj *Obj) bool {
 	return obj.typeof == STRING_TYPE
 }
+
+func isFunction(obj *Obj) bool {
+	return obj.typeof == FUNCTION_TYPE
+}
+
+func isClosure(obj *Obj) bool {
+	return obj.typeof == CLOSURE_TYPE
+}
+
+func isClass(obj *Obj) bool {
+	return obj.typeof == CLASS_TYPE
+}
+
+func isInstance(obj *Obj) bool {
+	return obj.typeof == INSTANCE_TYPE
+}
@@ -0,0 +1,422 @@
+package vm
+
+import "math"
+
+// OptimizationLevel selects the optimizations applied to compiled code
+type OptimizationLevel int
+
+const (
+	// OPTIMIZE_NONE runs the code exactly as the compiler emits it
+	OPTIMIZE_NONE OptimizationLevel = iota
+	// OPTIMIZE_PEEPHOLE folds constant expressions and replaces short runs
+	// of instructions with cheaper ones
+	OPTIMIZE_PEEPHOLE
+)
+
+// negatedComparisons maps each comparison to the one which gives the
+// opposite result, so a comparison followed by OP_NOT can be fused
+var negatedComparisons = map[OpCode]OpCode{
+	OP_EQUAL:         OP_NOT_EQUAL,
+	OP_NOT_EQUAL:     OP_EQUAL,
+	OP_GREATER:       OP_LESS_EQUAL,
+	OP_LESS_EQUAL:    OP_GREATER,
+	OP_LESS:          OP_GREATER_EQUAL,
+	OP_GREATER_EQUAL: OP_LESS,
+}
+
+// optInstruction is a decoded instruction. Instructions naming a constant
+// keep their short form whatever the size of its index, the long form is
+// picked when the code is encoded again.
+type optInstruction struct {
+	op OpCode
+	// Index of the constant the instruction refers to, -1 if it has none
+	constant int
+	// Operands other than the constant and jump offset
+	operands []OpCode
+	// Index in the original code of the instruction a jump lands on
+	target int
+	// Indexes in the original code of the jump targets which now start
+	// at this instruction
+	labels []int
+	line   uint
+}
+
+// optimizer rewrites the code of a single function
+type optimizer struct {
+	machine  *VM
+	function *FunctionObj
+	// Instructions as they were compiled
+	original []optInstruction
+	// Instructions after optimization
+	code []optInstruction
+	// Index of each number and string in the constants
+	constants map[constantKey]int
+}
+
+// optimize runs the peephole optimizer over the code of function. Each
+// instruction is appended to the optimized code in turn, then the end of
+// the code is rewritten for as long as a rule applies. Rules never look
+// past a jump target, so every path through the code still sees the
+// instructions it did before. Unused constants are dropped and jumps and
+// lines are recomputed when the code is encoded again. Wide constants can
+// make the code longer, and if a jump no longer fits in its operand the
+// function is left as it was compiled.
+func (machine *VM) optimize(function *FunctionObj) {
+	o := optimizer{machine: machine, function: function, constants: make(map[constantKey]int)}
+	if !o.decode() {
+		return
+	}
+	for i, value := range function.chunk.Constants.values[:function.chunk.Constants.count] {
+		if key, shared := constantKeyOf(value); shared {
+			if _, ok := o.constants[key]; !ok {
+				o.constants[key] = i
+			}
+		}
+	}
+
+	compiledConstants := function.chunk.Constants.count
+	for i := range o.original {
+		o.code = append(o.code, o.original[i])
+		for o.rewrite(i) {
+		}
+	}
+	if !o.encode() {
+		// Drop the constants added by folding, which the compiled code doesn't use
+		function.chunk.Constants.count = compiledConstants
+	}
+}
+
+// region Decoding
+
+// decode splits the code into instructions, returning false if it can't
+// be decoded, in which case the verifier reports the problem
+func (o *optimizer) decode() bool {
+	chunk := &o.function.chunk
+	v := verifier{
+		function:  o.function,
+		code:      chunk.Code[:chunk.Count],
+		constants: chunk.Constants.values[:chunk.Constants.count],
+	}
+	if v.decode() != nil {
+		return false
+	}
+
+	indexes := make(map[uint]int)
+	targets := make(map[int]uint)
+	for offset := uint(0); offset < uint(len(v.code)); offset += v.lengths[offset] {
+		indexes[offset] = len(o.original)
+		instruction := optInstruction{op: v.code[offset], constant: -1, target: -1, line: chunk.Lines[offset]}
+		operands := v.code[offset+1 : offset+v.lengths[offset]]
+		switch instruction.op.shortForm() {
+		case OP_CONSTANT, OP_GET_GLOBAL, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_GET_PROPERTY,
+			OP_SET_PROPERTY, OP_GET_SUPER, OP_CLASS, OP_METHOD, OP_INVOKE, OP_SUPER_INVOKE, OP_CLOSURE:
+			width := 1
+			if instruction.op.isLong() {
+				width = 3
+			}
+			instruction.op = instruction.op.shortForm()
+			instruction.constant = 0
+			for _, operand := range operands[:width] {
+				instruction.constant = instruction.constant<<8 | int(operand)
+			}
+			instruction.operands = operands[width:]
+		case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP:
+			target, _ := v.jumpTarget(offset)
+			targets[len(o.original)] = target
+		default:
+			instruction.operands = operands
+		}
+		o.original = append(o.original, instruction)
+	}
+
+	for i, target := range targets {
+		o.original[i].target = indexes[target]
+		labeled := &o.original[indexes[target]]
+		if len(labeled.labels) == 0 {
+			labeled.labels = []int{indexes[target]}
+		}
+	}
+	return true
+}
+
+// endregion Decoding
+
+// region Rules
+
+// rewrite applies the first rule which matches the end of the code,
+// returning whether one did. index is the original index of the last
+// instruction added.
+func (o *optimizer) rewrite(index int) bool {
+	last := o.code[len(o.code)-1]
+	switch last.op {
+	case OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE, OP_EQUAL, OP_NOT_EQUAL, OP_GREATER,
+		OP_LESS, OP_GREATER_EQUAL, OP_LESS_EQUAL:
+		// Two literals and an operator become the result
+		window := o.window(3)
+		if window == nil {
+			return false
+		}
+		a, aOk := o.literal(window[0])
+		b, bOk := o.literal(window[1])
+		if !aOk || !bOk {
+			return false
+		}
+		result, ok := o.fold(last.op, a, b)
+		if !ok {
+			return false
+		}
+		return o.replaceWithLiteral(3, result)
+	case OP_NEGATE:
+		window := o.window(2)
+		if window == nil {
+			return false
+		}
+		if value, ok := o.literal(window[0]); ok && isNumber(value) {
+			return o.replaceWithLiteral(2, numberToVal(-valAsNumber(value)))
+		}
+	case OP_NOT:
+		window := o.window(2)
+		if window == nil {
+			return false
+		}
+		if value, ok := o.literal(window[0]); ok {
+			return o.replaceWithLiteral(2, boolToVal(isFalsey(value)))
+		}
+		if negated, ok := negatedComparisons[window[0].op]; ok {
+			o.replace(2, optInstruction{op: negated, constant: -1, target: -1, line: window[0].line})
+			return true
+		}
+		// The first OP_NOT already leaves a boolean, so the other two cancel out
+		if window = o.window(3); window != nil && window[0].op == OP_NOT && window[1].op == OP_NOT {
+			o.replace(3, window[0])
+			return true
+		}
+	case OP_JUMP_IF_FALSE:
+		// A pair of OP_NOTs doesn't change whether a value is falsey, so
+		// they are dead when the jump and the code after it pop the value
+		window := o.window(3)
+		if window == nil || window[0].op != OP_NOT || window[1].op != OP_NOT {
+			return false
+		}
+		if index+1 < len(o.original) && o.original[index+1].op == OP_POP &&
+			o.original[last.target].op == OP_POP {
+			o.replace(3, last)
+			return true
+		}
+	}
+	return false
+}
+
+// window returns the last count instructions of the code, or nil if there
+// aren't that many or a jump lands on any but the first of them
+func (o *optimizer) window(count int) []optInstruction {
+	if len(o.code) < count {
+		return nil
+	}
+	window := o.code[len(o.code)-count:]
+	for _, instruction := range window[1:] {
+		if len(instruction.labels) > 0 {
+			return nil
+		}
+	}
+	return window
+}
+
+// replace swaps the last count instructions for instruction, which takes
+// over the jump targets of the first of them
+func (o *optimizer) replace(count int, instruction optInstruction) {
+	instruction.labels = o.code[len(o.code)-count].labels
+	o.code = append(o.code[:len(o.code)-count], instruction)
+}
+
+// replaceWithLiteral swaps the last count instructions for an instruction
+// loading value, on the line of the first of them. It returns false if
+// the value can't be added to the constants.
+func (o *optimizer) replaceWithLiteral(count int, value Value) bool {
+	instruction := optInstruction{constant: -1, target: -1, line: o.code[len(o.code)-count].line}
+	switch {
+	case isNil(value):
+		instruction.op = OP_NIL
+	case isBool(value) && valAsBool(value):
+		instruction.op = OP_TRUE
+	case isBool(value):
+		instruction.op = OP_FALSE
+	default:
+		constant, ok := o.addConstant(value)
+		if !ok {
+			return false
+		}
+		instruction.op = OP_CONSTANT
+		instruction.constant = constant
+	}
+	o.replace(count, instruction)
+	return true
+}
+
+// literal returns the value an instruction loads, if it only loads a nil,
+// boolean, number or string
+func (o *optimizer) literal(instruction optInstruction) (Value, bool) {
+	switch instruction.op {
+	case OP_NIL:
+		return nilToVal(), true
+	case OP_TRUE:
+		return boolToVal(true), true
+	case OP_FALSE:
+		return boolToVal(false), true
+	case OP_CONSTANT:
+		value := o.function.chunk.Constants.values[instruction.constant]
+		if _, shared := constantKeyOf(value); shared {
+			return value, true
+		}
+	}
+	return nilToVal(), false
+}
+
+// fold returns the result of applying a binary operator to two literals,
+// or false if it would fail at runtime and must be left to do so
+func (o *optimizer) fold(op OpCode, a Value, b Value) (Value, bool) {
+	switch op {
+	case OP_EQUAL:
+		return boolToVal(valuesEqual(a, b)), true
+	case OP_NOT_EQUAL:
+		return boolToVal(!valuesEqual(a, b)), true
+	}
+
+	if op == OP_ADD && isObj(a) && isString(valAsObj(a)) && isObj(b) && isString(valAsObj(b)) {
+		str := *valAsObj(a).data.asString() + *valAsObj(b).data.asString()
+		return objToVal(o.machine.copyString(str)), true
+	}
+	if !isNumber(a) || !isNumber(b) {
+		return nilToVal(), false
+	}
+
+	x, y := valAsNumber(a), valAsNumber(b)
+	switch op {
+	case OP_ADD:
+		return numberToVal(x + y), true
+	case OP_SUBTRACT:
+		return numberToVal(x - y), true
+	case OP_MULTIPLY:
+		return numberToVal(x * y), true
+	case OP_DIVIDE:
+		return numberToVal(x / y), true
+	case OP_GREATER:
+		return boolToVal(x > y), true
+	case OP_LESS:
+		return boolToVal(x < y), true
+	case OP_GREATER_EQUAL:
+		return boolToVal(!(x < y)), true
+	case OP_LESS_EQUAL:
+		return boolToVal(!(x > y)), true
+	}
+	return nilToVal(), false
+}
+
+// addConstant returns the index of value in the constants, adding it if
+// it isn't there yet
+func (o *optimizer) addConstant(value Value) (int, bool) {
+	key, _ := constantKeyOf(value)
+	if constant, ok := o.constants[key]; ok {
+		return constant, true
+	}
+	if o.function.chunk.Constants.count >= uint(CONSTANTS_MAX) {
+		return 0, false
+	}
+	constant := AddConstant(&o.function.chunk, value)
+	o.constants[key] = constant
+	return constant, true
+}
+
+// endregion Rules
+
+// region Encoding
+
+// encode replaces the function's chunk with the optimized code, dropping
+// the constants it no longer uses. It returns false without changing the
+// code if a jump is too far to encode.
+func (o *optimizer) encode() bool {
+	oldConstants := o.function.chunk.Constants.values[:o.function.chunk.Constants.count]
+	used := make([]bool, len(oldConstants))
+	for _, instruction := range o.code {
+		if instruction.constant >= 0 {
+			used[instruction.constant] = true
+		}
+	}
+	// Constants keep their order, so indexes only shrink and no
+	// instruction needs a longer form than it was compiled with
+	var constants ValueArrary
+	indexes := make([]int, len(oldConstants))
+	for i, value := range oldConstants {
+		if used[i] {
+			indexes[i] = int(constants.count)
+			writeValueArray(&constants, value)
+		}
+	}
+
+	// Jump offsets depend on where the instructions end up
+	targets := make(map[int]uint)
+	offset := uint(0)
+	for i := range o.code {
+		instruction := &o.code[i]
+		if instruction.constant >= 0 {
+			instruction.constant = indexes[instruction.constant]
+		}
+		for _, label := range instruction.labels {
+			targets[label] = offset
+		}
+		offset += instructionLength(*instruction)
+	}
+
+	chunk := Chunk{Constants: constants}
+	for _, instruction := range o.code {
+		line := instruction.line
+		switch {
+		case instruction.constant > math.MaxUint8:
+			WriteChunk(&chunk, instruction.op.LongForm(), line)
+			WriteChunk(&chunk, OpCode(instruction.constant>>16), line)
+			WriteChunk(&chunk, OpCode(instruction.constant>>8), line)
+			WriteChunk(&chunk, OpCode(instruction.constant), line)
+			for _, operand := range instruction.operands {
+				WriteChunk(&chunk, operand, line)
+			}
+		case instruction.target >= 0:
+			start := chunk.Count
+			WriteChunk(&chunk, instruction.op, line)
+			jump := int(targets[instruction.target]) - int(start+3)
+			if instruction.op == OP_LOOP {
+				jump = -jump
+			}
+			if jump > math.MaxUint16 {
+				return false
+			}
+			WriteChunk(&chunk, OpCode(jump>>8), line)
+			WriteChunk(&chunk, OpCode(jump), line)
+		default:
+			WriteChunk(&chunk, instruction.op, line)
+			if instruction.constant >= 0 {
+				WriteChunk(&chunk, OpCode(instruction.constant), line)
+			}
+			for _, operand := range instruction.operands {
+				WriteChunk(&chunk, operand, line)
+			}
+		}
+	}
+	o.function.chunk = chunk
+	return true
+}
+
+// instructionLength returns the number of bytes instruction is encoded in
+func instructionLength(instruction optInstruction) uint {
+	switch {
+	case instruction.constant > math.MaxUint8:
+		return 4 + uint(len(instruction.operands))
+	case instruction.target >= 0:
+		return 3
+	case instruction.constant >= 0:
+		return 2 + uint(len(instruction.operands))
+	default:
+		return 1 + uint(len(instruction.operands))
+	}
+}
+
+// endregion Encoding
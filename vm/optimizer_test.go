@@ -0,0 +1,158 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// runSource interprets source with the code optimized at level, returning
+// what it printed and the error it stopped with
+func runSource(level OptimizationLevel, source string) (string, error) {
+	var output bytes.Buffer
+	machine := InitVM(WithOptimizationLevel(level), WithStdout(&output), WithStderr(io.Discard))
+	defer machine.FreeVM()
+	_, err := machine.Interpret(source)
+	return output.String(), err
+}
+
+// countOpCodes counts the instructions of each kind in the code of chunk,
+// not including the functions among its constants
+func countOpCodes(chunk *Chunk) map[OpCode]int {
+	counts := make(map[OpCode]int)
+	for offset := uint(0); offset < chunk.Count; {
+		counts[chunk.Code[offset]]++
+		offset = disassembleInstruction(io.Discard, chunk, offset)
+	}
+	return counts
+}
+
+func TestOptimizerRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// Number of each instruction expected in the optimized script
+		want map[OpCode]int
+	}{
+		{"fold arithmetic", "print 1 + 2 * 3 - 4 / 2;",
+			map[OpCode]int{OP_ADD: 0, OP_SUBTRACT: 0, OP_MULTIPLY: 0, OP_DIVIDE: 0, OP_CONSTANT: 1}},
+		{"fold strings", `print "lo" + "x";`, map[OpCode]int{OP_ADD: 0, OP_CONSTANT: 1}},
+		{"fold comparisons", "print 1 < 2 == (3 >= 4);", map[OpCode]int{OP_LESS: 0, OP_EQUAL: 0, OP_FALSE: 1}},
+		{"fold negation", "print -(2 - 5);", map[OpCode]int{OP_NEGATE: 0, OP_CONSTANT: 1}},
+		{"fold not", "print !nil;", map[OpCode]int{OP_NOT: 0, OP_TRUE: 1}},
+		{"keep failing arithmetic", `print 1 + "a";`, map[OpCode]int{OP_ADD: 1}},
+		{"keep negating a string", `print -"a";`, map[OpCode]int{OP_NEGATE: 1}},
+		{"fuse not equal", "var a = 1; print !(a == 2);", map[OpCode]int{OP_NOT: 0, OP_EQUAL: 0, OP_NOT_EQUAL: 1}},
+		{"fuse less", "var a = 1; print !(a < 2);", map[OpCode]int{OP_NOT: 0, OP_LESS: 0, OP_GREATER_EQUAL: 1}},
+		{"fuse greater", "var a = 1; print !(a > 2);", map[OpCode]int{OP_NOT: 0, OP_LESS_EQUAL: 1}},
+		{"fuse NaN comparison", "var a = 0 / 0; print !(a < 1); print !(a <= 1);",
+			map[OpCode]int{OP_NOT: 0, OP_GREATER_EQUAL: 1, OP_GREATER: 1}},
+		{"drop NOT NOT", "var a = 1; print !!!a;", map[OpCode]int{OP_NOT: 1}},
+		{"drop NOT NOT before a jump", "var a = 1; if (!!a) print 1; else print 2;", map[OpCode]int{OP_NOT: 0}},
+		{"keep NOT NOT as a value", "var a = 1; print !!a;", map[OpCode]int{OP_NOT: 2}},
+		{"stop at jump targets", "var a = false; print !(a or false);", map[OpCode]int{OP_NOT: 1, OP_FALSE: 2}},
+	}
+
+	for _, test := range tests {
+		chunk := compileChunkAt(t, OPTIMIZE_PEEPHOLE, test.source)
+		counts := countOpCodes(chunk)
+		for op, want := range test.want {
+			if counts[op] != want {
+				t.Errorf("%s: %d %s instructions, want %d", test.name, counts[op], op, want)
+			}
+		}
+		if err := chunk.Verify(); err != nil {
+			t.Errorf("%s: optimized chunk fails verification: %v", test.name, err)
+		}
+
+		want, wantErr := runSource(OPTIMIZE_NONE, test.source)
+		got, gotErr := runSource(OPTIMIZE_PEEPHOLE, test.source)
+		if got != want || fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+			t.Errorf("%s: optimized code printed %q with error %v, want %q with error %v",
+				test.name, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+func TestOptimizerKeepsOutput(t *testing.T) {
+	for _, level := range []OptimizationLevel{OPTIMIZE_NONE, OPTIMIZE_PEEPHOLE} {
+		if _, err := runSource(level, testProgram); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+	}
+	want, _ := runSource(OPTIMIZE_NONE, testProgram)
+	got, _ := runSource(OPTIMIZE_PEEPHOLE, testProgram)
+	if got != want {
+		t.Errorf("optimized program printed %q, want %q", got, want)
+	}
+}
+
+func TestOptimizerLines(t *testing.T) {
+	source := `var a = 1 +
+  2;
+var b = !(a <
+  4);
+print -"not a number";`
+	chunk := compileChunkAt(t, OPTIMIZE_PEEPHOLE, source)
+	if uint(len(chunk.Lines)) != chunk.Count {
+		t.Fatalf("%d lines for %d bytes of code", len(chunk.Lines), chunk.Count)
+	}
+	// A folded constant takes the line of its first operand
+	if chunk.Code[0] != OP_CONSTANT || chunk.Lines[0] != 1 {
+		t.Errorf("script starts with %s on line %d, want a folded constant on line 1", chunk.Code[0], chunk.Lines[0])
+	}
+	// A fused comparison keeps the line of the comparison
+	lines := make(map[OpCode]uint)
+	unoptimized := compileChunk(t, source)
+	for offset := uint(0); offset < unoptimized.Count; offset = disassembleInstruction(io.Discard, unoptimized, offset) {
+		lines[unoptimized.Code[offset]] = unoptimized.Lines[offset]
+	}
+	for offset := uint(0); offset < chunk.Count; offset = disassembleInstruction(io.Discard, chunk, offset) {
+		if chunk.Code[offset] == OP_GREATER_EQUAL && chunk.Lines[offset] != lines[OP_LESS] {
+			t.Errorf("fused comparison is on line %d, want %d", chunk.Lines[offset], lines[OP_LESS])
+		}
+	}
+
+	for _, level := range []OptimizationLevel{OPTIMIZE_NONE, OPTIMIZE_PEEPHOLE} {
+		_, err := runSource(level, source)
+		var runtimeErr *RuntimeError
+		if !errors.As(err, &runtimeErr) || runtimeErr.Frames[0].Line != 5 {
+			t.Errorf("level %d: got error %v, want a runtime error on line 5", level, err)
+		}
+	}
+}
+
+// TestOptimizerLongJumps optimizes a jump over code which grows when
+// negated constants need wide indexes, taking it past the longest jump
+func TestOptimizerLongJumps(t *testing.T) {
+	var source strings.Builder
+	source.WriteString("if (true) {\n")
+	// Each pair is one byte longer once -i is a constant past index 255
+	for i := 0; i < 255; i++ {
+		fmt.Fprintf(&source, "%d; -%d;\n", i, i)
+	}
+	// Padding to bring the jump close to its limit
+	for i := 0; i < 31800; i++ {
+		source.WriteString("nil;\n")
+	}
+	source.WriteString("print \"done\";\n}\n")
+
+	chunk := compileChunkAt(t, OPTIMIZE_PEEPHOLE, source.String())
+	if err := chunk.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// The jump can't be encoded, so the code is left as it was compiled
+	if negations := countOpCodes(chunk)[OP_NEGATE]; negations != 255 {
+		t.Errorf("%d negations left, want the 255 compiled", negations)
+	}
+	if unoptimized := compileChunk(t, source.String()); !equalChunks(chunk, unoptimized) {
+		t.Error("optimized chunk differs from the compiled one")
+	}
+	output, err := runSource(OPTIMIZE_PEEPHOLE, source.String())
+	if err != nil || output != "done\n" {
+		t.Errorf("printed %q with error %v, want \"done\"", output, err)
+	}
+}
@@ -4,20 +4,41 @@ import (
 	"errors"
 )
 
+// Scanner splits lox source code into tokens
 type Scanner struct {
 	code    []rune
 	start   uint
 	current uint
 	line    int
+	// Index of the first character of the current line
+	lineStart uint
+	// Line and column where the current token starts
+	startLine   int
+	startColumn int
+	// Comments skipped so far, in the order they appear
+	comments []Comment
 }
 
-func initScanner(source *string) *Scanner {
-	return &Scanner{code: []rune(*source), start: 0, current: 0, line: 0}
+// Comment is a // comment skipped by the scanner
+type Comment struct {
+	// Position of the first slash
+	Position Position
+	// Text of the comment, from the slashes to the end of the line
+	Text string
 }
 
-func (scanner *Scanner) scanToken() Token {
+// NewScanner creates a scanner reading the tokens of source
+func NewScanner(source string) *Scanner {
+	return &Scanner{code: []rune(source), start: 0, current: 0, line: 1}
+}
+
+// ScanToken returns the next token, TOKEN_EOF once the source is used up.
+// Whitespace is skipped, and comments are skipped but kept for Comments.
+func (scanner *Scanner) ScanToken() Token {
 	scanner.skipWhitespace()
 	scanner.start = scanner.current
+	scanner.startLine = scanner.line
+	scanner.startColumn = int(scanner.current-scanner.lineStart) + 1
 
 	if scanner.isAtEnd() {
 		return scanner.makeToken(TOKEN_EOF)
@@ -115,17 +136,21 @@ func (scanner *Scanner) skipWhitespace() {
 		case ' ', '\r', '\t':
 			_ = scanner.advance()
 		case '\n':
-			scanner.line++
 			_ = scanner.advance()
+			scanner.newLine()
 		case '/':
 			nextChar, err := scanner.peekNext()
 			if err != nil {
 				return
 			}
 			if nextChar == '/' {
+				start := scanner.current
+				position := Position{Line: scanner.line, Column: int(start-scanner.lineStart) + 1, Offset: int(start)}
 				for c, _ := scanner.peek(); c != '\n' && !scanner.isAtEnd(); c, _ = scanner.peek() {
 					_ = scanner.advance()
 				}
+				scanner.comments = append(scanner.comments,
+					Comment{Position: position, Text: string(scanner.code[start:scanner.current])})
 			} else {
 				return
 			}
@@ -135,12 +160,18 @@ func (scanner *Scanner) skipWhitespace() {
 	}
 }
 
+// newLine records that the character just consumed ended a line
+func (scanner *Scanner) newLine() {
+	scanner.line++
+	scanner.lineStart = scanner.current
+}
+
 func (scanner *Scanner) string() Token {
 	for c, e := scanner.peek(); e == nil && c != '"' && !scanner.isAtEnd(); c, e = scanner.peek() {
+		scanner.advance()
 		if c == '\n' {
-			scanner.line++
+			scanner.newLine()
 		}
-		scanner.advance()
 	}
 	if scanner.isAtEnd() {
 		return scanner.errorToken("Unterminated string.")
@@ -237,7 +268,7 @@ func (scanner *Scanner) peek() (rune, error) {
 }
 
 func (scanner *Scanner) peekNext() (rune, error) {
-	if scanner.current >= uint(len(scanner.code))-2 {
+	if scanner.current+1 >= uint(len(scanner.code)) {
 		return 'x', errors.New("unexpected EOF")
 	}
 	return scanner.code[scanner.current+1], nil
@@ -248,7 +279,8 @@ func (scanner *Scanner) makeToken(tokType TokenType) Token {
 		tokenType: tokType,
 		start:     scanner.start,
 		length:    scanner.current - scanner.start,
-		line:      scanner.line,
+		line:      scanner.startLine,
+		column:    scanner.startColumn,
 	}
 }
 
@@ -256,10 +288,24 @@ func (scanner *Scanner) errorToken(msg string) Token {
 	return Token{
 		err:       &msg,
 		tokenType: TOKEN_ERROR,
-		start:     0,
-		length:    uint(len(msg)),
-		line:      scanner.line,
+		start:     scanner.start,
+		length:    scanner.current - scanner.start,
+		line:      scanner.startLine,
+		column:    scanner.startColumn,
+	}
+}
+
+// Lexeme returns the source text of a token
+func (scanner *Scanner) Lexeme(token Token) string {
+	if token.text != nil {
+		return *token.text
 	}
+	return string(scanner.code[token.start : token.start+token.length])
+}
+
+// Comments returns the comments skipped by the tokens scanned so far
+func (scanner *Scanner) Comments() []Comment {
+	return scanner.comments
 }
 
 // Other helpers
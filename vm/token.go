@@ -124,10 +124,43 @@ func (tt TokenType) String() string {
 	return tokenTypeNames[tt]
 }
 
+// Token is a single lexeme of the source code, as produced by Scanner
 type Token struct {
 	err       *string
 	tokenType TokenType
 	start     uint
 	length    uint
 	line      int
+	// Column of the first character of the token, starting from 1
+	column int
+	// Text of a synthetic token which doesn't appear in the source
+	text *string
+}
+
+// syntheticToken creates an identifier token which isn't backed by the source
+func syntheticToken(text string) Token {
+	return Token{
+		tokenType: TOKEN_IDENTIFIER,
+		length:    uint(len(text)),
+		text:      &text,
+	}
+}
+
+// Type returns the type of the token
+func (token Token) Type() TokenType {
+	return token.tokenType
+}
+
+// Position returns where the token starts in the source
+func (token Token) Position() Position {
+	return Position{Line: token.line, Column: token.column, Offset: int(token.start)}
+}
+
+// ErrorMessage returns the problem a TOKEN_ERROR describes, empty for
+// other tokens
+func (token Token) ErrorMessage() string {
+	if token.err == nil {
+		return ""
+	}
+	return *token.err
 }
@@ -2,6 +2,8 @@ package vm
 
 import (
 	"fmt"
+	"io"
+	"math"
 )
 
 // region Typing
@@ -21,116 +23,42 @@ const (
 
 // region Value
 
-// ValueData represents the data associated with a Value
-type ValueData interface {
-	asBool() bool
-	asNumber() float64
-	asNil()
-	asObj() *Obj
-}
-
-// region Boolean
-
-type Boolean struct {
-	value bool
-}
-
-// Implement the ValueData type
-func (b *Boolean) asBool() bool {
-	return b.value
-}
-
-func (b *Boolean) asNumber() float64 {
-	panic("Can't coerce a bool to float")
-}
-
-func (b *Boolean) asNil() {
-	panic("Can't coerce bool to nil")
-}
-
-func (b *Boolean) asObj() *Obj {
-	panic("Can't coerce bool to obj")
-}
-
-// endregion Boolean
-
-// region Number
-
-type Number struct {
-	value float64
-}
-
-func (n *Number) asBool() bool {
-	panic("Can't coerce number to bool")
-}
-
-func (n *Number) asNumber() float64 {
-	return n.value
-}
-
-func (n *Number) asNil() {
-	panic("Can't coerce nil to float")
-}
-
-func (n *Number) asObj() *Obj {
-	panic("Can't coerce number to obj")
-}
-
-// endregion Number
-
-// region Nil
-
-type Nil struct{}
-
-func (n *Nil) asBool() bool {
-	panic("Can't coerce nil to bool")
-}
-
-func (n *Nil) asNumber() float64 {
-	panic("Can't coerce nil to float")
-}
-
-func (n *Nil) asNil() {
-	return
-}
-
-func (n *Nil) asObj() *Obj {
-	panic("Can't coerce obj to nil")
-}
-
-// endregion Nil
-
-// region Object
-
-type Object struct {
-	value *Obj
-}
-
-func (o *Object) asBool() bool {
-	panic("Can't coerce obj to bool")
+// Value represents data in lox. Numbers are stored as their IEEE 754
+// bits, and every other type as a quiet NaN tagged with its type, so the
+// type and data of a nil, boolean or number share one 64 bit word. The
+// object of a VAL_OBJ is kept in its own field rather than in the word,
+// since Go's garbage collector can't see pointers hidden in an integer.
+// Fields should only be accessed through the conversion functions, such
+// as numberToVal and valAsNumber.
+type Value struct {
+	// Bits of a number, or QNAN with the tag of any other type
+	bits uint64
+	// Object of a VAL_OBJ, nil for every other type
+	obj *Obj
 }
 
-func (o *Object) asNumber() float64 {
-	panic("Can't coerce obj to float")
-}
+// Quiet NaN bits marking a Value which isn't a number. Numbers which are
+// NaN are stored as CANONICAL_NAN, which doesn't have all of them set.
+const QNAN uint64 = 0x7ffc000000000000
 
-func (o *Object) asNil() {
-	panic("Can't coerce nil to float")
-}
+// CANONICAL_NAN is the one NaN number stored in a Value
+const CANONICAL_NAN uint64 = 0x7ff8000000000000
 
-func (o *Object) asObj() *Obj {
-	return o.value
-}
-
-// endregion Object
+// Tags in the low bits of QNAN, giving the type of a Value which isn't a number
+const (
+	TAG_NIL   uint64 = 1
+	TAG_FALSE uint64 = 2
+	TAG_TRUE  uint64 = 3
+	TAG_OBJ   uint64 = 4
+)
 
-// Value represents data in lox
-type Value struct {
-	// Type of the Value
-	typeof ValueType
-	// Data associated with a Value
-	data ValueData
-}
+// Words of the Values of each type that isn't a number
+const (
+	NIL_VAL   = QNAN | TAG_NIL
+	FALSE_VAL = QNAN | TAG_FALSE
+	TRUE_VAL  = QNAN | TAG_TRUE
+	OBJ_VAL   = QNAN | TAG_OBJ
+)
 
 // endregion Value
 
@@ -151,28 +79,50 @@ func writeValueArray(array *ValueArrary, value Value) {
 	array.count += 1
 }
 
-func printValue(value Value) {
-	switch value.typeof {
+func printValue(w io.Writer, value Value) {
+	_, _ = fmt.Fprint(w, formatValue(value))
+}
+
+// formatValue returns the text print shows for value
+func formatValue(value Value) string {
+	switch value.Type() {
 	case VAL_BOOL:
 		if valAsBool(value) {
-			fmt.Printf("true")
-		} else {
-			fmt.Printf("false")
+			return "true"
 		}
+		return "false"
 	case VAL_NIL:
-		fmt.Printf("nil")
+		return "nil"
 	case VAL_NUMBER:
-		fmt.Printf("%g", valAsNumber(value))
+		return fmt.Sprintf("%g", valAsNumber(value))
 	case VAL_OBJ:
-		printObject(value)
+		return formatObject(value)
+	default:
+		return ""
 	}
 }
 
-func printObject(value Value) {
+func formatObject(value Value) string {
 	object := valAsObj(value)
 	switch object.typeof {
 	case STRING_TYPE:
-		fmt.Printf(*object.data.asString())
+		return *object.data.asString()
+	case FUNCTION_TYPE:
+		return formatFunction(object.data.asFunction())
+	case CLOSURE_TYPE:
+		return formatFunction(object.data.asClosure().function)
+	case UPVALUE_TYPE:
+		return "upvalue"
+	case CLASS_TYPE:
+		return *object.data.asClass().name
+	case INSTANCE_TYPE:
+		return *object.data.asInstance().class.name + " instance"
+	case BOUND_METHOD_TYPE:
+		return formatFunction(object.data.asBoundMethod().method.function)
+	case NATIVE_TYPE:
+		return "<native fn>"
+	default:
+		return ""
 	}
 }
 
@@ -180,74 +130,57 @@ func printObject(value Value) {
 
 // region Conversions
 
+// The valAs functions don't check the type of the value, so callers must
+// check it first with isBool, isNumber or isObj. valAsObj returns nil for
+// anything but an object, so the VM checks every value it takes off the
+// stack as an object, since a loaded chunk can leave anything there.
+
 func boolToVal(boolean bool) Value {
-	return Value{
-		typeof: VAL_BOOL,
-		data: &Boolean{
-			value: boolean,
-		},
+	if boolean {
+		return Value{bits: TRUE_VAL}
 	}
+	return Value{bits: FALSE_VAL}
 }
 
 func nilToVal() Value {
-	return Value{
-		typeof: VAL_NIL,
-	}
+	return Value{bits: NIL_VAL}
 }
 
 func numberToVal(number float64) Value {
-	return Value{
-		typeof: VAL_NUMBER,
-		data: &Number{
-			value: number,
-		},
+	// Other NaNs could collide with the tagged words
+	if number != number {
+		return Value{bits: CANONICAL_NAN}
 	}
+	return Value{bits: math.Float64bits(number)}
 }
 
-func objToVal(obj interface{}) Value {
-	return Value{
-		typeof: VAL_OBJ,
-		data: &Object{
-			value: dataToObj(obj),
-		},
-	}
+func objToVal(data ObjData) Value {
+	return Value{bits: OBJ_VAL, obj: data.header()}
 }
 
 func valAsBool(value Value) bool {
-	if value.typeof != VAL_BOOL {
-		panic("Tried to interpret an invalid value data bool")
-	}
-	return value.data.asBool()
+	return value.bits == TRUE_VAL
 }
 
 func valAsNumber(value Value) float64 {
-	if value.typeof != VAL_NUMBER {
-		panic("Tried to interpret an invalid value data number")
-	}
-	return value.data.asNumber()
-}
-
-func valAsNil(value Value) Nil {
-	return Nil{}
+	return math.Float64frombits(value.bits)
 }
 
 func valAsObj(value Value) *Obj {
-	if value.typeof != VAL_OBJ {
-		panic("Tried to interpret an invalid value data object")
-	}
-	return value.data.asObj()
+	return value.obj
 }
 
 func isBool(value Value) bool {
-	return value.typeof == VAL_BOOL
+	// FALSE_VAL and TRUE_VAL only differ in the lowest bit
+	return value.bits|1 == TRUE_VAL
 }
 
 func isNil(value Value) bool {
-	return value.typeof == VAL_NIL
+	return value.bits == NIL_VAL
 }
 
 func isNumber(value Value) bool {
-	return value.typeof == VAL_NUMBER
+	return value.bits&QNAN != QNAN
 }
 
 func isFalsey(value Value) bool {
@@ -255,23 +188,23 @@ func isFalsey(value Value) bool {
 }
 
 func isObj(value Value) bool {
-	return value.typeof == VAL_OBJ
+	return value.bits == OBJ_VAL
 }
 
 func valuesEqual(a Value, b Value) bool {
-	if a.typeof != b.typeof {
+	if isNumber(a) && isNumber(b) {
+		// Compared as floats, so NaN isn't equal to itself and 0 equals -0
+		return valAsNumber(a) == valAsNumber(b)
+	}
+	if a.bits != b.bits {
 		return false
 	}
-	switch a.typeof {
-	case VAL_BOOL:
-		return valAsBool(a) == valAsBool(b)
-	case VAL_NIL:
+	switch a.Type() {
+	case VAL_BOOL, VAL_NIL:
 		return true
-	case VAL_NUMBER:
-		return valAsNumber(a) == valAsNumber(b)
 	case VAL_OBJ:
-		aObj := a.data.asObj()
-		bObj := b.data.asObj()
+		aObj := valAsObj(a)
+		bObj := valAsObj(b)
 		if aObj.typeof != bObj.typeof {
 			return false
 		}
@@ -280,11 +213,98 @@ func valuesEqual(a Value, b Value) bool {
 			bString := valAsObj(b).data.asString()
 			return aString == bString
 		}
-		// No other objects implemented yet, so just return false
-		return false
+		// Other objects are only equal to themselves
+		return aObj == bObj
 	default:
 		return false
 	}
 }
 
 // endregion Conversions
+
+// region Public API
+
+// NilValue returns the lox nil value
+func NilValue() Value {
+	return nilToVal()
+}
+
+// BoolValue converts a Go bool to a lox boolean
+func BoolValue(boolean bool) Value {
+	return boolToVal(boolean)
+}
+
+// NumberValue converts a Go float64 to a lox number
+func NumberValue(number float64) Value {
+	return numberToVal(number)
+}
+
+// StringValue converts a Go string to a lox string owned by machine
+func (machine *VM) StringValue(str string) Value {
+	return objToVal(machine.copyString(str))
+}
+
+// Type returns the type of the value
+func (value Value) Type() ValueType {
+	switch {
+	case isNumber(value):
+		return VAL_NUMBER
+	case isObj(value):
+		return VAL_OBJ
+	case isNil(value):
+		return VAL_NIL
+	default:
+		return VAL_BOOL
+	}
+}
+
+// IsNil reports whether the value is nil
+func (value Value) IsNil() bool {
+	return isNil(value)
+}
+
+// IsBool reports whether the value is a boolean
+func (value Value) IsBool() bool {
+	return isBool(value)
+}
+
+// IsNumber reports whether the value is a number
+func (value Value) IsNumber() bool {
+	return isNumber(value)
+}
+
+// IsString reports whether the value is a string
+func (value Value) IsString() bool {
+	return isObj(value) && isString(valAsObj(value))
+}
+
+// AsBool returns the boolean held by the value, and whether it is a boolean
+func (value Value) AsBool() (bool, bool) {
+	if !isBool(value) {
+		return false, false
+	}
+	return valAsBool(value), true
+}
+
+// AsNumber returns the number held by the value, and whether it is a number
+func (value Value) AsNumber() (float64, bool) {
+	if !isNumber(value) {
+		return 0, false
+	}
+	return valAsNumber(value), true
+}
+
+// AsString returns the string held by the value, and whether it is a string
+func (value Value) AsString() (string, bool) {
+	if !value.IsString() {
+		return "", false
+	}
+	return *valAsObj(value).data.asString(), true
+}
+
+// String returns the value as it would be printed by lox
+func (value Value) String() string {
+	return formatValue(value)
+}
+
+// endregion Public API
@@ -0,0 +1,100 @@
+package vm
+
+import (
+	"math"
+	"testing"
+	"unsafe"
+)
+
+func TestValueSize(t *testing.T) {
+	// One word for the type and data, one for the object pointer
+	if size := unsafe.Sizeof(Value{}); size != 16 {
+		t.Errorf("Value is %d bytes, want 16", size)
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	machine := InitVM()
+	defer machine.FreeVM()
+
+	tests := []struct {
+		name  string
+		value Value
+		want  ValueType
+	}{
+		{"nil", nilToVal(), VAL_NIL},
+		{"true", boolToVal(true), VAL_BOOL},
+		{"false", boolToVal(false), VAL_BOOL},
+		{"zero", numberToVal(0), VAL_NUMBER},
+		{"negative zero", numberToVal(math.Copysign(0, -1)), VAL_NUMBER},
+		{"infinity", numberToVal(math.Inf(-1)), VAL_NUMBER},
+		{"NaN", numberToVal(math.NaN()), VAL_NUMBER},
+		{"NaN with tag bits", numberToVal(math.Float64frombits(TRUE_VAL)), VAL_NUMBER},
+		{"string", machine.StringValue("lox"), VAL_OBJ},
+	}
+	for _, test := range tests {
+		if got := test.value.Type(); got != test.want {
+			t.Errorf("%s: Type() = %d, want %d", test.name, got, test.want)
+		}
+		if isNumber(test.value) != (test.want == VAL_NUMBER) || isBool(test.value) != (test.want == VAL_BOOL) ||
+			isNil(test.value) != (test.want == VAL_NIL) || isObj(test.value) != (test.want == VAL_OBJ) {
+			t.Errorf("%s: type predicates disagree with Type()", test.name)
+		}
+	}
+}
+
+func TestValueConversions(t *testing.T) {
+	if !valAsBool(boolToVal(true)) || valAsBool(boolToVal(false)) {
+		t.Error("booleans don't round trip")
+	}
+	for _, number := range []float64{0, 1.5, -3, math.MaxFloat64, math.SmallestNonzeroFloat64, math.Inf(1)} {
+		if got := valAsNumber(numberToVal(number)); got != number {
+			t.Errorf("valAsNumber(numberToVal(%g)) = %g", number, got)
+		}
+	}
+	if got := valAsNumber(numberToVal(math.NaN())); !math.IsNaN(got) {
+		t.Errorf("NaN converted to %g", got)
+	}
+}
+
+func TestValuesEqual(t *testing.T) {
+	machine := InitVM()
+	defer machine.FreeVM()
+
+	nan := numberToVal(math.NaN())
+	tests := []struct {
+		name string
+		a, b Value
+		want bool
+	}{
+		{"equal numbers", numberToVal(2), numberToVal(2), true},
+		{"different numbers", numberToVal(2), numberToVal(3), false},
+		{"signed zeros", numberToVal(0), numberToVal(math.Copysign(0, -1)), true},
+		{"NaN", nan, nan, false},
+		{"nils", nilToVal(), nilToVal(), true},
+		{"nil and false", nilToVal(), boolToVal(false), false},
+		{"booleans", boolToVal(true), boolToVal(true), true},
+		{"different booleans", boolToVal(true), boolToVal(false), false},
+		{"interned strings", machine.StringValue("a"), machine.StringValue("a"), true},
+		{"different strings", machine.StringValue("a"), machine.StringValue("b"), false},
+		{"number and string", numberToVal(1), machine.StringValue("1"), false},
+	}
+	for _, test := range tests {
+		if got := valuesEqual(test.a, test.b); got != test.want {
+			t.Errorf("%s: valuesEqual = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValueConversionsDontAllocate(t *testing.T) {
+	allocations := testing.AllocsPerRun(100, func() {
+		a := numberToVal(1)
+		b := numberToVal(2)
+		_ = numberToVal(valAsNumber(a) + valAsNumber(b))
+		_ = boolToVal(valuesEqual(a, b))
+		_ = nilToVal()
+	})
+	if allocations != 0 {
+		t.Errorf("creating values made %g allocations, want 0", allocations)
+	}
+}
@@ -0,0 +1,342 @@
+package vm
+
+import "fmt"
+
+// Verify checks the chunk can be run as a script without crashing the VM,
+// along with the functions among its constants. Every opcode must be
+// known, operands must lie inside the code and refer to existing
+// constants of the right type, jumps must land on instructions, and no
+// path may run off the end of the code. The stack must never be popped
+// below the frame or grow past STACK_MAX.
+func (chunk *Chunk) Verify() error {
+	return verifyFunction(&FunctionObj{chunk: *chunk}, make(map[*FunctionObj]bool))
+}
+
+// verifyFunction verifies function and then the functions it creates,
+// skipping those which have already been seen
+func verifyFunction(function *FunctionObj, seen map[*FunctionObj]bool) error {
+	seen[function] = true
+	v := verifier{function: function}
+	if err := v.verify(); err != nil {
+		return err
+	}
+
+	for _, constant := range v.constants {
+		if isObj(constant) && valAsObj(constant).typeof == FUNCTION_TYPE {
+			nested := valAsObj(constant).data.asFunction()
+			if !seen[nested] {
+				if err := verifyFunction(nested, seen); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// verifier holds the state of the verification of a single function
+type verifier struct {
+	function  *FunctionObj
+	code      []OpCode
+	constants []Value
+	// Length of the instruction starting at each offset, zero for offsets
+	// inside operands
+	lengths []uint
+	// Stack height before each instruction, -1 until a path reaches it
+	heights []int
+	// Greatest stack height on any path
+	maxHeight int
+}
+
+func (v *verifier) fail(offset uint, format string, args ...interface{}) error {
+	name := "script"
+	if v.function.name != nil {
+		name = *v.function.name
+	}
+	err := &VerifyError{Function: name, Offset: offset, Message: fmt.Sprintf(format, args...)}
+	if offset < uint(len(v.code)) {
+		err.OpCode = v.code[offset]
+	}
+	return err
+}
+
+// verify checks the function, without the functions it creates, and
+// records the most stack slots its frame uses
+func (v *verifier) verify() error {
+	chunk := &v.function.chunk
+	if chunk.Count > uint(len(chunk.Code)) || chunk.Count > uint(len(chunk.Lines)) ||
+		chunk.Constants.count > uint(len(chunk.Constants.values)) {
+		return v.fail(0, "counts don't match the code and constants")
+	}
+	v.code = chunk.Code[:chunk.Count]
+	v.constants = chunk.Constants.values[:chunk.Constants.count]
+	if len(v.code) == 0 {
+		return v.fail(0, "no code")
+	}
+
+	if err := v.decode(); err != nil {
+		return err
+	}
+	if err := v.checkStack(); err != nil {
+		return err
+	}
+	v.function.maxSlots = v.maxHeight
+	return nil
+}
+
+// region Operands
+
+// decode walks the instructions in order, checking their operands
+func (v *verifier) decode() error {
+	v.lengths = make([]uint, len(v.code))
+	for offset := uint(0); offset < uint(len(v.code)); {
+		length, err := v.decodeInstruction(offset)
+		if err != nil {
+			return err
+		}
+		v.lengths[offset] = length
+		offset += length
+	}
+
+	// Jumps are checked once every instruction boundary is known
+	for offset, length := range v.lengths {
+		switch v.code[offset] {
+		case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP:
+			if length == 0 {
+				continue
+			}
+			if _, ok := v.jumpTarget(uint(offset)); !ok {
+				return v.fail(uint(offset), "jump target isn't an instruction")
+			}
+		}
+	}
+	return nil
+}
+
+// decodeInstruction checks the operands of the instruction at offset and
+// returns its length
+func (v *verifier) decodeInstruction(offset uint) (uint, error) {
+	instruction := v.code[offset]
+	if _, ok := opCodeNames[instruction]; !ok {
+		return 0, v.fail(offset, "unknown opcode %d", instruction)
+	}
+
+	// Long forms are checked as the instruction they widen, with two more
+	// bytes of index
+	short := instruction.shortForm()
+	width := v.indexWidth(offset)
+	length := uint(1)
+	switch short {
+	case OP_CONSTANT, OP_GET_LOCAL, OP_SET_LOCAL, OP_GET_UPVALUE, OP_SET_UPVALUE, OP_CALL,
+		OP_GET_GLOBAL, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_GET_PROPERTY, OP_SET_PROPERTY,
+		OP_GET_SUPER, OP_CLASS, OP_METHOD, OP_CLOSURE:
+		length = 1 + width
+	case OP_INVOKE, OP_SUPER_INVOKE:
+		length = 2 + width
+	case OP_JUMP, OP_JUMP_IF_FALSE, OP_LOOP:
+		length = 3
+	}
+	if offset+length > uint(len(v.code)) {
+		return 0, v.fail(offset, "operands run past the end of the code")
+	}
+
+	switch short {
+	case OP_CONSTANT:
+		if index := v.constantIndex(offset); index >= uint(len(v.constants)) {
+			return 0, v.fail(offset, "constant %d out of range", index)
+		}
+	case OP_GET_GLOBAL, OP_DEFINE_GLOBAL, OP_SET_GLOBAL, OP_GET_PROPERTY, OP_SET_PROPERTY,
+		OP_GET_SUPER, OP_CLASS, OP_METHOD, OP_INVOKE, OP_SUPER_INVOKE:
+		if err := v.checkConstant(offset, STRING_TYPE); err != nil {
+			return 0, err
+		}
+	case OP_GET_UPVALUE, OP_SET_UPVALUE:
+		if index := int(v.code[offset+1]); index >= v.function.upvalueCount {
+			return 0, v.fail(offset, "upvalue %d out of range", index)
+		}
+	case OP_CLOSURE:
+		if err := v.checkConstant(offset, FUNCTION_TYPE); err != nil {
+			return 0, err
+		}
+		function := valAsObj(v.constants[v.constantIndex(offset)]).data.asFunction()
+		length += 2 * uint(function.upvalueCount)
+		if offset+length > uint(len(v.code)) {
+			return 0, v.fail(offset, "operands run past the end of the code")
+		}
+		for i := offset + 1 + width; i < offset+length; i += 2 {
+			isLocal, index := v.code[i], v.code[i+1]
+			if isLocal > 1 {
+				return 0, v.fail(offset, "capture kind %d is neither local nor upvalue", isLocal)
+			}
+			if isLocal == 0 && int(index) >= v.function.upvalueCount {
+				return 0, v.fail(offset, "upvalue %d out of range", index)
+			}
+		}
+	}
+	return length, nil
+}
+
+// indexWidth returns the number of bytes in the constant index of the
+// instruction at offset
+func (v *verifier) indexWidth(offset uint) uint {
+	if v.code[offset].isLong() {
+		return 3
+	}
+	return 1
+}
+
+// constantIndex returns the constant index of the instruction at offset
+func (v *verifier) constantIndex(offset uint) uint {
+	if v.code[offset].isLong() {
+		return uint(v.code[offset+1])<<16 | uint(v.code[offset+2])<<8 | uint(v.code[offset+3])
+	}
+	return uint(v.code[offset+1])
+}
+
+// checkConstant checks the constant operand of the instruction at offset
+// refers to an object of the given type
+func (v *verifier) checkConstant(offset uint, objType ObjType) error {
+	index := v.constantIndex(offset)
+	if index >= uint(len(v.constants)) {
+		return v.fail(offset, "constant %d out of range", index)
+	}
+	if !isObj(v.constants[index]) || valAsObj(v.constants[index]).typeof != objType {
+		return v.fail(offset, "constant %d has the wrong type", index)
+	}
+	return nil
+}
+
+// jumpTarget returns the offset the jump at offset lands on, and whether
+// it is the start of an instruction
+func (v *verifier) jumpTarget(offset uint) (uint, bool) {
+	jump := uint(v.code[offset+1])<<8 | uint(v.code[offset+2])
+	var target uint
+	if v.code[offset] == OP_LOOP {
+		if jump > offset+3 {
+			return 0, false
+		}
+		target = offset + 3 - jump
+	} else {
+		target = offset + 3 + jump
+	}
+	return target, target < uint(len(v.code)) && v.lengths[target] != 0
+}
+
+// endregion Operands
+
+// region Stack
+
+// checkStack follows every path through the code, making sure the stack
+// height before each instruction is the same on every path, stays within
+// the frame and never drops below what the instruction pops
+func (v *verifier) checkStack() error {
+	v.heights = make([]int, len(v.code))
+	for i := range v.heights {
+		v.heights[i] = -1
+	}
+
+	// The frame starts with the callee followed by its arguments
+	v.heights[0] = v.function.arity + 1
+	v.maxHeight = v.heights[0]
+	worklist := []uint{0}
+	for len(worklist) > 0 {
+		offset := worklist[len(worklist)-1]
+		worklist = worklist[:len(worklist)-1]
+
+		height := v.heights[offset]
+		pops, pushes, err := v.stackEffect(offset, height)
+		if err != nil {
+			return err
+		}
+		if height < pops {
+			return v.fail(offset, "pops %d values from a stack of %d", pops, height)
+		}
+		height += pushes - pops
+		if height > int(STACK_MAX) {
+			return v.fail(offset, "stack grows past %d slots", STACK_MAX)
+		}
+		v.maxHeight = max(v.maxHeight, height)
+
+		for _, next := range v.successors(offset) {
+			if next >= uint(len(v.code)) {
+				return v.fail(offset, "execution runs past the end of the code")
+			}
+			if v.heights[next] == -1 {
+				v.heights[next] = height
+				worklist = append(worklist, next)
+			} else if v.heights[next] != height {
+				return v.fail(next, "stack height is %d on one path and %d on another", v.heights[next], height)
+			}
+		}
+	}
+	return nil
+}
+
+// stackEffect returns the number of values the instruction at offset pops
+// and pushes, given the height of the stack before it
+func (v *verifier) stackEffect(offset uint, height int) (int, int, error) {
+	switch v.code[offset].shortForm() {
+	case OP_CONSTANT, OP_NIL, OP_TRUE, OP_FALSE, OP_GET_GLOBAL, OP_GET_UPVALUE, OP_CLASS:
+		return 0, 1, nil
+	case OP_GET_LOCAL, OP_SET_LOCAL:
+		if slot := int(v.code[offset+1]); slot >= height {
+			return 0, 0, v.fail(offset, "local %d is above the top of the stack", slot)
+		}
+		if v.code[offset] == OP_SET_LOCAL {
+			return 1, 1, nil
+		}
+		return 0, 1, nil
+	case OP_CLOSURE:
+		function := valAsObj(v.constants[v.constantIndex(offset)]).data.asFunction()
+		captures := offset + 1 + v.indexWidth(offset)
+		for i := 0; i < function.upvalueCount; i++ {
+			isLocal, index := v.code[captures+uint(2*i)], int(v.code[captures+1+uint(2*i)])
+			// A local function can capture itself, in the slot the closure is pushed to
+			if isLocal == 1 && index > height {
+				return 0, 0, v.fail(offset, "captured local %d is above the top of the stack", index)
+			}
+		}
+		return 0, 1, nil
+	case OP_POP, OP_DEFINE_GLOBAL, OP_PRINT, OP_CLOSE_UPVALUE:
+		return 1, 0, nil
+	case OP_SET_GLOBAL, OP_SET_UPVALUE, OP_GET_PROPERTY, OP_NOT, OP_NEGATE, OP_JUMP_IF_FALSE:
+		return 1, 1, nil
+	case OP_SET_PROPERTY, OP_GET_SUPER, OP_EQUAL, OP_GREATER, OP_LESS, OP_NOT_EQUAL,
+		OP_GREATER_EQUAL, OP_LESS_EQUAL, OP_ADD, OP_SUBTRACT, OP_MULTIPLY, OP_DIVIDE, OP_INHERIT,
+		OP_METHOD:
+		return 2, 1, nil
+	case OP_CALL:
+		// The callee and arguments are replaced by the result
+		return int(v.code[offset+1]) + 1, 1, nil
+	case OP_INVOKE:
+		return int(v.code[offset+1+v.indexWidth(offset)]) + 1, 1, nil
+	case OP_SUPER_INVOKE:
+		// The superclass is popped before the call
+		return int(v.code[offset+1+v.indexWidth(offset)]) + 2, 1, nil
+	case OP_RETURN:
+		return 1, 0, nil
+	default:
+		// OP_JUMP and OP_LOOP
+		return 0, 0, nil
+	}
+}
+
+// successors returns the offsets execution can continue at after the
+// instruction at offset
+func (v *verifier) successors(offset uint) []uint {
+	next := offset + v.lengths[offset]
+	switch v.code[offset] {
+	case OP_RETURN:
+		return nil
+	case OP_JUMP, OP_LOOP:
+		target, _ := v.jumpTarget(offset)
+		return []uint{target}
+	case OP_JUMP_IF_FALSE:
+		target, _ := v.jumpTarget(offset)
+		return []uint{next, target}
+	default:
+		return []uint{next}
+	}
+}
+
+// endregion Stack
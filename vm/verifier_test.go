@@ -0,0 +1,137 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+)
+
+// buildChunk makes a chunk with the given constants and code, all on line 1
+func buildChunk(constants []Value, code ...OpCode) *Chunk {
+	chunk := InitChunk()
+	for _, constant := range constants {
+		AddConstant(&chunk, constant)
+	}
+	for _, instruction := range code {
+		WriteChunk(&chunk, instruction, 1)
+	}
+	return &chunk
+}
+
+// TestVerifiedChunksFailAtRuntime runs chunks which pass verification but
+// misuse classes in ways the compiler never does. They must stop with a
+// runtime error rather than crash the VM.
+func TestVerifiedChunksFailAtRuntime(t *testing.T) {
+	name := StringConstant("m")
+	class := StringConstant("A")
+	number := NumberValue(1)
+
+	tests := []struct {
+		name      string
+		constants []Value
+		code      []OpCode
+		message   string
+	}{
+		{
+			"GET_SUPER on nil",
+			[]Value{name},
+			[]OpCode{OP_NIL, OP_NIL, OP_GET_SUPER, 0, OP_POP, OP_NIL, OP_RETURN},
+			"Superclass must be a class.",
+		},
+		{
+			"SUPER_INVOKE on nil",
+			[]Value{name},
+			[]OpCode{OP_NIL, OP_NIL, OP_SUPER_INVOKE, 0, 0, OP_POP, OP_NIL, OP_RETURN},
+			"Superclass must be a class.",
+		},
+		{
+			"METHOD on nil",
+			[]Value{name},
+			[]OpCode{OP_NIL, OP_NIL, OP_METHOD, 0, OP_POP, OP_NIL, OP_RETURN},
+			"Only classes have methods.",
+		},
+		{
+			"number stored as a method and invoked",
+			[]Value{class, number, name},
+			[]OpCode{OP_CLASS, 0, OP_CONSTANT, 1, OP_METHOD, 2, OP_CALL, 0, OP_INVOKE, 2, 0, OP_POP, OP_NIL, OP_RETURN},
+			"Methods must be functions.",
+		},
+		{
+			"number stored as a method and bound",
+			[]Value{class, number, name},
+			[]OpCode{OP_CLASS, 0, OP_CONSTANT, 1, OP_METHOD, 2, OP_CALL, 0, OP_GET_PROPERTY, 2, OP_POP, OP_NIL, OP_RETURN},
+			"Methods must be functions.",
+		},
+		{
+			"number stored as an initializer",
+			[]Value{class, number, StringConstant("init")},
+			[]OpCode{OP_CLASS, 0, OP_CONSTANT, 1, OP_METHOD, 2, OP_CALL, 0, OP_POP, OP_NIL, OP_RETURN},
+			"Methods must be functions.",
+		},
+		{
+			"INHERIT onto nil",
+			[]Value{class},
+			[]OpCode{OP_CLASS, 0, OP_NIL, OP_INHERIT, OP_POP, OP_NIL, OP_RETURN},
+			"Only classes can inherit.",
+		},
+		{
+			"INHERIT from nil",
+			[]Value{class},
+			[]OpCode{OP_NIL, OP_CLASS, 0, OP_INHERIT, OP_POP, OP_NIL, OP_RETURN},
+			"Superclass must be a class.",
+		},
+	}
+
+	for _, test := range tests {
+		chunk := buildChunk(test.constants, test.code...)
+		if err := chunk.Verify(); err != nil {
+			t.Errorf("%s: chunk failed verification: %v", test.name, err)
+			continue
+		}
+
+		func() {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					t.Errorf("%s: VM panicked: %v", test.name, recovered)
+				}
+			}()
+			_, err := runChunk(t, chunk)
+			var runtimeErr *RuntimeError
+			if !errors.As(err, &runtimeErr) || runtimeErr.Message != test.message {
+				t.Errorf("%s: got error %v, want runtime error %q", test.name, err, test.message)
+			}
+		}()
+	}
+}
+
+func TestVerifyRejectsMalformedChunks(t *testing.T) {
+	name := StringConstant("x")
+	tests := []struct {
+		name      string
+		constants []Value
+		code      []OpCode
+	}{
+		{"no code", nil, nil},
+		{"unknown opcode", nil, []OpCode{255}},
+		{"missing operand", []Value{name}, []OpCode{OP_NIL, OP_CONSTANT}},
+		{"constant out of range", nil, []OpCode{OP_CONSTANT, 0, OP_RETURN}},
+		{"name isn't a string", []Value{NumberValue(1)}, []OpCode{OP_GET_GLOBAL, 0, OP_RETURN}},
+		{"long index missing a byte", []Value{name}, []OpCode{OP_NIL, OP_GET_GLOBAL_LONG, 0, 0}},
+		{"long constant out of range", []Value{name}, []OpCode{OP_GET_GLOBAL_LONG, 0, 1, 0, OP_RETURN}},
+		{"long invoke missing its argument count", []Value{name}, []OpCode{OP_NIL, OP_INVOKE_LONG, 0, 0, 0}},
+		{"stack underflow", nil, []OpCode{OP_POP, OP_POP, OP_NIL, OP_RETURN}},
+		{"runs off the end", nil, []OpCode{OP_NIL}},
+		{"jump into an operand", []Value{name}, []OpCode{OP_JUMP, 0, 1, OP_CONSTANT, 0, OP_RETURN}},
+		{"local above the stack", nil, []OpCode{OP_GET_LOCAL, 5, OP_RETURN}},
+		{"upvalue out of range", nil, []OpCode{OP_GET_UPVALUE, 0, OP_RETURN}},
+		{"heights differ between paths", nil, []OpCode{
+			OP_TRUE, OP_JUMP_IF_FALSE, 0, 1, OP_NIL, OP_NIL, OP_RETURN,
+		}},
+	}
+
+	for _, test := range tests {
+		chunk := buildChunk(test.constants, test.code...)
+		if err := chunk.Verify(); !errors.Is(err, ErrInvalidBytecode) {
+			t.Errorf("%s: got error %v, want ErrInvalidBytecode", test.name, err)
+		}
+	}
+}
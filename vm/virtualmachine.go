@@ -1,23 +1,82 @@
 package vm
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
 )
 
 const DEBUG_PRINT_CODE bool = false
 const DEBUG_TRACE_EXECUTION bool = false
+const DEBUG_STRESS_GC bool = false
+const DEBUG_LOG_GC bool = false
+
+// Maximum depth of nested function calls
+const FRAMES_MAX int = 64
 
 // Maximum Size of the Stack
-const STACK_MAX uint = 256
+const STACK_MAX uint = uint(FRAMES_MAX * UINT8_COUNT)
+
+// Number of instructions run between checks for context cancellation
+const CONTEXT_CHECK_INTERVAL uint64 = 1024
+
+// CallFrame represents a single ongoing function call
+type CallFrame struct {
+	// Closure being executed
+	closure *ClosureObj
+	// Code and constants of the closure's chunk, cached for the run loop
+	code      []OpCode
+	constants []Value
+	// Index of the next instruction in the function's chunk
+	ip uint
+	// Index of the first stack slot the function can use
+	slots uint
+}
 
 type VM struct {
-	chunk    *Chunk
-	ip       uint
-	stack    [STACK_MAX]Value
-	stackTop uint
-	strings  map[string]*string
-	objects  *Obj
+	frames       [FRAMES_MAX]CallFrame
+	frameCount   int
+	stack        [STACK_MAX]Value
+	stackTop     uint
+	openUpvalues *UpvalueObj
+	// Writer print statements and debug output are written to
+	stdout io.Writer
+	// Writer compile and runtime errors are reported to
+	errorOutput io.Writer
+	// Reader the readLine native reads from
+	stdin *bufio.Reader
+	// Instruction currently being executed
+	instruction OpCode
+	// Error which stopped the current run
+	runtimeErr *RuntimeError
+	globals    map[string]Value
+	strings    map[string]*StringObj
+	// Classes of the instances created by FromGo, keyed by Go type
+	hostClasses map[reflect.Type]*ClassObj
+	// Context which stops the current run once it is done
+	ctx context.Context
+	// Optimizations applied to the code compiled by the VM
+	optimizationLevel OptimizationLevel
+	// Execution limits, zero means unlimited
+	maxInstructions uint64
+	maxFrames       int
+	maxHeapBytes    uint
+	// Instructions run by the current call to Interpret
+	instructionCount uint64
+	// Value of instructionCount at which the limits are next checked
+	nextLimitCheck uint64
+	// Set when an allocation takes the heap past maxHeapBytes
+	heapExceeded bool
+	// Compiler of the innermost function being compiled, a root for the garbage collector
+	compiler *Compiler
+	// Garbage collector state
+	bytesAllocated uint
+	nextGC         uint
+	objects        *Obj
+	grayStack      []*Obj
 }
 
 type InterpretResult byte
@@ -31,12 +90,112 @@ const (
 	INTERPRET_RUNTIME_ERROR
 )
 
-func InitVM() VM {
+// Option configures a VM created by InitVM
+type Option func(machine *VM)
+
+// WithStdout sets the writer print statements and debug output are written to
+func WithStdout(w io.Writer) Option {
+	return func(machine *VM) {
+		machine.stdout = w
+	}
+}
+
+// WithStderr sets the writer compile and runtime errors are reported to
+func WithStderr(w io.Writer) Option {
+	return func(machine *VM) {
+		machine.errorOutput = w
+	}
+}
+
+// WithStdin sets the reader the readLine native reads from. A
+// *bufio.Reader is used as is, so it can be shared with the host.
+func WithStdin(r io.Reader) Option {
+	return func(machine *VM) {
+		if reader, ok := r.(*bufio.Reader); ok {
+			machine.stdin = reader
+		} else {
+			machine.stdin = bufio.NewReader(r)
+		}
+	}
+}
+
+// WithOptimizationLevel sets the optimizations applied to compiled code,
+// OPTIMIZE_PEEPHOLE by default
+func WithOptimizationLevel(level OptimizationLevel) Option {
+	return func(machine *VM) {
+		machine.optimizationLevel = level
+	}
+}
+
+// WithMaxInstructions limits the number of instructions each call to
+// Interpret may run, failing with an InstructionLimitError
+func WithMaxInstructions(limit uint64) Option {
+	return func(machine *VM) {
+		machine.maxInstructions = limit
+	}
+}
+
+// WithMaxStackDepth limits the number of calls which may be active at
+// once, failing with a StackDepthError. The depth can't exceed FRAMES_MAX.
+func WithMaxStackDepth(limit int) Option {
+	return func(machine *VM) {
+		machine.maxFrames = limit
+	}
+}
+
+// WithMaxHeapBytes limits the estimated memory used by lox objects,
+// failing with a HeapLimitError once garbage collection can't bring the
+// heap back under limit
+func WithMaxHeapBytes(limit uint) Option {
+	return func(machine *VM) {
+		machine.maxHeapBytes = limit
+	}
+}
+
+// InitVM creates a VM, which uses the standard streams unless options
+// say otherwise
+func InitVM(options ...Option) VM {
 	newVM := VM{}
-	newVM.strings = make(map[string]*string)
+	newVM.stdout = os.Stdout
+	newVM.errorOutput = os.Stderr
+	newVM.globals = make(map[string]Value)
+	newVM.strings = make(map[string]*StringObj)
+	newVM.hostClasses = make(map[reflect.Type]*ClassObj)
+	newVM.nextGC = GC_INITIAL_THRESHOLD
+	newVM.ctx = context.Background()
+	newVM.optimizationLevel = OPTIMIZE_PEEPHOLE
+	for _, option := range options {
+		option(&newVM)
+	}
+	if newVM.stdin == nil {
+		newVM.stdin = bufio.NewReader(os.Stdin)
+	}
+
+	if newVM.maxFrames <= 0 || newVM.maxFrames > FRAMES_MAX {
+		newVM.maxFrames = FRAMES_MAX
+	}
+
+	newVM.DefineNative("clock", 0, clockNative)
+	newVM.defineBuiltin("readLine", 0, readLineNative)
 	return newVM
 }
 
+// SetErrorOutput sets the writer compile and runtime errors are reported to
+func (machine *VM) SetErrorOutput(w io.Writer) {
+	machine.errorOutput = w
+}
+
+// SetGlobal defines or assigns the global variable name
+func (machine *VM) SetGlobal(name string, value Value) {
+	machine.globals[name] = value
+}
+
+// GetGlobal returns the value of the global variable name, and whether it is defined
+func (machine *VM) GetGlobal(name string) (Value, bool) {
+	value, ok := machine.globals[name]
+	return value, ok
+}
+
 func (machine *VM) FreeVM() {
 	currentObject := machine.objects
 	if currentObject == nil {
@@ -50,17 +209,11 @@ func (machine *VM) FreeVM() {
 		if currentObject == nil {
 			break
 		}
-		// Set the current object data to nil
-		// this should drop the reference to the object and
-		// free the memory
-		// Could also just set the references to the whole object to
-		// nil and let the GC collect them, but again, this
-		// is just for learning
-		currentObject.data = nil
 		// Get the next object to work on
 		nextObject := currentObject.next
-		// Drop the reference to the next object from current object
-		currentObject.next = nil
+		// Drop the references held by the object, including the
+		// next object in the list
+		machine.freeObject(currentObject)
 		// If there is no next object exit the loop
 		if nextObject == nil {
 			break
@@ -71,54 +224,89 @@ func (machine *VM) FreeVM() {
 	}
 	// Now that all references within the object chain have been dropped
 	machine.objects = nil
-	// Empty the strings map
-	machine.strings = make(map[string]*string)
+	// Empty the globals and strings maps
+	machine.globals = make(map[string]Value)
+	machine.strings = make(map[string]*StringObj)
+	machine.hostClasses = make(map[reflect.Type]*ClassObj)
+	machine.grayStack = nil
 	// End of function
 	return
 }
 
-func (machine *VM) Interpret(source string) InterpretResult {
-	var chunk Chunk
+// Interpret compiles and runs source. Errors are reported to the error
+// output and returned as a *CompileError or *RuntimeError.
+func (machine *VM) Interpret(source string) (InterpretResult, error) {
+	return machine.interpret(context.Background(), "", source)
+}
+
+// InterpretFile is like Interpret, but records file as the origin of
+// the source in runtime error stack traces
+func (machine *VM) InterpretFile(file string, source string) (InterpretResult, error) {
+	return machine.interpret(context.Background(), file, source)
+}
+
+// InterpretContext is like Interpret, but stops the script with a runtime
+// error once ctx is done. The error's Cause is ctx.Err(). Cancellation is
+// checked between instructions, so a native which blocks isn't interrupted.
+func (machine *VM) InterpretContext(ctx context.Context, source string) (InterpretResult, error) {
+	return machine.interpret(ctx, "", source)
+}
 
-	if !Compile(source, &chunk) {
-		return INTERPRET_COMPILE_ERROR
+func (machine *VM) interpret(ctx context.Context, file string, source string) (InterpretResult, error) {
+	machine.startRun(ctx)
+	defer machine.finishRun()
+
+	function, diagnostics := CompileFile(file, source, machine)
+	for _, diagnostic := range diagnostics {
+		_, _ = fmt.Fprintln(machine.errorOutput, diagnostic)
+	}
+	if function == nil {
+		return INTERPRET_COMPILE_ERROR, &CompileError{Diagnostics: diagnostics}
 	}
+	return machine.runScript(function)
+}
 
-	machine.chunk = &chunk
-	machine.ip = 0
+// startRun resets the execution limits, which apply to each call to Interpret
+func (machine *VM) startRun(ctx context.Context) {
+	machine.ctx = ctx
+	machine.instructionCount = 0
+	// Check the limits on the first instruction, so a context which is
+	// already done stops the script straight away
+	machine.nextLimitCheck = 1
+	machine.heapExceeded = false
+}
+
+// finishRun drops the context of the run, so the VM doesn't keep it alive
+func (machine *VM) finishRun() {
+	machine.ctx = context.Background()
+}
+
+// runScript calls function, the top level code of a script, and runs it to completion
+func (machine *VM) runScript(function *FunctionObj) (InterpretResult, error) {
+	machine.pushValue(objToVal(function))
+	closure := machine.newClosure(function)
+	machine.popValue()
+	machine.pushValue(objToVal(closure))
+	machine.call(closure, 0)
 
 	result := machine.run()
+	if result == INTERPRET_RUNTIME_ERROR {
+		err := machine.runtimeErr
+		machine.runtimeErr = nil
+		_, _ = fmt.Fprintln(machine.errorOutput, err)
+		return result, err
+	}
+	return result, nil
+}
 
-	return result
+func (machine *VM) resetStack() {
+	machine.stackTop = 0
+	machine.frameCount = 0
+	machine.openUpvalues = nil
 }
 
 // Stack Functions
 func (machine *VM) pushValue(value Value) {
-	// Check if the value being added is an object, if it is,
-	// add it to the object linked list
-	// Further, if it is a string, add it to the strings table, and intern it
-	if isObj(value) {
-		newObj := value.data.asObj()
-		// If the object is a string, intern it
-		if isString(newObj) {
-			newString := newObj.data.asString()
-			// Check if the newString already has an entry
-			newStringPointer, ok := machine.strings[*newString]
-			if ok {
-				// The string exists in the hash table
-				newObj.data = &StringObj{value: newStringPointer}
-			} else {
-				// The string doesn't yet exist in the hash table
-				// Insert it
-				machine.strings[*newString] = newString
-				// Then set the newObj to point to it
-				newObj.data = &StringObj{value: newString}
-			}
-		}
-
-		newObj.next = machine.objects
-		machine.objects = newObj
-	}
 	machine.stack[machine.stackTop] = value
 	machine.stackTop++
 }
@@ -128,166 +316,543 @@ func (machine *VM) popValue() Value {
 	return machine.stack[machine.stackTop]
 }
 
-func (machine *VM) readByte() OpCode {
-	instruction := machine.chunk.Code[machine.ip]
-	machine.ip += 1
+func (machine *VM) currentFrame() *CallFrame {
+	return &machine.frames[machine.frameCount-1]
+}
+
+func (frame *CallFrame) readByte() OpCode {
+	instruction := frame.code[frame.ip]
+	frame.ip++
 	return instruction
 }
 
-func (machine *VM) readConstant() Value {
-	return machine.chunk.Constants.values[machine.readByte()]
+func (frame *CallFrame) readShort() uint16 {
+	frame.ip += 2
+	return uint16(frame.code[frame.ip-2])<<8 | uint16(frame.code[frame.ip-1])
 }
 
-func (machine *VM) binaryOp(f func(Value, Value) Value) InterpretResult {
-	if (!isNumber(machine.peek(0)) || !isNumber(machine.peek(1))) &&
-		(!isObj(machine.peek(0)) && !isObj(machine.peek(1))) {
-		machine.runtimeError("Operands must be numbers or strings.")
-		return INTERPRET_RUNTIME_ERROR
+// readConstant reads the constant index of instruction, which is 24 bits
+// for the long forms, and returns the constant
+func (frame *CallFrame) readConstant(instruction OpCode) Value {
+	if instruction.isLong() {
+		frame.ip += 3
+		index := uint(frame.code[frame.ip-3])<<16 | uint(frame.code[frame.ip-2])<<8 | uint(frame.code[frame.ip-1])
+		return frame.constants[index]
 	}
-	// If they are both object, make sure they are both strings
-	if !isNumber(machine.peek(0)) || !isNumber(machine.peek(1)) {
-		if !isString(machine.peek(0).data.asObj()) || !isString(machine.peek(1).data.asObj()) {
-			machine.runtimeError("Operands must be numbers or strings.")
-			return INTERPRET_RUNTIME_ERROR
+	return frame.constants[frame.readByte()]
+}
+
+func (frame *CallFrame) readString(instruction OpCode) *string {
+	return valAsObj(frame.readConstant(instruction)).data.asString()
+}
+
+func (machine *VM) callValue(callee Value, argCount int) bool {
+	if isObj(callee) {
+		calleeObj := valAsObj(callee)
+		switch calleeObj.typeof {
+		case BOUND_METHOD_TYPE:
+			bound := calleeObj.data.asBoundMethod()
+			machine.stack[machine.stackTop-uint(argCount)-1] = bound.receiver
+			return machine.call(bound.method, argCount)
+		case CLASS_TYPE:
+			class := calleeObj.data.asClass()
+			machine.stack[machine.stackTop-uint(argCount)-1] = objToVal(machine.newInstance(class))
+			if initializer, ok := class.methods["init"]; ok {
+				return machine.call(valAsObj(initializer).data.asClosure(), argCount)
+			} else if argCount != 0 {
+				machine.runtimeError("Expected 0 arguments but got %d.", argCount)
+				return false
+			}
+			return true
+		case CLOSURE_TYPE:
+			return machine.call(calleeObj.data.asClosure(), argCount)
+		case NATIVE_TYPE:
+			return machine.callNative(calleeObj.data.asNative(), argCount)
+		default:
+			// Non-callable object type
 		}
 	}
+	machine.runtimeError("Can only call functions and classes.")
+	return false
+}
+
+func (machine *VM) call(closure *ClosureObj, argCount int) bool {
+	if argCount != closure.function.arity {
+		machine.runtimeError("Expected %d arguments but got %d.", closure.function.arity, argCount)
+		return false
+	}
+
+	// Make sure there is room for every slot the frame uses before pushing it
+	slots := machine.stackTop - uint(argCount) - 1
+	if machine.frameCount >= machine.maxFrames || slots+uint(closure.function.maxSlots) > STACK_MAX {
+		machine.runtimeError("Stack overflow.")
+		machine.runtimeErr.Cause = &StackDepthError{Limit: machine.maxFrames}
+		return false
+	}
 
-	a := machine.popValue()
-	b := machine.popValue()
-	machine.pushValue(f(b, a))
-	return INTERPRET_OK
+	frame := &machine.frames[machine.frameCount]
+	machine.frameCount++
+	frame.closure = closure
+	frame.code = closure.function.chunk.Code
+	frame.constants = closure.function.chunk.Constants.values
+	frame.ip = 0
+	frame.slots = slots
+	return true
 }
 
+func (machine *VM) invokeFromClass(class *ClassObj, name *string, argCount int) bool {
+	method, ok := class.methods[*name]
+	if !ok {
+		machine.runtimeError("Undefined property '%s'.", *name)
+		return false
+	}
+	return machine.call(valAsObj(method).data.asClosure(), argCount)
+}
+
+// invoke calls a method directly without creating an intermediate bound method
+func (machine *VM) invoke(name *string, argCount int) bool {
+	receiver := machine.peek(uint(argCount))
+	if !isObj(receiver) || !isInstance(valAsObj(receiver)) {
+		machine.runtimeError("Only instances have methods.")
+		return false
+	}
+
+	instance := valAsObj(receiver).data.asInstance()
+
+	// Fields shadow methods, so check them first
+	if value, ok := instance.fields[*name]; ok {
+		machine.stack[machine.stackTop-uint(argCount)-1] = value
+		return machine.callValue(value, argCount)
+	}
+
+	return machine.invokeFromClass(instance.class, name, argCount)
+}
+
+// bindMethod replaces the instance on top of the stack with its method bound to it
+func (machine *VM) bindMethod(class *ClassObj, name *string) bool {
+	method, ok := class.methods[*name]
+	if !ok {
+		machine.runtimeError("Undefined property '%s'.", *name)
+		return false
+	}
+
+	bound := machine.newBoundMethod(machine.peek(0), valAsObj(method).data.asClosure())
+	machine.popValue()
+	machine.pushValue(objToVal(bound))
+	return true
+}
+
+// captureUpvalue returns the open upvalue for the given stack slot,
+// creating it if no closure has captured the slot yet
+func (machine *VM) captureUpvalue(slot uint) *UpvalueObj {
+	var prevUpvalue *UpvalueObj
+	upvalue := machine.openUpvalues
+	for upvalue != nil && upvalue.slot > slot {
+		prevUpvalue = upvalue
+		upvalue = upvalue.next
+	}
+
+	if upvalue != nil && upvalue.slot == slot {
+		return upvalue
+	}
+
+	createdUpvalue := machine.newUpvalue(&machine.stack[slot], slot)
+	createdUpvalue.next = upvalue
+
+	if prevUpvalue == nil {
+		machine.openUpvalues = createdUpvalue
+	} else {
+		prevUpvalue.next = createdUpvalue
+	}
+
+	return createdUpvalue
+}
+
+// defineMethod adds the closure on top of the stack to the class below it.
+// Compiled code always has a class and a closure there, but a loaded chunk
+// might not, and every method being a closure is what lets calls to them
+// skip the check.
+func (machine *VM) defineMethod(name *string) bool {
+	if !isObj(machine.peek(1)) || !isClass(valAsObj(machine.peek(1))) {
+		machine.runtimeError("Only classes have methods.")
+		return false
+	}
+	if !isObj(machine.peek(0)) || !isClosure(valAsObj(machine.peek(0))) {
+		machine.runtimeError("Methods must be functions.")
+		return false
+	}
+
+	class := valAsObj(machine.peek(1)).data.asClass()
+	class.methods[*name] = machine.peek(0)
+	machine.popValue()
+	return true
+}
+
+// closeUpvalues moves every variable at or above the last stack slot
+// off the stack and into its upvalue
+func (machine *VM) closeUpvalues(last uint) {
+	for machine.openUpvalues != nil && machine.openUpvalues.slot >= last {
+		upvalue := machine.openUpvalues
+		upvalue.closed = *upvalue.location
+		upvalue.location = &upvalue.closed
+		machine.openUpvalues = upvalue.next
+	}
+}
+
+// run executes instructions until the outermost frame returns. The
+// current frame is cached in a local and reloaded whenever a call or
+// return changes it.
 func (machine *VM) run() InterpretResult {
+	frame := machine.currentFrame()
 	for {
-		// Check if the ip is beyond the instructions
-		if machine.ip >= uint(len(machine.chunk.Code)) {
-			return INTERPRET_OK // Reached the end of the instructions
-		}
-
 		if DEBUG_TRACE_EXECUTION {
-			disassembleInstruction(machine.chunk, machine.ip)
+			disassembleInstruction(machine.stdout, &frame.closure.function.chunk, frame.ip)
 			for slot := uint(0); slot < machine.stackTop; slot++ {
-				fmt.Printf("[ ")
-				printValue(machine.stack[slot])
-				fmt.Printf(" ] ")
+				_, _ = fmt.Fprintf(machine.stdout, "[ ")
+				printValue(machine.stdout, machine.stack[slot])
+				_, _ = fmt.Fprintf(machine.stdout, " ] ")
 			}
-			fmt.Printf("\n")
+			_, _ = fmt.Fprintf(machine.stdout, "\n")
 		}
-		var instruction OpCode
-		instruction = machine.readByte()
+		instruction := frame.readByte()
+		machine.instruction = instruction
+		machine.instructionCount++
+		if machine.instructionCount >= machine.nextLimitCheck && !machine.checkLimits() {
+			return INTERPRET_RUNTIME_ERROR
+		}
+
 		switch instruction {
-		case OP_CONSTANT:
-			constant := machine.readConstant()
-			machine.pushValue(constant)
+		case OP_CONSTANT, OP_CONSTANT_LONG:
+			machine.pushValue(frame.readConstant(instruction))
 		case OP_NIL:
 			machine.pushValue(nilToVal())
 		case OP_TRUE:
 			machine.pushValue(boolToVal(true))
 		case OP_FALSE:
 			machine.pushValue(boolToVal(false))
+		case OP_POP:
+			machine.stackTop--
+		case OP_GET_LOCAL:
+			slot := frame.readByte()
+			machine.pushValue(machine.stack[frame.slots+uint(slot)])
+		case OP_SET_LOCAL:
+			slot := frame.readByte()
+			machine.stack[frame.slots+uint(slot)] = machine.peek(0)
+		case OP_GET_UPVALUE:
+			slot := frame.readByte()
+			machine.pushValue(*frame.closure.upvalues[slot].location)
+		case OP_SET_UPVALUE:
+			slot := frame.readByte()
+			*frame.closure.upvalues[slot].location = machine.peek(0)
+		case OP_GET_PROPERTY, OP_GET_PROPERTY_LONG:
+			if !isObj(machine.peek(0)) || !isInstance(valAsObj(machine.peek(0))) {
+				machine.runtimeError("Only instances have properties.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			instance := valAsObj(machine.peek(0)).data.asInstance()
+			name := frame.readString(instruction)
+
+			if value, ok := instance.fields[*name]; ok {
+				machine.stack[machine.stackTop-1] = value
+				break
+			}
+
+			if !machine.bindMethod(instance.class, name) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_SET_PROPERTY, OP_SET_PROPERTY_LONG:
+			if !isObj(machine.peek(1)) || !isInstance(valAsObj(machine.peek(1))) {
+				machine.runtimeError("Only instances have fields.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			instance := valAsObj(machine.peek(1)).data.asInstance()
+			instance.fields[*frame.readString(instruction)] = machine.peek(0)
+			// Replace the instance with the assigned value
+			value := machine.popValue()
+			machine.stack[machine.stackTop-1] = value
+		case OP_GET_SUPER, OP_GET_SUPER_LONG:
+			name := frame.readString(instruction)
+			if !isObj(machine.peek(0)) || !isClass(valAsObj(machine.peek(0))) {
+				return machine.superclassError()
+			}
+			superclass := valAsObj(machine.popValue()).data.asClass()
+
+			if !machine.bindMethod(superclass, name) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		case OP_GET_GLOBAL, OP_GET_GLOBAL_LONG:
+			name := frame.readString(instruction)
+			value, ok := machine.globals[*name]
+			if !ok {
+				machine.runtimeError("Undefined variable '%s'.", *name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			machine.pushValue(value)
+		case OP_DEFINE_GLOBAL, OP_DEFINE_GLOBAL_LONG:
+			name := frame.readString(instruction)
+			machine.globals[*name] = machine.popValue()
+		case OP_SET_GLOBAL, OP_SET_GLOBAL_LONG:
+			name := frame.readString(instruction)
+			if _, ok := machine.globals[*name]; !ok {
+				machine.runtimeError("Undefined variable '%s'.", *name)
+				return INTERPRET_RUNTIME_ERROR
+			}
+			machine.globals[*name] = machine.peek(0)
 		case OP_EQUAL:
-			a := machine.popValue()
 			b := machine.popValue()
-			machine.pushValue(boolToVal(valuesEqual(a, b)))
+			machine.stack[machine.stackTop-1] = boolToVal(valuesEqual(machine.peek(0), b))
 		case OP_GREATER:
-			machine.binaryOp(greater)
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
+			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = boolToVal(valAsNumber(a) > valAsNumber(b))
 		case OP_LESS:
-			machine.binaryOp(less)
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
+			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = boolToVal(valAsNumber(a) < valAsNumber(b))
+		case OP_NOT_EQUAL:
+			b := machine.popValue()
+			machine.stack[machine.stackTop-1] = boolToVal(!valuesEqual(machine.peek(0), b))
+		case OP_GREATER_EQUAL:
+			// Negates OP_LESS rather than using >=, so comparisons with NaN
+			// give the same result as OP_LESS followed by OP_NOT
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
+			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = boolToVal(!(valAsNumber(a) < valAsNumber(b)))
+		case OP_LESS_EQUAL:
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
+			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = boolToVal(!(valAsNumber(a) > valAsNumber(b)))
 		case OP_ADD:
-			res := machine.binaryOp(add)
-			if res != INTERPRET_OK {
-				return res
+			a, b := machine.peek(1), machine.peek(0)
+			if isNumber(a) && isNumber(b) {
+				machine.stackTop--
+				machine.stack[machine.stackTop-1] = numberToVal(valAsNumber(a) + valAsNumber(b))
+			} else if isObj(a) && isString(valAsObj(a)) && isObj(b) && isString(valAsObj(b)) {
+				machine.concatenate()
+			} else {
+				machine.runtimeError("Operands must be two numbers or two strings.")
+				return INTERPRET_RUNTIME_ERROR
 			}
 		case OP_SUBTRACT:
-			res := machine.binaryOp(subtract)
-			if res != INTERPRET_OK {
-				return res
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
 			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = numberToVal(valAsNumber(a) - valAsNumber(b))
 		case OP_MULTIPLY:
-			res := machine.binaryOp(multiply)
-			if res != INTERPRET_OK {
-				return res
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
 			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = numberToVal(valAsNumber(a) * valAsNumber(b))
 		case OP_DIVIDE:
-			res := machine.binaryOp(divide)
-			if res != INTERPRET_OK {
-				return res
+			a, b := machine.peek(1), machine.peek(0)
+			if !isNumber(a) || !isNumber(b) {
+				return machine.numberOperandsError()
 			}
+			machine.stackTop--
+			machine.stack[machine.stackTop-1] = numberToVal(valAsNumber(a) / valAsNumber(b))
 		case OP_NOT:
-			machine.pushValue(boolToVal(isFalsey(machine.popValue())))
+			machine.stack[machine.stackTop-1] = boolToVal(isFalsey(machine.peek(0)))
 		case OP_NEGATE:
 			if !isNumber(machine.peek(0)) {
 				machine.runtimeError("Operand must be a number.")
 				return INTERPRET_RUNTIME_ERROR
 			}
-			machine.pushValue(numberToVal(-valAsNumber(machine.popValue())))
+			machine.stack[machine.stackTop-1] = numberToVal(-valAsNumber(machine.peek(0)))
 		case OP_PRINT:
-			printValue(machine.popValue())
-			fmt.Print("\n")
+			printValue(machine.stdout, machine.popValue())
+			_, _ = fmt.Fprint(machine.stdout, "\n")
+		case OP_JUMP:
+			offset := frame.readShort()
+			frame.ip += uint(offset)
+		case OP_JUMP_IF_FALSE:
+			offset := frame.readShort()
+			if isFalsey(machine.peek(0)) {
+				frame.ip += uint(offset)
+			}
+		case OP_LOOP:
+			offset := frame.readShort()
+			frame.ip -= uint(offset)
+		case OP_CALL:
+			argCount := int(frame.readByte())
+			if !machine.callValue(machine.peek(uint(argCount)), argCount) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = machine.currentFrame()
+		case OP_INVOKE, OP_INVOKE_LONG:
+			method := frame.readString(instruction)
+			argCount := int(frame.readByte())
+			if !machine.invoke(method, argCount) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = machine.currentFrame()
+		case OP_SUPER_INVOKE, OP_SUPER_INVOKE_LONG:
+			method := frame.readString(instruction)
+			argCount := int(frame.readByte())
+			if !isObj(machine.peek(0)) || !isClass(valAsObj(machine.peek(0))) {
+				return machine.superclassError()
+			}
+			superclass := valAsObj(machine.popValue()).data.asClass()
+			if !machine.invokeFromClass(superclass, method, argCount) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+			frame = machine.currentFrame()
+		case OP_CLOSURE, OP_CLOSURE_LONG:
+			function := valAsObj(frame.readConstant(instruction)).data.asFunction()
+			closure := machine.newClosure(function)
+			machine.pushValue(objToVal(closure))
+			for i := range closure.upvalues {
+				isLocal := frame.readByte()
+				index := frame.readByte()
+				if isLocal == 1 {
+					closure.upvalues[i] = machine.captureUpvalue(frame.slots + uint(index))
+				} else {
+					closure.upvalues[i] = frame.closure.upvalues[index]
+				}
+			}
+		case OP_CLOSE_UPVALUE:
+			machine.closeUpvalues(machine.stackTop - 1)
+			machine.stackTop--
+		case OP_RETURN:
+			result := machine.popValue()
+			machine.closeUpvalues(frame.slots)
+			machine.frameCount--
+			if machine.frameCount == 0 {
+				// Drop the script closure
+				machine.stackTop = frame.slots
+				return INTERPRET_OK
+			}
+
+			machine.stackTop = frame.slots
+			machine.pushValue(result)
+			frame = machine.currentFrame()
+		case OP_CLASS, OP_CLASS_LONG:
+			machine.pushValue(objToVal(machine.newClass(frame.readString(instruction))))
+		case OP_INHERIT:
+			superclass := machine.peek(1)
+			if !isObj(superclass) || !isClass(valAsObj(superclass)) {
+				return machine.superclassError()
+			}
+			if !isObj(machine.peek(0)) || !isClass(valAsObj(machine.peek(0))) {
+				machine.runtimeError("Only classes can inherit.")
+				return INTERPRET_RUNTIME_ERROR
+			}
+
+			subclass := valAsObj(machine.peek(0)).data.asClass()
+			for name, method := range valAsObj(superclass).data.asClass().methods {
+				subclass.methods[name] = method
+			}
+			machine.stackTop-- // Subclass
+		case OP_METHOD, OP_METHOD_LONG:
+			if !machine.defineMethod(frame.readString(instruction)) {
+				return INTERPRET_RUNTIME_ERROR
+			}
+		default:
+			machine.runtimeError("Unknown opcode %d.", instruction)
+			return INTERPRET_RUNTIME_ERROR
 		}
 	}
 }
 
-func (machine *VM) peek(position uint) Value {
-	return machine.stack[machine.stackTop-1-position]
+// numberOperandsError raises the error for a binary operator which
+// requires numbers
+func (machine *VM) numberOperandsError() InterpretResult {
+	machine.runtimeError("Operands must be numbers.")
+	return INTERPRET_RUNTIME_ERROR
 }
 
-func (machine *VM) runtimeError(format string, args ...interface{}) {
-	_, _ = fmt.Fprintf(os.Stderr, format, args...)
-	_, _ = os.Stderr.WriteString("\n")
+// superclassError raises the error for inheriting from, or looking up a
+// method on, a superclass which isn't a class
+func (machine *VM) superclassError() InterpretResult {
+	machine.runtimeError("Superclass must be a class.")
+	return INTERPRET_RUNTIME_ERROR
+}
 
-	instruction := machine.ip - 1
-	line := machine.chunk.Lines[instruction]
-	_, _ = fmt.Fprintf(os.Stderr, "[line %d] in script\n", line)
+// concatenate replaces the two strings on top of the stack with their concatenation
+func (machine *VM) concatenate() {
+	// Leave the operands on the stack while allocating, so the
+	// garbage collector can find them
+	b := valAsObj(machine.peek(0)).data.asString()
+	a := valAsObj(machine.peek(1)).data.asString()
+	result := machine.copyString(*a + *b)
+	machine.stackTop--
+	machine.stack[machine.stackTop-1] = objToVal(result)
 }
 
-// Functions Passed to Binary
-func add(a Value, b Value) Value {
-	if isObj(a) && isObj(b) {
-		if !isString(a.data.asObj()) || !isString(b.data.asObj()) {
-			panic("Tried to add two objects which are not both strings")
-		}
-		aString := a.data.asObj().data.asString()
-		bString := b.data.asObj().data.asString()
-		newString := *aString + *bString
-		return objToVal(&newString)
+func (machine *VM) peek(position uint) Value {
+	return machine.stack[machine.stackTop-1-position]
+}
 
-	} else if isNumber(a) && isNumber(b) {
-		return numberToVal(a.data.asNumber() + b.data.asNumber())
+// checkLimits raises a runtime error and returns false once the script
+// has run out of instructions or heap, or its context is done. The run
+// loop only calls it once instructionCount reaches nextLimitCheck.
+func (machine *VM) checkLimits() bool {
+	if machine.maxInstructions > 0 && machine.instructionCount > machine.maxInstructions {
+		machine.runtimeError("Instruction limit exceeded.")
+		machine.runtimeErr.Cause = &InstructionLimitError{Limit: machine.maxInstructions}
+		return false
 	}
-	panic("Tried to add non-numbers.")
 
-}
-func subtract(a Value, b Value) Value {
-	if !isNumber(a) || !isNumber(b) {
-		panic("Tried to subtract non-numbers.")
+	if machine.heapExceeded {
+		allocated := machine.bytesAllocated
+		machine.runtimeError("Heap limit exceeded.")
+		machine.runtimeErr.Cause = &HeapLimitError{Limit: machine.maxHeapBytes, Allocated: allocated}
+		return false
 	}
-	return numberToVal(a.data.asNumber() - b.data.asNumber())
-}
-func multiply(a Value, b Value) Value {
-	if !isNumber(a) || !isNumber(b) {
-		panic("Tried to multiply non-numbers.")
+
+	if err := machine.ctx.Err(); err != nil {
+		machine.runtimeError("Interrupted: %s.", err)
+		machine.runtimeErr.Cause = err
+		return false
 	}
-	return numberToVal(a.data.asNumber() * b.data.asNumber())
-}
-func divide(a Value, b Value) Value {
-	if !isNumber(a) || !isNumber(b) {
-		panic("Tried to divide non-numbers.")
+
+	machine.nextLimitCheck = machine.instructionCount + CONTEXT_CHECK_INTERVAL
+	if machine.maxInstructions > 0 && machine.nextLimitCheck > machine.maxInstructions+1 {
+		machine.nextLimitCheck = machine.maxInstructions + 1
 	}
-	return numberToVal(a.data.asNumber() / b.data.asNumber())
+	return true
 }
 
-func less(a Value, b Value) Value {
-	if !isNumber(a) || !isNumber(b) {
-		panic("Tried to compare non-numbers.")
+// runtimeError records the error which stopped the current run, along
+// with a trace of the active calls, and unwinds the stack
+func (machine *VM) runtimeError(format string, args ...interface{}) {
+	err := &RuntimeError{
+		Message: fmt.Sprintf(format, args...),
+		OpCode:  machine.instruction,
 	}
-	return boolToVal(a.data.asNumber() < b.data.asNumber())
-}
 
-func greater(a Value, b Value) Value {
-	if !isNumber(a) || !isNumber(b) {
-		panic("Tried to compare non-numbers.")
+	for i := machine.frameCount - 1; i >= 0; i-- {
+		frame := &machine.frames[i]
+		function := frame.closure.function
+		instruction := frame.ip - 1
+		name := "script"
+		if function.name != nil {
+			name = *function.name
+		}
+		err.Frames = append(err.Frames, StackFrame{
+			Function: name,
+			File:     function.file,
+			Line:     function.chunk.Lines[instruction],
+		})
 	}
-	return boolToVal(a.data.asNumber() > b.data.asNumber())
+
+	machine.runtimeErr = err
+	machine.resetStack()
 }